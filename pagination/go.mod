@@ -0,0 +1,5 @@
+module github.com/FilipVdZel/pagination
+
+go 1.13
+
+require go.mongodb.org/mongo-driver v1.8.2
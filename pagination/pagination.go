@@ -0,0 +1,318 @@
+// Package pagination pages through Mongo collections for the list
+// endpoints of webUsers and webSubscriptions. Pages are sorted on one field
+// with _id as tie breaker and continue from a cursor signed with HMAC, so
+// clients can not hand in positions or values of their own.
+package pagination
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Default and largest page size for list endpoints
+const (
+	DefaultLimit = 50
+	MaxLimit     = 500
+)
+
+var (
+	errBadCursor  = errors.New("cursor is not valid")
+	errCursorSort = errors.New("cursor was created with a different sort")
+)
+
+// Page is the envelope returned by list endpoints
+type Page struct {
+	Data  interface{} `json:"data"`
+	Total int64       `json:"total"`
+	Limit int64       `json:"limit"`
+	Next  string      `json:"next,omitempty"`
+}
+
+// Field is a field pages can be sorted on and the BSON type of its values
+type Field struct {
+	Name string
+	Type bsontype.Type
+}
+
+// Pager parses page requests and signs their cursors
+type Pager struct {
+	key []byte
+}
+
+// New returns a Pager signing cursors with a key derived from secret.
+// Replicas of a service must use the same secret to accept each other's
+// cursors.
+func New(secret string) *Pager {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("pagination cursor"))
+	return &Pager{key: mac.Sum(nil)}
+}
+
+// Request holds the parsed limit, sort, fields and cursor parameters
+type Request struct {
+	Limit      int64
+	SortField  string
+	Descending bool
+	Fields     []string
+
+	pager *Pager
+	after *cursor
+}
+
+// cursor marks the last document of the previous page
+type cursor struct {
+	Sort  string             `bson:"s"`
+	Value bson.RawValue      `bson:"v,omitempty"`
+	ID    primitive.ObjectID `bson:"id"`
+}
+
+// missing reports if the document had no value for the sort field
+func (after *cursor) missing() bool {
+	return after.Value.Type == 0 || after.Value.Type == bsontype.Null
+}
+
+// contains reports if the list holds the value
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Parse reads the paging parameters. Only fields in sortable can be sorted
+// on and only fields in selectable can be selected.
+func (pager *Pager) Parse(params url.Values, sortable []Field, selectable []string) (Request, error) {
+	page := Request{Limit: DefaultLimit, SortField: "_id", pager: pager}
+
+	if limit := params.Get("limit"); limit != "" {
+		n, err := strconv.ParseInt(limit, 10, 64)
+		if err != nil || n < 1 || n > MaxLimit {
+			return page, errors.New("limit must be a number from 1 to " + strconv.Itoa(MaxLimit))
+		}
+		page.Limit = n
+	}
+
+	sortType := bsontype.ObjectID
+	if sort := params.Get("sort"); sort != "" {
+		if strings.HasPrefix(sort, "-") {
+			page.Descending = true
+			sort = sort[1:]
+		}
+		names := make([]string, len(sortable))
+		found := false
+		for i, field := range sortable {
+			names[i] = field.Name
+			if field.Name == sort {
+				sortType = field.Type
+				found = true
+			}
+		}
+		if !found {
+			return page, errors.New("can not sort on '" + sort + "', use one of " + strings.Join(names, ", "))
+		}
+		page.SortField = sort
+	}
+
+	if fields := params.Get("fields"); fields != "" {
+		for _, field := range strings.Split(fields, ",") {
+			field = strings.TrimSpace(field)
+			if !contains(selectable, field) {
+				return page, errors.New("unknown field '" + field + "', use any of " + strings.Join(selectable, ", "))
+			}
+			page.Fields = append(page.Fields, field)
+		}
+	}
+
+	if token := params.Get("cursor"); token != "" {
+		after, err := pager.decode(token)
+		if err != nil {
+			return page, err
+		}
+		if after.Sort != page.sortKey() {
+			return page, errCursorSort
+		}
+		// Sorting on _id keeps the position in ID only
+		if page.SortField != "_id" && !after.missing() && after.Value.Type != sortType {
+			return page, errBadCursor
+		}
+		page.after = &after
+	}
+	return page, nil
+}
+
+// sign returns the HMAC of the encoded cursor
+func (pager *Pager) sign(data []byte) []byte {
+	mac := hmac.New(sha256.New, pager.key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// encode serializes the cursor followed by its signature
+func (pager *Pager) encode(after bson.D) (string, error) {
+	data, err := bson.Marshal(after)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data) + "." + base64.RawURLEncoding.EncodeToString(pager.sign(data)), nil
+}
+
+// decode checks the signature of the token and returns its cursor
+func (pager *Pager) decode(token string) (cursor, error) {
+	var after cursor
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return after, errBadCursor
+	}
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return after, errBadCursor
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(sig, pager.sign(data)) {
+		return after, errBadCursor
+	}
+	if err := bson.Unmarshal(data, &after); err != nil {
+		return after, errBadCursor
+	}
+	return after, nil
+}
+
+// sortKey is the sort parameter the page was requested with
+func (page Request) sortKey() string {
+	if page.Descending {
+		return "-" + page.SortField
+	}
+	return page.SortField
+}
+
+// Projection loads only the selected fields plus the ones paging needs.
+// Without a fields parameter the fallback projection is used.
+func (page Request) Projection(fallback bson.M, always ...string) bson.M {
+	if len(page.Fields) == 0 {
+		return fallback
+	}
+	projection := bson.M{"_id": 1, page.SortField: 1}
+	for _, field := range append(page.Fields, always...) {
+		projection[field] = 1
+	}
+	return projection
+}
+
+// Filter adds the position of the cursor to the base filter.
+// Documents missing the sort field sort before all others in Mongo.
+func (page Request) Filter(base bson.M) bson.M {
+	if page.after == nil {
+		return base
+	}
+	field, value, id := page.SortField, page.after.Value, page.after.ID
+	var after bson.M
+	switch {
+	case field == "_id" && page.Descending:
+		after = bson.M{"_id": bson.M{"$lt": id}}
+	case field == "_id":
+		after = bson.M{"_id": bson.M{"$gt": id}}
+	case page.after.missing() && page.Descending:
+		after = bson.M{field: nil, "_id": bson.M{"$lt": id}}
+	case page.after.missing():
+		after = bson.M{"$or": bson.A{
+			bson.M{field: nil, "_id": bson.M{"$gt": id}},
+			bson.M{field: bson.M{"$ne": nil}},
+		}}
+	case page.Descending:
+		after = bson.M{"$or": bson.A{
+			bson.M{field: bson.M{"$lt": value}},
+			bson.M{field: value, "_id": bson.M{"$lt": id}},
+			bson.M{field: nil},
+		}}
+	default:
+		after = bson.M{"$or": bson.A{
+			bson.M{field: bson.M{"$gt": value}},
+			bson.M{field: value, "_id": bson.M{"$gt": id}},
+		}}
+	}
+	if len(base) == 0 {
+		return after
+	}
+	return bson.M{"$and": bson.A{base, after}}
+}
+
+// findOptions sorts with _id as tie breaker and asks for one extra
+// document to learn if there is a next page
+func (page Request) findOptions(projection bson.M) *options.FindOptions {
+	direction := 1
+	if page.Descending {
+		direction = -1
+	}
+	sort := bson.D{{Key: page.SortField, Value: direction}}
+	if page.SortField != "_id" {
+		sort = append(sort, bson.E{Key: "_id", Value: direction})
+	}
+	return options.Find().
+		SetSort(sort).
+		SetLimit(page.Limit + 1).
+		SetProjection(projection)
+}
+
+// CursorAfter encodes the position of the document for the next link
+func (page Request) CursorAfter(last bson.Raw) (string, error) {
+	after := bson.D{{Key: "s", Value: page.sortKey()}}
+	if id, ok := last.Lookup("_id").ObjectIDOK(); ok {
+		after = append(after, bson.E{Key: "id", Value: id})
+	}
+	if value, err := last.LookupErr(page.SortField); err == nil && value.Type != bsontype.Null && page.SortField != "_id" {
+		after = append(after, bson.E{Key: "v", Value: value})
+	}
+	return page.pager.encode(after)
+}
+
+// Find runs the query for one page. It returns the raw documents, the
+// number of documents matching base and the link to the next page.
+func Find(ctx context.Context, collection *mongo.Collection, req *http.Request, page Request, base bson.M, projection bson.M) ([]bson.Raw, int64, string, error) {
+	found, err := collection.Find(ctx, page.Filter(base), page.findOptions(projection))
+	if err != nil {
+		return nil, 0, "", err
+	}
+	docs := []bson.Raw{}
+	err = found.All(ctx, &docs)
+	if err != nil {
+		return nil, 0, "", err
+	}
+
+	var total int64
+	if len(base) == 0 {
+		total, err = collection.EstimatedDocumentCount(ctx)
+	} else {
+		total, err = collection.CountDocuments(ctx, base)
+	}
+	if err != nil {
+		return nil, 0, "", err
+	}
+
+	var next string
+	if int64(len(docs)) > page.Limit {
+		docs = docs[:page.Limit]
+		token, err := page.CursorAfter(docs[len(docs)-1])
+		if err != nil {
+			return nil, 0, "", err
+		}
+		query := req.URL.Query()
+		query.Set("cursor", token)
+		next = req.URL.Path + "?" + query.Encode()
+	}
+	return docs, total, next, nil
+}
@@ -0,0 +1,211 @@
+package pagination
+
+import (
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var (
+	testSortable   = []Field{{Name: "name", Type: bsontype.String}, {Name: "createdAt", Type: bsontype.DateTime}}
+	testSelectable = []string{"name", "description"}
+)
+
+// cursorFor returns the cursor after a document with the given fields
+func cursorFor(t *testing.T, pager *Pager, params url.Values, doc bson.M) string {
+	page, err := pager.Parse(params, testSortable, testSelectable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := bson.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := page.CursorAfter(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// roundTrip marshals the filter and reads it back
+func roundTrip(t *testing.T, filter bson.M) bson.M {
+	data, err := bson.Marshal(filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded bson.M
+	if err := bson.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	return decoded
+}
+
+func TestParse(t *testing.T) {
+	pager := New("secret")
+	tests := []struct {
+		query string
+		want  Request
+		err   string
+	}{
+		{"", Request{Limit: DefaultLimit, SortField: "_id"}, ""},
+		{"limit=20&sort=-name&fields=name,%20description", Request{Limit: 20, SortField: "name", Descending: true, Fields: []string{"name", "description"}}, ""},
+		{"limit=0", Request{}, "limit must be a number from 1 to 500"},
+		{"limit=501", Request{}, "limit must be a number from 1 to 500"},
+		{"limit=ten", Request{}, "limit must be a number"},
+		{"sort=password", Request{}, "can not sort on 'password', use one of name, createdAt"},
+		{"fields=password", Request{}, "unknown field 'password'"},
+		{"cursor=abc", Request{}, "cursor is not valid"},
+	}
+	for _, test := range tests {
+		params, _ := url.ParseQuery(test.query)
+		page, err := pager.Parse(params, testSortable, testSelectable)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("Parse(%s) error = %v, want %q", test.query, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Parse(%s) failed: %v", test.query, err)
+			continue
+		}
+		page.pager = nil
+		if !reflect.DeepEqual(page, test.want) {
+			t.Errorf("Parse(%s) = %+v, want %+v", test.query, page, test.want)
+		}
+	}
+}
+
+func TestCursorRoundTrip(t *testing.T) {
+	pager := New("secret")
+	id := primitive.NewObjectID()
+	created := primitive.NewDateTimeFromTime(time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC))
+	tests := []struct {
+		name   string
+		sort   string
+		doc    bson.M
+		filter bson.M
+	}{
+		{
+			name:   "by id",
+			sort:   "",
+			doc:    bson.M{"_id": id, "name": "ann"},
+			filter: bson.M{"_id": bson.M{"$gt": id}},
+		},
+		{
+			name: "by name",
+			sort: "name",
+			doc:  bson.M{"_id": id, "name": "ann"},
+			filter: bson.M{"$or": bson.A{
+				bson.M{"name": bson.M{"$gt": "ann"}},
+				bson.M{"name": "ann", "_id": bson.M{"$gt": id}},
+			}},
+		},
+		{
+			name: "by date descending",
+			sort: "-createdAt",
+			doc:  bson.M{"_id": id, "createdAt": created},
+			filter: bson.M{"$or": bson.A{
+				bson.M{"createdAt": bson.M{"$lt": created}},
+				bson.M{"createdAt": created, "_id": bson.M{"$lt": id}},
+				bson.M{"createdAt": nil},
+			}},
+		},
+		{
+			name: "missing sort field",
+			sort: "name",
+			doc:  bson.M{"_id": id},
+			filter: bson.M{"$or": bson.A{
+				bson.M{"name": nil, "_id": bson.M{"$gt": id}},
+				bson.M{"name": bson.M{"$ne": nil}},
+			}},
+		},
+	}
+	for _, test := range tests {
+		params := url.Values{}
+		if test.sort != "" {
+			params.Set("sort", test.sort)
+		}
+		params.Set("cursor", cursorFor(t, pager, params, test.doc))
+		page, err := pager.Parse(params, testSortable, testSelectable)
+		if err != nil {
+			t.Errorf("%s: Parse failed: %v", test.name, err)
+			continue
+		}
+		// Decode both from BSON so RawValues and Go values are alike
+		got, want := roundTrip(t, page.Filter(nil)), roundTrip(t, test.filter)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: filter = %v, want %v", test.name, got, want)
+		}
+	}
+}
+
+func TestCursorRejected(t *testing.T) {
+	pager := New("secret")
+	byName := url.Values{"sort": {"name"}}
+	token := cursorFor(t, pager, byName, bson.M{"_id": primitive.NewObjectID(), "name": "ann"})
+	parts := strings.Split(token, ".")
+
+	// A correctly signed cursor holding a number for the name
+	wrongType, err := pager.encode(bson.D{{Key: "s", Value: "name"}, {Key: "id", Value: primitive.NewObjectID()}, {Key: "v", Value: 42}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A correctly signed cursor holding an operator
+	operator, err := pager.encode(bson.D{{Key: "s", Value: "name"}, {Key: "id", Value: primitive.NewObjectID()}, {Key: "v", Value: bson.M{"$ne": nil}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		pager  *Pager
+		sort   string
+		cursor string
+		want   error
+	}{
+		{"other secret", New("other"), "name", token, errBadCursor},
+		{"changed payload", pager, "name", parts[0] + "A." + parts[1], errBadCursor},
+		{"changed signature", pager, "name", parts[0] + "." + strings.Repeat("A", len(parts[1])), errBadCursor},
+		{"no signature", pager, "name", parts[0], errBadCursor},
+		{"other sort", pager, "-name", token, errCursorSort},
+		{"value of the wrong type", pager, "name", wrongType, errBadCursor},
+		{"document as value", pager, "name", operator, errBadCursor},
+	}
+	for _, test := range tests {
+		params := url.Values{"sort": {test.sort}, "cursor": {test.cursor}}
+		_, err := test.pager.Parse(params, testSortable, testSelectable)
+		if err != test.want {
+			t.Errorf("%s: Parse error = %v, want %v", test.name, err, test.want)
+		}
+	}
+}
+
+func TestProjection(t *testing.T) {
+	pager := New("secret")
+	fallback := bson.M{"password": 0}
+	tests := []struct {
+		query string
+		want  bson.M
+	}{
+		{"", fallback},
+		{"fields=description&sort=name", bson.M{"_id": 1, "name": 1, "description": 1, "owner": 1}},
+	}
+	for _, test := range tests {
+		params, _ := url.ParseQuery(test.query)
+		page, err := pager.Parse(params, testSortable, testSelectable)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := page.Projection(fallback, "owner"); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Projection for %q = %v, want %v", test.query, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+// Package problem writes the RFC 7807 problem details responses webUsers
+// and webSubscriptions answer errors with, and maps common failures onto
+// them.
+package problem
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Problem is an RFC 7807 problem details response
+type Problem struct {
+	Type     string            `json:"type"`
+	Title    string            `json:"title"`
+	Status   int               `json:"status"`
+	Detail   string            `json:"detail,omitempty"`
+	Instance string            `json:"instance,omitempty"`
+	Errors   map[string]string `json:"errors,omitempty"`
+}
+
+// Write responds with an application/problem+json body
+func Write(w http.ResponseWriter, req *http.Request, status int, detail string) {
+	WriteErrors(w, req, status, detail, nil)
+}
+
+// WriteErrors responds with a problem that lists errors per field
+func WriteErrors(w http.ResponseWriter, req *http.Request, status int, detail string, errs map[string]string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(Problem{
+		Type:     "about:blank",
+		Title:    http.StatusText(status),
+		Status:   status,
+		Detail:   detail,
+		Instance: req.URL.Path,
+		Errors:   errs,
+	})
+}
+
+// InvalidID responds to a path parameter that is not an ObjectID
+func InvalidID(w http.ResponseWriter, req *http.Request, id string) {
+	Write(w, req, http.StatusBadRequest, "'"+id+"' is not a valid id, expected 24 hex characters")
+}
+
+// ServerError logs the cause and responds without exposing it
+func ServerError(w http.ResponseWriter, req *http.Request, err error) {
+	log.Printf("%s %s: %v\n", req.Method, req.URL.Path, err)
+	Write(w, req, http.StatusInternalServerError, "internal server error")
+}
+
+// DBError maps a Mongo error onto the matching status.
+// what names the document that was looked for, as in "user 61f0...".
+func DBError(w http.ResponseWriter, req *http.Request, err error, what string) {
+	switch {
+	case err == mongo.ErrNoDocuments:
+		Write(w, req, http.StatusNotFound, what+" not found")
+	case mongo.IsDuplicateKeyError(err):
+		Write(w, req, http.StatusConflict, what+" already exists")
+	case mongo.IsTimeout(err) || err == context.DeadlineExceeded:
+		log.Printf("%s %s: %v\n", req.Method, req.URL.Path, err)
+		Write(w, req, http.StatusServiceUnavailable, "database timed out")
+	default:
+		ServerError(w, req, err)
+	}
+}
@@ -0,0 +1,61 @@
+package problem
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestWriteErrors(t *testing.T) {
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/users", nil)
+	WriteErrors(w, req, http.StatusBadRequest, "validation failed", map[string]string{"email": "email is required"})
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if got := w.Header().Get("Content-Type"); got != "application/problem+json" {
+		t.Errorf("Content-Type = %q, want application/problem+json", got)
+	}
+	var got Problem
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	want := Problem{
+		Type:     "about:blank",
+		Title:    "Bad Request",
+		Status:   http.StatusBadRequest,
+		Detail:   "validation failed",
+		Instance: "/users",
+		Errors:   map[string]string{"email": "email is required"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("problem = %+v, want %+v", got, want)
+	}
+}
+
+func TestDBError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"not found", mongo.ErrNoDocuments, http.StatusNotFound},
+		{"duplicate", mongo.WriteException{WriteErrors: mongo.WriteErrors{{Code: 11000}}}, http.StatusConflict},
+		{"timeout", context.DeadlineExceeded, http.StatusServiceUnavailable},
+		{"other", errors.New("connection reset"), http.StatusInternalServerError},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		DBError(w, httptest.NewRequest("GET", "/users/1", nil), test.err, "user 1")
+		if w.Code != test.want {
+			t.Errorf("%s: status = %d, want %d", test.name, w.Code, test.want)
+		}
+	}
+}
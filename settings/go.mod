@@ -0,0 +1,5 @@
+module github.com/FilipVdZel/settings
+
+go 1.13
+
+require gopkg.in/yaml.v3 v3.0.1
@@ -0,0 +1,302 @@
+// Package settings loads the configuration of webUsers and webSubscriptions.
+// Each service lists its settings, pointing at the fields of its own Config,
+// and every setting starts at its default and is overridden by the config
+// file, then the environment and then the command line.
+package settings
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Where a setting got its value, shown by -print-config
+const (
+	SourceDefault = "default"
+	SourceFile    = "file"
+	SourceEnv     = "env"
+	SourceFlag    = "flag"
+)
+
+// Sources holds where every setting got its value, by key
+type Sources map[string]string
+
+// Setting ties a field of a Config to its key in the config file, its
+// environment variable and its flag. The flag is the key in kebab case.
+type Setting struct {
+	Key   string
+	Env   string
+	Usage string
+	// Pointer to the field: *string, *int, *bool, *time.Duration or *[]string
+	Value interface{}
+	// Redact hides the value when the config is printed
+	Redact func(string) string
+}
+
+// FlagName turns a key like users.cacheTTL into users-cache-ttl
+func FlagName(key string) string {
+	var name strings.Builder
+	previous := '.'
+	for _, r := range key {
+		switch {
+		case r == '.':
+			name.WriteRune('-')
+		case unicode.IsUpper(r):
+			if !unicode.IsUpper(previous) && previous != '.' {
+				name.WriteRune('-')
+			}
+			name.WriteRune(unicode.ToLower(r))
+		default:
+			name.WriteRune(r)
+		}
+		previous = r
+	}
+	return name.String()
+}
+
+// Set parses the text into the setting's field
+func (s Setting) Set(text string) error {
+	text = strings.TrimSpace(text)
+	switch value := s.Value.(type) {
+	case *string:
+		*value = text
+	case *int:
+		n, err := strconv.Atoi(text)
+		if err != nil {
+			return errors.New("must be a whole number")
+		}
+		*value = n
+	case *bool:
+		b, err := strconv.ParseBool(text)
+		if err != nil {
+			return errors.New("must be true or false")
+		}
+		*value = b
+	case *time.Duration:
+		d, err := time.ParseDuration(text)
+		if err != nil {
+			return errors.New("must be a duration like 30s or 5m")
+		}
+		*value = d
+	case *[]string:
+		*value = nil
+		for _, item := range strings.Split(text, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				*value = append(*value, item)
+			}
+		}
+	}
+	return nil
+}
+
+// String formats the field like Set reads it
+func (s Setting) String() string {
+	switch value := s.Value.(type) {
+	case *string:
+		return *value
+	case *int:
+		return strconv.Itoa(*value)
+	case *bool:
+		return strconv.FormatBool(*value)
+	case *time.Duration:
+		return value.String()
+	case *[]string:
+		return strings.Join(*value, ",")
+	}
+	return ""
+}
+
+// Flags are the command line flags of the settings
+type Flags struct {
+	File   *string
+	Print  *bool
+	values map[string]*string
+}
+
+// RegisterFlags adds -config, -print-config and a flag per setting. The
+// settings should point at the defaults, they are shown in the usage.
+func RegisterFlags(flags *flag.FlagSet, defaults []Setting) *Flags {
+	registered := &Flags{
+		File:   flags.String("config", "", "YAML or JSON config file (env CONFIG_FILE)"),
+		Print:  flags.Bool("print-config", false, "print the effective config with secrets redacted and exit"),
+		values: map[string]*string{},
+	}
+	for _, s := range defaults {
+		name := FlagName(s.Key)
+		registered.values[name] = flags.String(name, "", fmt.Sprintf("%s (env %s, default %q)", s.Usage, s.Env, s.String()))
+	}
+	return registered
+}
+
+// Load layers the config file, the environment and the flags that were set
+// over the values the settings point at, and returns where each got its
+// value
+func Load(flags *flag.FlagSet, registered *Flags, settings []Setting) (Sources, error) {
+	sources := Sources{}
+	byKey := map[string]Setting{}
+	byFlag := map[string]Setting{}
+	for _, s := range settings {
+		byKey[s.Key] = s
+		byFlag[FlagName(s.Key)] = s
+		sources[s.Key] = SourceDefault
+	}
+
+	path := *registered.File
+	if path == "" {
+		path = os.Getenv("CONFIG_FILE")
+	}
+	if path != "" {
+		values, err := readConfigFile(path)
+		if err != nil {
+			return sources, err
+		}
+		for key, text := range values {
+			s, ok := byKey[key]
+			if !ok {
+				return sources, fmt.Errorf("config file %s: unknown setting %s", path, key)
+			}
+			if err := s.Set(text); err != nil {
+				return sources, fmt.Errorf("config file %s: %s %v", path, key, err)
+			}
+			sources[key] = SourceFile
+		}
+	}
+
+	for _, s := range settings {
+		text, ok := os.LookupEnv(s.Env)
+		if !ok || text == "" {
+			continue
+		}
+		if err := s.Set(text); err != nil {
+			return sources, fmt.Errorf("%s %v", s.Env, err)
+		}
+		sources[s.Key] = SourceEnv
+	}
+
+	var flagErr error
+	flags.Visit(func(f *flag.Flag) {
+		s, ok := byFlag[f.Name]
+		if !ok || flagErr != nil {
+			return
+		}
+		if err := s.Set(*registered.values[f.Name]); err != nil {
+			flagErr = fmt.Errorf("-%s %v", f.Name, err)
+			return
+		}
+		sources[s.Key] = SourceFlag
+	})
+	return sources, flagErr
+}
+
+// readConfigFile reads a YAML or JSON file into keys like mongo.uri. JSON
+// is valid YAML so both are read the same way.
+func readConfigFile(path string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("config file: %v", err)
+	}
+	var document map[string]interface{}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	if err := decoder.Decode(&document); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("config file %s: %v", path, err)
+	}
+	values := map[string]string{}
+	return values, flatten("", document, values)
+}
+
+// flatten joins nested keys with dots, lists become comma separated
+func flatten(prefix string, document map[string]interface{}, values map[string]string) error {
+	for key, value := range document {
+		if prefix != "" {
+			key = prefix + "." + key
+		}
+		switch value := value.(type) {
+		case map[string]interface{}:
+			if err := flatten(key, value, values); err != nil {
+				return err
+			}
+		case []interface{}:
+			items := make([]string, len(value))
+			for i, item := range value {
+				items[i] = fmt.Sprint(item)
+			}
+			values[key] = strings.Join(items, ",")
+		case nil:
+			values[key] = ""
+		default:
+			values[key] = fmt.Sprint(value)
+		}
+	}
+	return nil
+}
+
+// ValidListen checks for a host:port address with a valid port
+func ValidListen(address string) bool {
+	i := strings.LastIndex(address, ":")
+	if i < 0 {
+		return false
+	}
+	port, err := strconv.Atoi(address[i+1:])
+	return err == nil && port > 0 && port < 65536
+}
+
+// RedactSecret hides a secret but shows whether it is set
+func RedactSecret(value string) string {
+	if value == "" {
+		return ""
+	}
+	return "<redacted>"
+}
+
+// RedactURI hides the password in a connection string
+func RedactURI(value string) string {
+	parsed, err := url.Parse(value)
+	if err != nil {
+		return RedactSecret(value)
+	}
+	if _, ok := parsed.User.Password(); ok {
+		parsed.User = url.UserPassword(parsed.User.Username(), "redacted")
+	}
+	return parsed.String()
+}
+
+// Describe returns a line per setting with its redacted value and source
+func Describe(settings []Setting, sources Sources) []string {
+	width := 0
+	for _, s := range settings {
+		if len(s.Key) > width {
+			width = len(s.Key)
+		}
+	}
+	lines := make([]string, 0, len(settings))
+	for _, s := range settings {
+		value := s.String()
+		if s.Redact != nil {
+			value = s.Redact(value)
+		}
+		source := sources[s.Key]
+		if source == "" {
+			source = SourceDefault
+		}
+		lines = append(lines, fmt.Sprintf("%-*s = %s (%s)", width, s.Key, strconv.Quote(value), source))
+	}
+	return lines
+}
+
+// Print writes the lines of Describe
+func Print(w io.Writer, settings []Setting, sources Sources) {
+	for _, line := range Describe(settings, sources) {
+		fmt.Fprintln(w, line)
+	}
+}
@@ -0,0 +1,125 @@
+package settings
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testConfig has a field of every supported type
+type testConfig struct {
+	Name    string
+	Port    int
+	Debug   bool
+	Timeout time.Duration
+	Origins []string
+	Secret  string
+}
+
+func (config *testConfig) settings() []Setting {
+	return []Setting{
+		{Key: "name", Env: "SETTINGS_TEST_NAME", Value: &config.Name},
+		{Key: "http.port", Env: "SETTINGS_TEST_PORT", Value: &config.Port},
+		{Key: "debug", Env: "SETTINGS_TEST_DEBUG", Value: &config.Debug},
+		{Key: "http.timeout", Env: "SETTINGS_TEST_TIMEOUT", Value: &config.Timeout},
+		{Key: "http.allowedOrigins", Env: "SETTINGS_TEST_ORIGINS", Value: &config.Origins},
+		{Key: "secret", Env: "SETTINGS_TEST_SECRET", Value: &config.Secret, Redact: RedactSecret},
+	}
+}
+
+// load parses the arguments over the defaults like the services do
+func load(t *testing.T, args ...string) (testConfig, Sources, error) {
+	config := testConfig{Name: "default", Port: 80, Timeout: time.Second}
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	registered := RegisterFlags(flags, config.settings())
+	if err := flags.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	sources, err := Load(flags, registered, config.settings())
+	return config, sources, err
+}
+
+func TestLoadLayers(t *testing.T) {
+	file, err := ioutil.TempFile("", "settings-*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("http:\n  port: 8080\n  timeout: 5s\n  allowedOrigins: [a, b]\ndebug: true\n")
+	file.Close()
+	os.Setenv("SETTINGS_TEST_PORT", "9090")
+	defer os.Unsetenv("SETTINGS_TEST_PORT")
+
+	config, sources, err := load(t, "-config", file.Name(), "-debug=false")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := testConfig{Name: "default", Port: 9090, Debug: false, Timeout: 5 * time.Second, Origins: []string{"a", "b"}}
+	if !reflect.DeepEqual(config, want) {
+		t.Errorf("config = %+v, want %+v", config, want)
+	}
+	wantSources := Sources{
+		"name":                SourceDefault,
+		"http.port":           SourceEnv,
+		"debug":               SourceFlag,
+		"http.timeout":        SourceFile,
+		"http.allowedOrigins": SourceFile,
+		"secret":              SourceDefault,
+	}
+	if !reflect.DeepEqual(sources, wantSources) {
+		t.Errorf("sources = %v, want %v", sources, wantSources)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"bad number", []string{"-http-port", "eighty"}, "-http-port must be a whole number"},
+		{"bad duration", []string{"-http-timeout", "5"}, "-http-timeout must be a duration"},
+		{"bad bool", []string{"-debug", "maybe"}, "-debug must be true or false"},
+		{"missing file", []string{"-config", "/does/not/exist.yaml"}, "config file"},
+	}
+	for _, test := range tests {
+		_, _, err := load(t, test.args...)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: err = %v, want %q", test.name, err, test.want)
+		}
+	}
+}
+
+func TestFlagName(t *testing.T) {
+	tests := map[string]string{
+		"listen":                   "listen",
+		"users.cacheTTL":           "users-cache-ttl",
+		"users.url":                "users-url",
+		"publicURL":                "public-url",
+		"smtp.startTLS":            "smtp-start-tls",
+		"websocket.allowedOrigins": "websocket-allowed-origins",
+	}
+	for key, want := range tests {
+		if got := FlagName(key); got != want {
+			t.Errorf("FlagName(%s) = %s, want %s", key, got, want)
+		}
+	}
+}
+
+func TestDescribeRedacts(t *testing.T) {
+	config := testConfig{Secret: "super-secret-key"}
+	lines := Describe(config.settings(), Sources{"secret": SourceEnv})
+	for _, line := range lines {
+		if strings.Contains(line, "super-secret-key") {
+			t.Errorf("secret shown in %q", line)
+		}
+	}
+	if got := RedactURI("mongodb://user:pass@db:27017"); got != "mongodb://user:redacted@db:27017" {
+		t.Errorf("RedactURI = %s", got)
+	}
+}
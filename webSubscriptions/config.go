@@ -0,0 +1,252 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/FilipVdZel/golang-mods/usersclient"
+	"github.com/FilipVdZel/settings"
+)
+
+// Config is the effective configuration. Every setting starts at its
+// default and is overridden by the config file, then the environment and
+// then the command line.
+type Config struct {
+	Listen    string
+	PublicURL string
+	// Timeouts of the HTTP server. There is no write timeout, streams and
+	// websockets stay open.
+	ReadHeaderTimeout time.Duration
+	IdleTimeout       time.Duration
+
+	MongoURI            string
+	MongoDatabase       string
+	MongoConnectTimeout time.Duration
+	Collections         Collections
+
+	UsersURL          string
+	ServiceKey        string
+	UsersTimeout      time.Duration
+	UsersRetries      int
+	UserCacheSize     int
+	UserCacheTTL      time.Duration
+	CredentialTTL     time.Duration
+	DeletePolicy      string
+	DeleteTransferTo  string
+	ReconcileInterval time.Duration
+
+	Notifier       string
+	NotifierFile   string
+	EmailFrom      string
+	SMTPHost       string
+	SMTPPort       int
+	SMTPUsername   string
+	SMTPPassword   string
+	SMTPStartTLS   bool
+	SMTPTimeout    time.Duration
+	OutboxWorkers  int
+	OutboxAttempts int
+	WebhookTimeout time.Duration
+	WebhookPrivate bool
+
+	ConfirmSecret    string
+	WSAllowedOrigins []string
+
+	// Source of every setting by key
+	sources settings.Sources
+}
+
+// Collections names the collections in the database. UserEvents is written
+// by webUsers and must match its name there.
+type Collections struct {
+	Subscriptions     string
+	Messages          string
+	Pending           string
+	Outbox            string
+	DeadLetters       string
+	Deliveries        string
+	Migrations        string
+	UserEvents        string
+	HandledUserEvents string
+}
+
+// defaultConfig is the configuration without file, environment or flags
+func defaultConfig() Config {
+	return Config{
+		Listen:              ":8082",
+		PublicURL:           "http://localhost:8082",
+		ReadHeaderTimeout:   10 * time.Second,
+		IdleTimeout:         2 * time.Minute,
+		MongoURI:            "mongodb://mongodb:27017",
+		MongoDatabase:       "myDB",
+		MongoConnectTimeout: 5 * time.Second,
+		Collections: Collections{
+			Subscriptions:     "Subscriptions",
+			Messages:          "Messages",
+			Pending:           "PendingSubscriptions",
+			Outbox:            "Outbox",
+			DeadLetters:       "DeadLetters",
+			Deliveries:        "Deliveries",
+			Migrations:        "Migrations",
+			UserEvents:        "UserEvents",
+			HandledUserEvents: "HandledUserEvents",
+		},
+		UsersURL:          usersclient.DefaultBaseURL,
+		UsersTimeout:      usersclient.DefaultTimeout,
+		UsersRetries:      usersclient.DefaultRetries,
+		UserCacheSize:     usersclient.DefaultCacheSize,
+		UserCacheTTL:      usersclient.DefaultProfileTTL,
+		CredentialTTL:     usersclient.DefaultCredentialTTL,
+		DeletePolicy:      ownerPolicyArchive,
+		ReconcileInterval: defaultReconcileInterval,
+		Notifier:          "smtp",
+		NotifierFile:      "emails.mbox",
+		EmailFrom:         "noreply@webSubscriptions.local",
+		SMTPHost:          "localhost",
+		SMTPPort:          25,
+		SMTPStartTLS:      true,
+		SMTPTimeout:       10 * time.Second,
+		OutboxWorkers:     defaultOutboxWorkers,
+		OutboxAttempts:    defaultMaxAttempts,
+		WebhookTimeout:    10 * time.Second,
+	}
+}
+
+// settings lists every setting in the order they are printed
+func (config *Config) settings() []settings.Setting {
+	return []settings.Setting{
+		{Key: "listen", Env: "LISTEN_ADDR", Usage: "address the API listens on", Value: &config.Listen},
+		{Key: "publicURL", Env: "PUBLIC_URL", Usage: "URL the API is reached on, used in confirmation links", Value: &config.PublicURL},
+		{Key: "http.readHeaderTimeout", Env: "HTTP_READ_HEADER_TIMEOUT", Usage: "time allowed to read request headers", Value: &config.ReadHeaderTimeout},
+		{Key: "http.idleTimeout", Env: "HTTP_IDLE_TIMEOUT", Usage: "how long idle keep-alive connections stay open", Value: &config.IdleTimeout},
+		{Key: "mongo.uri", Env: "MONGO_URI", Usage: "mongodb connection string", Value: &config.MongoURI, Redact: settings.RedactURI},
+		{Key: "mongo.database", Env: "MONGO_DATABASE", Usage: "database holding the collections", Value: &config.MongoDatabase},
+		{Key: "mongo.connectTimeout", Env: "MONGO_CONNECT_TIMEOUT", Usage: "time allowed to connect at startup", Value: &config.MongoConnectTimeout},
+		{Key: "collections.subscriptions", Env: "COLLECTION_SUBSCRIPTIONS", Usage: "collection of channels", Value: &config.Collections.Subscriptions},
+		{Key: "collections.messages", Env: "COLLECTION_MESSAGES", Usage: "collection of messages", Value: &config.Collections.Messages},
+		{Key: "collections.pending", Env: "COLLECTION_PENDING", Usage: "collection of unconfirmed subscriptions", Value: &config.Collections.Pending},
+		{Key: "collections.outbox", Env: "COLLECTION_OUTBOX", Usage: "collection of queued deliveries", Value: &config.Collections.Outbox},
+		{Key: "collections.deadLetters", Env: "COLLECTION_DEAD_LETTERS", Usage: "collection of failed deliveries", Value: &config.Collections.DeadLetters},
+		{Key: "collections.deliveries", Env: "COLLECTION_DELIVERIES", Usage: "collection of delivery results", Value: &config.Collections.Deliveries},
+		{Key: "collections.migrations", Env: "COLLECTION_MIGRATIONS", Usage: "collection of applied migrations", Value: &config.Collections.Migrations},
+		{Key: "collections.userEvents", Env: "COLLECTION_USER_EVENTS", Usage: "collection webUsers writes user events to", Value: &config.Collections.UserEvents},
+		{Key: "collections.handledUserEvents", Env: "COLLECTION_HANDLED_USER_EVENTS", Usage: "collection of handled user events", Value: &config.Collections.HandledUserEvents},
+		{Key: "users.url", Env: "USERS_URL", Usage: "base URL of webUsers", Value: &config.UsersURL},
+		{Key: "users.serviceKey", Env: "SERVICE_KEY", Usage: "key that lets webUsers show emails, required", Value: &config.ServiceKey, Redact: settings.RedactSecret},
+		{Key: "users.timeout", Env: "USERS_TIMEOUT", Usage: "timeout of a single call to webUsers", Value: &config.UsersTimeout},
+		{Key: "users.retries", Env: "USERS_RETRIES", Usage: "retries of a failed call to webUsers, 0 turns them off", Value: &config.UsersRetries},
+		{Key: "users.cacheSize", Env: "USER_CACHE_SIZE", Usage: "cached profiles and credentials, negative turns caching off", Value: &config.UserCacheSize},
+		{Key: "users.cacheTTL", Env: "USER_CACHE_TTL", Usage: "how long profiles are cached, negative turns it off", Value: &config.UserCacheTTL},
+		{Key: "users.credentialCacheTTL", Env: "CREDENTIAL_CACHE_TTL", Usage: "how long verified credentials are cached, negative turns it off", Value: &config.CredentialTTL},
+		{Key: "users.deletePolicy", Env: "USER_DELETE_POLICY", Usage: "archive or transfer the channels of deleted users", Value: &config.DeletePolicy},
+		{Key: "users.deleteTransferTo", Env: "USER_DELETE_TRANSFER_TO", Usage: "user that gets the channels with the transfer policy", Value: &config.DeleteTransferTo},
+		{Key: "users.reconcileInterval", Env: "USER_RECONCILE_INTERVAL", Usage: "how often user emails are compared with webUsers, 0 turns it off", Value: &config.ReconcileInterval},
+		{Key: "notifier.kind", Env: "NOTIFIER", Usage: "smtp, file or memory", Value: &config.Notifier},
+		{Key: "notifier.file", Env: "NOTIFIER_FILE", Usage: "mbox file of the file notifier", Value: &config.NotifierFile},
+		{Key: "notifier.from", Env: "SMTP_FROM", Usage: "sender of emails", Value: &config.EmailFrom},
+		{Key: "smtp.host", Env: "SMTP_HOST", Usage: "SMTP server", Value: &config.SMTPHost},
+		{Key: "smtp.port", Env: "SMTP_PORT", Usage: "SMTP port", Value: &config.SMTPPort},
+		{Key: "smtp.username", Env: "SMTP_USERNAME", Usage: "SMTP user", Value: &config.SMTPUsername},
+		{Key: "smtp.password", Env: "SMTP_PASSWORD", Usage: "SMTP password", Value: &config.SMTPPassword, Redact: settings.RedactSecret},
+		{Key: "smtp.startTLS", Env: "SMTP_STARTTLS", Usage: "upgrade SMTP connections with STARTTLS", Value: &config.SMTPStartTLS},
+		{Key: "smtp.timeout", Env: "SMTP_TIMEOUT", Usage: "timeout of sending one email", Value: &config.SMTPTimeout},
+		{Key: "outbox.workers", Env: "OUTBOX_WORKERS", Usage: "deliveries sent at the same time", Value: &config.OutboxWorkers},
+		{Key: "outbox.maxAttempts", Env: "OUTBOX_MAX_ATTEMPTS", Usage: "attempts before a delivery becomes a dead letter", Value: &config.OutboxAttempts},
+		{Key: "webhooks.timeout", Env: "WEBHOOK_TIMEOUT", Usage: "timeout of one webhook call", Value: &config.WebhookTimeout},
+		{Key: "webhooks.allowPrivate", Env: "WEBHOOK_ALLOW_PRIVATE", Usage: "let webhooks reach loopback, private and link-local addresses, for local testing only", Value: &config.WebhookPrivate},
+		{Key: "confirmSecret", Env: "CONFIRM_SECRET", Usage: "key signing confirmation links, random when empty", Value: &config.ConfirmSecret, Redact: settings.RedactSecret},
+		{Key: "websocket.allowedOrigins", Env: "WS_ALLOWED_ORIGINS", Usage: "comma separated origins allowed to open websockets, * allows all", Value: &config.WSAllowedOrigins},
+	}
+}
+
+// registerConfigFlags adds -config, -print-config and a flag per setting
+func registerConfigFlags(flags *flag.FlagSet) *settings.Flags {
+	defaults := defaultConfig()
+	return settings.RegisterFlags(flags, defaults.settings())
+}
+
+// loadConfig layers the config file, the environment and the flags that
+// were set over the defaults and validates the result
+func loadConfig(flags *flag.FlagSet, registered *settings.Flags) (Config, error) {
+	config := defaultConfig()
+	sources, err := settings.Load(flags, registered, config.settings())
+	config.sources = sources
+	if err != nil {
+		return config, err
+	}
+	return config, config.validate()
+}
+
+// validate reports every invalid setting at once
+func (config Config) validate() error {
+	var problems []string
+	check := func(ok bool, problem string) {
+		if !ok {
+			problems = append(problems, problem)
+		}
+	}
+	check(settings.ValidListen(config.Listen), "listen must be an address like :8082")
+	check(validHTTPURL(config.PublicURL), "publicURL must be an http or https URL")
+	check(config.ReadHeaderTimeout > 0, "http.readHeaderTimeout must be positive")
+	check(config.IdleTimeout > 0, "http.idleTimeout must be positive")
+	check(strings.HasPrefix(config.MongoURI, "mongodb://") || strings.HasPrefix(config.MongoURI, "mongodb+srv://"),
+		"mongo.uri must start with mongodb:// or mongodb+srv://")
+	check(config.MongoDatabase != "", "mongo.database must not be empty")
+	check(config.MongoConnectTimeout > 0, "mongo.connectTimeout must be positive")
+	names := map[string]string{}
+	for _, s := range config.settings() {
+		if !strings.HasPrefix(s.Key, "collections.") {
+			continue
+		}
+		name := s.String()
+		check(name != "", s.Key+" must not be empty")
+		if other, ok := names[name]; ok && name != "" {
+			check(false, s.Key+" and "+other+" must be different collections")
+		}
+		names[name] = s.Key
+	}
+	check(validHTTPURL(config.UsersURL), "users.url must be an http or https URL")
+	// Without the key webUsers hides emails, subscribing fails and
+	// reconciling finds nothing to copy
+	check(config.ServiceKey != "", "users.serviceKey is required, set SERVICE_KEY to the key of webUsers")
+	check(config.UsersTimeout > 0, "users.timeout must be positive")
+	check(config.UsersRetries >= 0, "users.retries must not be negative")
+	check(config.DeletePolicy == ownerPolicyArchive || config.DeletePolicy == ownerPolicyTransfer,
+		"users.deletePolicy must be archive or transfer")
+	check(config.DeletePolicy != ownerPolicyTransfer || config.DeleteTransferTo != "",
+		"users.deletePolicy transfer needs users.deleteTransferTo")
+	check(config.ReconcileInterval >= 0, "users.reconcileInterval must not be negative")
+	check(config.Notifier == "smtp" || config.Notifier == "file" || config.Notifier == "memory",
+		"notifier.kind must be smtp, file or memory")
+	check(config.Notifier != "file" || config.NotifierFile != "", "notifier.file must not be empty")
+	check(config.Notifier != "smtp" || config.SMTPHost != "", "smtp.host must not be empty")
+	check(config.SMTPPort > 0 && config.SMTPPort < 65536, "smtp.port must be between 1 and 65535")
+	check(config.SMTPTimeout > 0, "smtp.timeout must be positive")
+	check(config.OutboxWorkers > 0, "outbox.workers must be a positive number")
+	check(config.OutboxAttempts > 0, "outbox.maxAttempts must be a positive number")
+	check(config.WebhookTimeout > 0, "webhooks.timeout must be positive")
+	if len(problems) > 0 {
+		return errors.New("invalid config: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// validHTTPURL checks for an absolute http or https URL
+func validHTTPURL(raw string) bool {
+	parsed, err := url.Parse(raw)
+	return err == nil && (parsed.Scheme == "http" || parsed.Scheme == "https") && parsed.Host != ""
+}
+
+// describe returns a line per setting with its redacted value and source
+func (config Config) describe() []string {
+	return settings.Describe(config.settings(), config.sources)
+}
+
+// printConfig writes the effective config
+func printConfig(w io.Writer, config Config) {
+	settings.Print(w, config.settings(), config.sources)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/FilipVdZel/settings"
+)
+
+// withEnv sets the variables for the test and restores them afterwards.
+// An empty value unsets the variable.
+func withEnv(t *testing.T, vars map[string]string) func() {
+	saved := map[string]*string{}
+	for name, value := range vars {
+		if old, ok := os.LookupEnv(name); ok {
+			saved[name] = &old
+		} else {
+			saved[name] = nil
+		}
+		if value == "" {
+			os.Unsetenv(name)
+		} else {
+			os.Setenv(name, value)
+		}
+	}
+	return func() {
+		for name, old := range saved {
+			if old == nil {
+				os.Unsetenv(name)
+			} else {
+				os.Setenv(name, *old)
+			}
+		}
+	}
+}
+
+// writeConfigFile writes a temporary config file and returns its path
+func writeConfigFile(t *testing.T, content string) string {
+	file, err := ioutil.TempFile("", "config-*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err := file.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+	return file.Name()
+}
+
+// load parses the arguments like main does
+func load(args ...string) (Config, error) {
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	registered := registerConfigFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return Config{}, err
+	}
+	return loadConfig(flags, registered)
+}
+
+func TestLoadConfigLayers(t *testing.T) {
+	path := writeConfigFile(t, `
+users:
+  serviceKey: file-key
+  cacheTTL: 2m
+smtp:
+  port: 2525
+outbox:
+  workers: 3
+  maxAttempts: 4
+websocket:
+  allowedOrigins:
+    - https://a.example
+    - https://b.example
+`)
+	defer os.Remove(path)
+	defer withEnv(t, map[string]string{
+		"CONFIG_FILE":         path,
+		"OUTBOX_WORKERS":      "5",
+		"OUTBOX_MAX_ATTEMPTS": "6",
+		"SERVICE_KEY":         "",
+	})()
+
+	config, err := load("-outbox-workers", "7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		key    string
+		got    interface{}
+		want   interface{}
+		source string
+	}{
+		{"listen", config.Listen, ":8082", settings.SourceDefault},
+		{"users.serviceKey", config.ServiceKey, "file-key", settings.SourceFile},
+		{"users.cacheTTL", config.UserCacheTTL, 2 * time.Minute, settings.SourceFile},
+		{"smtp.port", config.SMTPPort, 2525, settings.SourceFile},
+		{"outbox.maxAttempts", config.OutboxAttempts, 6, settings.SourceEnv},
+		{"outbox.workers", config.OutboxWorkers, 7, settings.SourceFlag},
+		{"websocket.allowedOrigins", config.WSAllowedOrigins, []string{"https://a.example", "https://b.example"}, settings.SourceFile},
+	}
+	for _, test := range tests {
+		if !reflect.DeepEqual(test.got, test.want) {
+			t.Errorf("%s = %v, want %v", test.key, test.got, test.want)
+		}
+		if source := config.sources[test.key]; source != test.source {
+			t.Errorf("%s came from %s, want %s", test.key, source, test.source)
+		}
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		env  map[string]string
+		args []string
+		want []string
+	}{
+		{
+			name: "service key is required",
+			want: []string{"users.serviceKey is required"},
+		},
+		{
+			name: "unknown file key",
+			file: "users:\n  serviceKey: k\n  cacheTtl: 1m\n",
+			want: []string{"unknown setting users.cacheTtl"},
+		},
+		{
+			name: "bad env value",
+			env:  map[string]string{"SERVICE_KEY": "k", "SMTP_PORT": "twenty"},
+			want: []string{"SMTP_PORT must be a whole number"},
+		},
+		{
+			name: "bad flag value",
+			env:  map[string]string{"SERVICE_KEY": "k"},
+			args: []string{"-smtp-timeout", "soon"},
+			want: []string{"-smtp-timeout must be a duration"},
+		},
+		{
+			name: "every problem at once",
+			env:  map[string]string{"SERVICE_KEY": "k", "OUTBOX_WORKERS": "0", "LISTEN_ADDR": "8082"},
+			want: []string{"outbox.workers must be a positive number", "listen must be an address"},
+		},
+	}
+	for _, test := range tests {
+		env := map[string]string{"CONFIG_FILE": "", "SERVICE_KEY": "", "SMTP_PORT": "", "OUTBOX_WORKERS": "", "LISTEN_ADDR": ""}
+		for name, value := range test.env {
+			env[name] = value
+		}
+		if test.file != "" {
+			path := writeConfigFile(t, test.file)
+			defer os.Remove(path)
+			env["CONFIG_FILE"] = path
+		}
+		restore := withEnv(t, env)
+		_, err := load(test.args...)
+		restore()
+		if err == nil {
+			t.Errorf("%s: loadConfig succeeded", test.name)
+			continue
+		}
+		for _, want := range test.want {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("%s: error %q does not mention %q", test.name, err, want)
+			}
+		}
+	}
+}
+
+func TestDescribeRedactsSecrets(t *testing.T) {
+	config := defaultConfig()
+	config.ServiceKey = "super-secret-key"
+	for _, line := range config.describe() {
+		if strings.Contains(line, "super-secret-key") {
+			t.Errorf("secret shown in %q", line)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/FilipVdZel/pagination"
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// States of a delivery
+const (
+	deliveryQueued   = "queued"
+	deliverySent     = "sent"
+	deliveryFailed   = "failed"
+	deliveryBounced  = "bounced"
+	deliveryCanceled = "canceled"
+)
+
+var deliveryStatuses = []string{deliveryQueued, deliverySent, deliveryFailed, deliveryBounced, deliveryCanceled}
+
+// Fields of a delivery that can be sorted on and selected
+var (
+	deliverySortable   = []pagination.Field{{Name: "status", Type: bsontype.String}, {Name: "updatedAt", Type: bsontype.DateTime}}
+	deliverySelectable = []string{"message", "channel", "recipient", "kind", "status", "attempts", "lastError",
+		"queuedAt", "sentAt", "failedAt", "bouncedAt", "canceledAt", "updatedAt"}
+)
+
+// Delivery is the state of one message to one subscriber. It shares its
+// ID with the outbox job that sends it.
+type Delivery struct {
+	ID         primitive.ObjectID `json:"_id" bson:"_id"`
+	Message    primitive.ObjectID `json:"message" bson:"message"`
+	Channel    primitive.ObjectID `json:"channel" bson:"channel"`
+	Recipient  ShortUser          `json:"recipient" bson:"recipient"`
+	Kind       string             `json:"kind" bson:"kind"`
+	Status     string             `json:"status" bson:"status"`
+	Attempts   int                `json:"attempts" bson:"attempts"`
+	LastError  string             `json:"lastError,omitempty" bson:"lastError,omitempty"`
+	QueuedAt   time.Time          `json:"queuedAt" bson:"queuedAt"`
+	SentAt     *time.Time         `json:"sentAt,omitempty" bson:"sentAt,omitempty"`
+	FailedAt   *time.Time         `json:"failedAt,omitempty" bson:"failedAt,omitempty"`
+	BouncedAt  *time.Time         `json:"bouncedAt,omitempty" bson:"bouncedAt,omitempty"`
+	CanceledAt *time.Time         `json:"canceledAt,omitempty" bson:"canceledAt,omitempty"`
+	UpdatedAt  time.Time          `json:"updatedAt" bson:"updatedAt"`
+}
+
+// DeliveryCounts sums up the deliveries of a message per state
+type DeliveryCounts struct {
+	Total    int64 `json:"total"`
+	Queued   int64 `json:"queued"`
+	Sent     int64 `json:"sent"`
+	Failed   int64 `json:"failed"`
+	Bounced  int64 `json:"bounced"`
+	Canceled int64 `json:"canceled"`
+}
+
+// ensureDeliveryIndexes keeps one delivery per message, subscriber and
+// kind. The older index without kind is dropped if it is still there.
+func ensureDeliveryIndexes(ctx context.Context, deliveries *mongo.Collection) error {
+	deliveries.Indexes().DropOne(ctx, "message_recipient_unique")
+	_, err := deliveries.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "message", Value: 1}, {Key: "recipient.username", Value: 1}, {Key: "kind", Value: 1}},
+			Options: options.Index().SetName("message_recipient_kind_unique").SetUnique(true),
+		},
+		{Keys: bson.D{{Key: "message", Value: 1}, {Key: "status", Value: 1}, {Key: "_id", Value: 1}}},
+	})
+	return err
+}
+
+// newDelivery is the queued delivery for an outbox job
+func newDelivery(job DeliveryJob) Delivery {
+	return Delivery{
+		ID:        job.ID,
+		Message:   job.Message,
+		Channel:   job.Channel,
+		Recipient: job.Recipient,
+		Kind:      job.kind(),
+		Status:    deliveryQueued,
+		QueuedAt:  job.CreatedAt,
+		UpdatedAt: job.CreatedAt,
+	}
+}
+
+// setDeliveryStatus records the outcome of an attempt. Sent, failed and
+// bounced also stamp the time they happened, queued clears the failure.
+// Only a send that went out changes a canceled delivery.
+func setDeliveryStatus(ctx context.Context, deliveries *mongo.Collection, job DeliveryJob, status string) error {
+	now := time.Now()
+	set := bson.M{"status": status, "attempts": job.Attempts, "updatedAt": now}
+	update := bson.M{"$set": set}
+	switch status {
+	case deliveryQueued:
+		update["$unset"] = bson.M{"failedAt": "", "bouncedAt": ""}
+	default:
+		set[status+"At"] = now
+	}
+	if job.LastError != "" {
+		set["lastError"] = job.LastError
+	}
+	filter := bson.M{"_id": job.ID}
+	if status != deliverySent {
+		filter["status"] = bson.M{"$ne": deliveryCanceled}
+	}
+	_, err := deliveries.UpdateOne(ctx, filter, update)
+	return err
+}
+
+// deliveryCounts counts the deliveries of the messages per state
+func deliveryCounts(ctx context.Context, deliveries *mongo.Collection, messages []primitive.ObjectID) (map[primitive.ObjectID]*DeliveryCounts, error) {
+	counts := map[primitive.ObjectID]*DeliveryCounts{}
+	for _, id := range messages {
+		counts[id] = &DeliveryCounts{}
+	}
+	if len(messages) == 0 {
+		return counts, nil
+	}
+	cursor, err := deliveries.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"message": bson.M{"$in": messages}}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":   bson.M{"message": "$message", "status": "$status"},
+			"count": bson.M{"$sum": 1},
+		}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		var group struct {
+			ID struct {
+				Message primitive.ObjectID `bson:"message"`
+				Status  string             `bson:"status"`
+			} `bson:"_id"`
+			Count int64 `bson:"count"`
+		}
+		if err := cursor.Decode(&group); err != nil {
+			return nil, err
+		}
+		count := counts[group.ID.Message]
+		count.Total += group.Count
+		switch group.ID.Status {
+		case deliveryQueued:
+			count.Queued += group.Count
+		case deliverySent:
+			count.Sent += group.Count
+		case deliveryFailed:
+			count.Failed += group.Count
+		case deliveryBounced:
+			count.Bounced += group.Count
+		case deliveryCanceled:
+			count.Canceled += group.Count
+		}
+	}
+	return counts, cursor.Err()
+}
+
+// Handlers
+func (connection Connection) getDeliveries(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	// Confirm that the credentials are correct
+	caller, ok := authenticate(w, req)
+	if !ok {
+		return
+	}
+	channel, ok := connection.channelFromPath(w, req)
+	if !ok {
+		return
+	}
+	if !caller.canViewDeliveries(channel) {
+		permissionDenied(w, req, caller, "view deliveries of "+channel.Name)
+		return
+	}
+
+	param := mux.Vars(req)
+	messageId, err := primitive.ObjectIDFromHex(param["msgId"])
+	if err != nil {
+		invalidID(w, req, param["msgId"])
+		return
+	}
+	err = connection.Messages.FindOne(context.TODO(), bson.M{"_id": messageId, "channel": channel.ID}).Err()
+	if err != nil {
+		dbError(w, req, err, "message "+param["msgId"])
+		return
+	}
+
+	params := req.URL.Query()
+	page, err := connection.Pager.Parse(params, deliverySortable, deliverySelectable)
+	if err != nil {
+		writeProblem(w, req, http.StatusBadRequest, err.Error())
+		return
+	}
+	filter := bson.M{"message": messageId}
+	if status := params.Get("status"); status != "" {
+		if !contains(deliveryStatuses, status) {
+			writeProblem(w, req, http.StatusBadRequest, "status must be one of "+strings.Join(deliveryStatuses, ", "))
+			return
+		}
+		filter["status"] = status
+	}
+
+	docs, total, next, err := pagination.Find(context.TODO(), connection.Outbox.Deliveries, req, page, filter, page.Projection(bson.M{}))
+	if err != nil {
+		dbError(w, req, err, "deliveries")
+		return
+	}
+	deliveries := make([]Delivery, len(docs))
+	for i, doc := range docs {
+		err = bson.Unmarshal(doc, &deliveries[i])
+		if err != nil {
+			serverError(w, req, err)
+			return
+		}
+	}
+	json.NewEncoder(w).Encode(pagination.Page{
+		Data:  deliveries,
+		Total: total,
+		Limit: page.Limit,
+		Next:  next,
+	})
+}
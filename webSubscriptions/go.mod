@@ -3,6 +3,16 @@ module github.com/FilipVdZel/golang-mods
 go 1.13
 
 require (
-	github.com/gorilla/mux v1.8.0 // indirect
-	go.mongodb.org/mongo-driver v1.8.2 // indirect
+	github.com/FilipVdZel/pagination v0.0.0
+	github.com/FilipVdZel/problem v0.0.0
+	github.com/FilipVdZel/settings v0.0.0
+	github.com/gorilla/mux v1.8.0
+	github.com/gorilla/websocket v1.4.2
+	go.mongodb.org/mongo-driver v1.8.2
 )
+
+replace github.com/FilipVdZel/pagination => ../pagination
+
+replace github.com/FilipVdZel/problem => ../problem
+
+replace github.com/FilipVdZel/settings => ../settings
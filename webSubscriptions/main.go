@@ -3,14 +3,21 @@ package main
 import (
 	"context"
 	"encoding/json"
-	"fmt"
+	"errors"
+	"flag"
 	"log"
 	"net/http"
+	"os"
+	"regexp"
+	"strconv"
 	"time"
 
+	"github.com/FilipVdZel/golang-mods/usersclient"
+	"github.com/FilipVdZel/pagination"
 	"github.com/gorilla/mux"
 
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
@@ -30,14 +37,23 @@ type User struct {
 
 // shorter version of user stored in Subsciptions collection
 type ShortUser struct {
-	Username string `json:"username,omitempty" bson:"username,omitempty"`
-	Email    string `json:"email,omitempty" bson:"email,omitempty"`
+	Username string   `json:"username,omitempty" bson:"username,omitempty"`
+	Email    string   `json:"email,omitempty" bson:"email,omitempty"`
+	Webhook  *Webhook `json:"webhook,omitempty" bson:"webhook,omitempty"`
 }
 
-// Messages saved on Channel
+// Messages sent on a Channel, stored in the Messages collection
 type Message struct {
+	ID          primitive.ObjectID `json:"_id,omitempty" bson:"_id,omitempty"`
+	Channel     primitive.ObjectID `json:"channel,omitempty" bson:"channel,omitempty"`
 	Message     string
 	TimeCreated string
+	CreatedAt   time.Time `json:"createdAt" bson:"createdAt"`
+	Author      string    `json:"author,omitempty" bson:"author,omitempty"`
+	// Set until the deliveries of the message are queued
+	PendingDeliveries bool `json:"-" bson:"pendingDeliveries,omitempty"`
+	// Counted from the Deliveries collection when the message is read
+	Deliveries *DeliveryCounts `json:"deliveries,omitempty" bson:"-"`
 }
 
 // Subscriptions type struct
@@ -48,23 +64,125 @@ type Subscription struct {
 	Owner       string             `json:"owner,omitempty" bson:"owner,omitempty"`
 	OwnerEmail  string             `json:"owneremail,omitempty" bson:"owneremail,omitempty"`
 	Subscribers []ShortUser        `json:"subscribers,omitempty" bson:"subscribers,omitempty"`
-	Messages    []Message          `json:"messages,omitempty" bson:"messages,omitempty"`
+	// Set when the owner was deleted, archived channels take no new
+	// messages or subscribers
+	Archived      bool   `json:"archived,omitempty" bson:"archived,omitempty"`
+	PreviousOwner string `json:"previousOwner,omitempty" bson:"previousOwner,omitempty"`
+}
+
+// Fields of a channel that can be sorted on and selected
+var (
+	channelSortable   = []pagination.Field{{Name: "name", Type: bsontype.String}, {Name: "owner", Type: bsontype.String}}
+	channelSelectable = []string{"name", "description", "owner", "owneremail", "subscribers", "archived", "previousOwner"}
+	// Owner emails are only listed for admins
+	channelPublicSelectable = []string{"name", "description", "owner", "subscribers", "archived", "previousOwner"}
+)
+
+// contains reports if the list holds the value
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// channelInput is the body of creating or updating a channel. The owner
+// and subscribers are never taken from it, subscribers join through the
+// double opt-in.
+type channelInput struct {
+	Name        *string `json:"name"`
+	Description *string `json:"description"`
+}
+
+// fields returns the fields that were given
+func (input channelInput) fields() bson.M {
+	fields := bson.M{}
+	if input.Name != nil {
+		fields["name"] = *input.Name
+	}
+	if input.Description != nil {
+		fields["description"] = *input.Description
+	}
+	return fields
 }
 
+// removeChannel deletes the channel, its messages and pending
+// subscriptions, and cancels the deliveries that were not sent yet. The
+// channel goes first so nothing new is posted to it meanwhile.
+func (connection Connection) removeChannel(ctx context.Context, id primitive.ObjectID) (*mongo.DeleteResult, error) {
+	result, err := connection.Subscriptions.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return nil, err
+	}
+	_, err = connection.Pending.DeleteMany(ctx, bson.M{"channel": id})
+	if err != nil {
+		return result, err
+	}
+	_, err = connection.Messages.DeleteMany(ctx, bson.M{"channel": id})
+	if err != nil {
+		return result, err
+	}
+	_, err = connection.Outbox.cancelChannel(ctx, id)
+	return result, err
+}
+
+// Errors returned by verifyRequest
+var (
+	errNoCredentials  = errors.New("no credentials given")
+	errBadCredentials = errors.New("credentials are not correct")
+)
+
+// usersAPI calls webUsers and caches the answers, main configures it from
+// the config
+var usersAPI = usersclient.NewCached(usersclient.New(usersclient.Config{}), usersclient.CacheConfig{})
+
 // Database connection struct
 type Connection struct {
 	Subscriptions *mongo.Collection
+	Messages      *mongo.Collection
+	Pending       *mongo.Collection
+	Outbox        *Outbox
+	Hub           *Hub
+	ConfirmSecret []byte
+	PublicURL     string
+	Pager         *pagination.Pager
 }
 
 func main() {
+	// Maintenance commands run once and exit
+	dedupe := flag.Bool("dedupe-subscribers", false, "remove duplicate subscribers from every channel and exit")
+	reconcile := flag.Bool("reconcile-users", false, "fix copies of user emails that differ from webUsers and exit")
+	dryRun := flag.Bool("dry-run", false, "with -dedupe-subscribers or -reconcile-users, only report what would change")
+	configFlags := registerConfigFlags(flag.CommandLine)
+	flag.Parse()
+
+	// Defaults, then the config file, the environment and the flags
+	config, err := loadConfig(flag.CommandLine, configFlags)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *configFlags.Print {
+		printConfig(os.Stdout, config)
+		return
+	}
+	log.Println("Effective configuration:")
+	for _, line := range config.describe() {
+		log.Println("  " + line)
+	}
+	usersAPI = newUsersAPI(config)
+	wsAllowedOrigins = config.WSAllowedOrigins
+	webhookAllowPrivate = config.WebhookPrivate
+
 	// connect to mongodb
 	log.Println("Connecting to mongodb ...")
-	clientOptions := options.Client().ApplyURI("mongodb://mongodb:27017")
+	clientOptions := options.Client().ApplyURI(config.MongoURI)
 	client, err := mongo.NewClient(clientOptions)
 	if err != nil {
 		log.Fatal(err)
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), config.MongoConnectTimeout)
 	defer cancel()
 	err = client.Connect(ctx)
 	if err != nil {
@@ -77,13 +195,102 @@ func main() {
 		log.Fatal(err)
 	}
 
-	collectionSubscriptions := client.Database("myDB").Collection("Subscriptions")
+	db := client.Database(config.MongoDatabase)
+	collectionSubscriptions := db.Collection(config.Collections.Subscriptions)
+	collectionMessages := db.Collection(config.Collections.Messages)
+	err = ensureMessageIndexes(ctx, collectionMessages)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Bring stored documents up to date before anything reads them
+	applied, err := runMigrations(context.Background(), db, config.Collections)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(applied) > 0 {
+		log.Printf("Applied migrations %v\n", applied)
+	}
+	err = ensureChannelIndexes(context.Background(), collectionSubscriptions)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *dedupe {
+		changes, err := dedupeSubscribers(context.Background(), collectionSubscriptions, *dryRun)
+		printDedupeReport(os.Stdout, changes, *dryRun)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if *reconcile {
+		consumer := newUserEventConsumer(db, Connection{
+			Subscriptions: collectionSubscriptions,
+			Messages:      collectionMessages,
+			Pending:       db.Collection(config.Collections.Pending),
+		}, config)
+		fixes, err := consumer.reconcile(context.Background(), *dryRun)
+		printDriftReport(os.Stdout, fixes, *dryRun)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	notifier, err := loadNotifier(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Emails and webhook calls are queued in the Outbox and delivered in the background
+	outbox := newOutbox(db, notifier, config)
+	err = ensureOutboxIndexes(context.Background(), outbox.Jobs, outbox.DeadLetters)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = ensureDeliveryIndexes(context.Background(), outbox.Deliveries)
+	if err != nil {
+		log.Fatal(err)
+	}
+	go outbox.Run(context.Background())
+
+	// Live streams follow the Messages change stream when Mongo supports it
+	hub := newHub()
+	err = hub.watch(context.Background(), collectionMessages)
+	if err != nil {
+		log.Printf("No change streams, streaming messages of this process only: %v\n", err)
+	}
+
+	// Subscriptions wait in Pending until they are confirmed
+	collectionPending := db.Collection(config.Collections.Pending)
+	err = ensurePendingIndexes(context.Background(), collectionPending)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	connection := Connection{
 		Subscriptions: collectionSubscriptions,
+		Messages:      collectionMessages,
+		Pending:       collectionPending,
+		Outbox:        outbox,
+		Hub:           hub,
+		ConfirmSecret: loadConfirmSecret(config.ConfirmSecret),
+		PublicURL:     config.PublicURL,
+		Pager:         pagination.New(config.ServiceKey),
+	}
+
+	// Deleted, renamed and updated users are followed through the UserEvents of webUsers
+	consumer := newUserEventConsumer(db, connection, config)
+	err = ensureHandledIndexes(context.Background(), consumer.Handled)
+	if err != nil {
+		log.Fatal(err)
+	}
+	go consumer.Run(context.Background())
+	// Events can be missed, compare with webUsers now and then
+	if config.ReconcileInterval > 0 {
+		go consumer.reconcileEvery(context.Background(), config.ReconcileInterval)
 	}
 
 	// init server mux
 	router := mux.NewRouter()
+	router.Use(usersclient.Middleware)
 
 	//Handelers
 	router.HandleFunc("/subscriptions", connection.getSubscriptions).Methods("GET")
@@ -91,105 +298,160 @@ func main() {
 	router.HandleFunc("/subscriptions/{id}", connection.updateSubscriptions).Methods("PUT")
 	router.HandleFunc("/subscriptions/{id}", connection.deleteSubscriptions).Methods("DELETE")
 	router.HandleFunc("/messages", connection.sendMessages).Methods("POST")
+	router.HandleFunc("/subscriptions/{id}/messages", connection.getMessages).Methods("GET")
+	router.HandleFunc("/subscriptions/{id}/messages/{msgId}", connection.getMessage).Methods("GET")
+	router.HandleFunc("/subscriptions/{id}/messages/{msgId}", connection.deleteMessage).Methods("DELETE")
+	router.HandleFunc("/subscriptions/{id}/stream", connection.getStream).Methods("GET")
+	router.HandleFunc("/ws", connection.getWebSocket).Methods("GET")
+	router.HandleFunc("/subscriptions/{id}/messages/{msgId}/deliveries", connection.getDeliveries).Methods("GET")
+	router.HandleFunc("/subscriptions/{id}/subscribers/{username}/webhook", connection.putWebhook).Methods("PUT")
+	router.HandleFunc("/subscriptions/{id}/subscribers/{username}/webhook", connection.deleteWebhook).Methods("DELETE")
+	router.HandleFunc("/subscriptions/{id}/subscribers/{username}/webhook/rotate", connection.rotateWebhookSecret).Methods("POST")
+	router.HandleFunc("/users/{username}/subscriptions", connection.getUserSubscriptions).Methods("GET")
+	router.HandleFunc("/users/{username}/channels", connection.getUserChannels).Methods("GET")
+	router.HandleFunc("/subscribe/confirm", connection.confirmPage).Methods("GET")
+	router.HandleFunc("/subscribe/confirm", connection.ConfirmSubscription).Methods("POST")
 	router.HandleFunc("/subscribe/{id}", connection.Subscribe).Methods("POST")
 	router.HandleFunc("/unsubscribe/{id}", connection.Unsubscribe).Methods("DELETE")
-
-	// listen and serve requests on localhost port 8082
+	router.HandleFunc("/admin/cache", connection.getCacheStats).Methods("GET")
+	router.HandleFunc("/admin/deadletters", connection.getDeadLetters).Methods("GET")
+	router.HandleFunc("/admin/deadletters/replay", connection.replayDeadLetters).Methods("POST")
+	router.HandleFunc("/admin/deadletters/{id}", connection.getDeadLetter).Methods("GET")
+	router.HandleFunc("/admin/deadletters/{id}", connection.deleteDeadLetter).Methods("DELETE")
+	router.HandleFunc("/admin/deadletters/{id}/replay", connection.replayDeadLetter).Methods("POST")
+
+	// listen and serve requests on the configured address, :8082 by default
 	// Use server mux router
-	log.Fatal(http.ListenAndServe(":8082", router))
+	server := &http.Server{
+		Addr:              config.Listen,
+		Handler:           router,
+		ReadHeaderTimeout: config.ReadHeaderTimeout,
+		IdleTimeout:       config.IdleTimeout,
+	}
+	log.Fatal(server.ListenAndServe())
 }
 
 //Handlers
 func (connection Connection) getSubscriptions(w http.ResponseWriter, req *http.Request) {
 	// make sure content is not served as text to client
 	w.Header().Set("Content-Type", "application/json")
-	var subscriptions []Subscription
 
-	//Get parameters value
-	params := req.URL.Query()
-	// If no parameters Encode all users
-
-	if len(params) == 0 {
-		// create a filter (cursor)
-		// this filter returns all entries in the database
-		cursor, err := connection.Subscriptions.Find(context.TODO(), bson.M{})
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(`{"message": "` + err.Error() + `" }`))
+	// Credentials are optional, they only show more of each channel
+	var caller Caller
+	if req.Header.Get("Authorization") != "" {
+		var ok bool
+		caller, ok = authenticate(w, req)
+		if !ok {
 			return
 		}
-		//Apply filter to all entries
-		cursor.All(context.TODO(), &subscriptions)
+	}
+	admin := caller.hasRole(roleAdmin)
+	selectable := channelSelectable
+	if !admin {
+		selectable = channelPublicSelectable
+	}
 
-		// repond with filtered content
-		json.NewEncoder(w).Encode(subscriptions)
+	//Get parameters value
+	params := req.URL.Query()
+	page, err := connection.Pager.Parse(params, channelSortable, selectable)
+	if err != nil {
+		writeProblem(w, req, http.StatusBadRequest, err.Error())
 		return
 	}
 
+	// Without a name all channels are listed
+	filter := bson.M{}
 	//Go through all names
-	searchName := req.URL.Query().Get("name")
-	filter := bson.D{primitive.E{Key: "name", Value: primitive.Regex{Pattern: searchName, Options: "i"}}}
-	cursor, err := connection.Subscriptions.Find(context.TODO(), filter)
+	searchName := params.Get("name")
+	if searchName != "" {
+		// Names are matched literally, not as a pattern
+		filter = bson.M{"name": primitive.Regex{Pattern: regexp.QuoteMeta(searchName), Options: "i"}}
+	}
+
+	projection := page.Projection(bson.M{})
+	if !admin {
+		// Everyone else only sees their own subscriber entry, like on
+		// /users/{username}/subscriptions
+		projection = page.Projection(bson.M{"name": 1, "description": 1, "owner": 1, "subscribers": 1, "archived": 1, "previousOwner": 1})
+		if _, ok := projection["subscribers"]; ok {
+			if caller.Username == "" {
+				delete(projection, "subscribers")
+			} else {
+				projection["subscribers"] = bson.M{"$elemMatch": bson.M{"username": caller.Username}}
+			}
+		}
+	}
+	docs, total, next, err := pagination.Find(context.TODO(), connection.Subscriptions, req, page, filter, projection)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(`{"message": "` + err.Error() + `" }`))
+		dbError(w, req, err, "subscriptions")
 		return
 	}
 
-	//Apply filter to all entries
-	cursor.All(context.TODO(), &subscriptions)
-	//Encode all Subscriptions
-	json.NewEncoder(w).Encode(subscriptions)
+	subscriptions := make([]Subscription, len(docs))
+	for i, doc := range docs {
+		err = bson.Unmarshal(doc, &subscriptions[i])
+		if err != nil {
+			serverError(w, req, err)
+			return
+		}
+	}
+
+	//Encode one page of Subscriptions
+	json.NewEncoder(w).Encode(pagination.Page{
+		Data:  subscriptions,
+		Total: total,
+		Limit: page.Limit,
+		Next:  next,
+	})
 
 }
 
 func (connection Connection) createSubscriptions(w http.ResponseWriter, req *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	//Create new user var and decode json contect from body
-	var channel Subscription
-	_ = json.NewDecoder(req.Body).Decode(&channel)
+	var input channelInput
+	err := json.NewDecoder(req.Body).Decode(&input)
+	if err != nil {
+		writeProblem(w, req, http.StatusBadRequest, "invalid json body: "+err.Error())
+		return
+	}
+	if input.Name == nil || *input.Name == "" {
+		writeProblemErrors(w, req, http.StatusUnprocessableEntity, "channel is not valid", map[string]string{"name": "is required"})
+		return
+	}
+	channel := Subscription{Name: *input.Name}
+	if input.Description != nil {
+		channel.Description = *input.Description
+	}
 
-	// Ger username and password
-	u, p, ok := req.BasicAuth()
+	// Confirm basic auth or bearer token is correct
+	caller, ok := authenticate(w, req)
 	if !ok {
-		fmt.Println("Error parsing basic auth")
-		w.WriteHeader(401)
 		return
 	}
-	// Confirm that user and password is correct
-	valid := verifyUserPassword(u, p)
-	if !valid {
-		fmt.Println("Username and password not correct")
+	channel.Owner = caller.Username
+	user, err := lookupUser(req.Context(), caller.Username)
+	if err != nil {
+		usersError(w, req, err, caller.Username)
 		return
 	}
-	channel.Owner = u
-	var user User
-	getUserDetails(u, &user)
 	channel.OwnerEmail = user.Email
 	// insert channel into database
-	result, _ := connection.Subscriptions.InsertOne(context.TODO(), channel)
-	//Response with json data testing
+	result, err := connection.Subscriptions.InsertOne(context.TODO(), channel)
+	if err != nil {
+		dbError(w, req, err, "channel "+channel.Name)
+		return
+	}
+	//Response with json data
 	json.NewEncoder(w).Encode(result)
-	// Confirm that channel was created
-	w.Header().Set("Content-Type", "text/plain")
-	w.Write([]byte("Channel " + channel.Name + " was created by user " + channel.Owner + "\n"))
-	return
-
 }
 
 func (connection Connection) updateSubscriptions(w http.ResponseWriter, req *http.Request) {
 	// make sure content is not served as text to client
 	w.Header().Set("Content-Type", "application/json")
-	// Confirm that user and password is correct
-	u, p, ok := req.BasicAuth()
+	// Confirm that the credentials are correct
+	caller, ok := authenticate(w, req)
 	if !ok {
-		fmt.Println("Error parsing basic auth")
-		w.WriteHeader(401)
-		return
-	}
-	valid := verifyUserPassword(u, p)
-	if !valid {
-		fmt.Println("Username and password not correct")
 		return
 	}
 
@@ -198,39 +460,45 @@ func (connection Connection) updateSubscriptions(w http.ResponseWriter, req *htt
 	// Gat object ID
 	objectId, err := primitive.ObjectIDFromHex(param["id"])
 	if err != nil {
-		log.Println("Invalid ID")
+		invalidID(w, req, param["id"])
 		return
 	}
-	var channel Subscription
+	var input channelInput
 	// decode json in request body
-	err = json.NewDecoder(req.Body).Decode(&channel)
+	err = json.NewDecoder(req.Body).Decode(&input)
 	if err != nil {
-		fmt.Printf("%v\n", err)
+		writeProblem(w, req, http.StatusBadRequest, "invalid json body: "+err.Error())
+		return
 	}
-	// Check if user is the owner of the Channel
+	fields := input.fields()
+	if len(fields) == 0 {
+		writeProblem(w, req, http.StatusBadRequest, "nothing to update, give a name or description")
+		return
+	}
+	if name, ok := fields["name"]; ok && name == "" {
+		writeProblemErrors(w, req, http.StatusUnprocessableEntity, "channel is not valid", map[string]string{"name": "must not be empty"})
+		return
+	}
+	// Check if user is the owner of the Channel or an admin
 	var channeldata Subscription
-	connection.Subscriptions.FindOne(context.TODO(), bson.M{"_id": objectId}).Decode(&channeldata)
-	if u != channeldata.Owner {
-		fmt.Println("Not the owner")
-		w.Header().Set("Content-Type", "text/plain")
-		w.Write([]byte("Permission Denied.\n"))
+	err = connection.Subscriptions.FindOne(context.TODO(), bson.M{"_id": objectId}).Decode(&channeldata)
+	if err != nil {
+		dbError(w, req, err, "channel "+param["id"])
+		return
+	}
+	if !caller.canEditChannel(channeldata) {
+		permissionDenied(w, req, caller, "update "+channeldata.Name)
 		return
 	}
 
-	// Update Channel info
-	var doc bson.D
-	data, _ := bson.Marshal(channel)
-	_ = bson.Unmarshal(data, &doc)
-	// update specified user
+	// Update Channel info, only the name and description can change
 	result, err := connection.Subscriptions.UpdateOne(
 		context.TODO(),          // required context
 		bson.M{"_id": objectId}, // filter
-		bson.M{"$set": doc},
+		bson.M{"$set": fields},
 	)
 	if err != nil {
-		log.Println("Update Failed")
-		w.Header().Set("Content-Type", "text/plain")
-		w.Write([]byte("Update failed\n"))
+		dbError(w, req, err, "channel "+param["id"])
 		return
 	}
 	json.NewEncoder(w).Encode(result)
@@ -239,16 +507,9 @@ func (connection Connection) updateSubscriptions(w http.ResponseWriter, req *htt
 
 func (connection Connection) deleteSubscriptions(w http.ResponseWriter, req *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	// Confirm that user and password is correct
-	u, p, ok := req.BasicAuth()
+	// Confirm that the credentials are correct
+	caller, ok := authenticate(w, req)
 	if !ok {
-		fmt.Println("Error parsing basic auth")
-		w.WriteHeader(401)
-		return
-	}
-	valid := verifyUserPassword(u, p)
-	if !valid {
-		fmt.Println("Username and password not correct")
 		return
 	}
 
@@ -257,19 +518,27 @@ func (connection Connection) deleteSubscriptions(w http.ResponseWriter, req *htt
 	//Get Object id
 	objectId, err := primitive.ObjectIDFromHex(param["id"])
 	if err != nil {
-		log.Println("Invalid ID")
+		invalidID(w, req, param["id"])
+		return
 	}
-	// Check if user is the owner of the Channel
+	// Check if user is the owner of the Channel or an admin
 	var channel Subscription
-	connection.Subscriptions.FindOne(context.TODO(), bson.M{"_id": objectId}).Decode(&channel)
-	if u != channel.Owner {
-		fmt.Println("Not the owner")
-		w.Header().Set("Content-Type", "text/plain")
-		w.Write([]byte("Permission Denied.\n"))
+	err = connection.Subscriptions.FindOne(context.TODO(), bson.M{"_id": objectId}).Decode(&channel)
+	if err != nil {
+		dbError(w, req, err, "channel "+param["id"])
 		return
 	}
-	// Delete Channel from collection
-	result, err := connection.Subscriptions.DeleteOne(context.TODO(), bson.M{"_id": objectId})
+	if !caller.canEditChannel(channel) {
+		permissionDenied(w, req, caller, "delete "+channel.Name)
+		return
+	}
+	// Delete Channel from collection with its messages and deliveries
+	result, err := connection.removeChannel(context.TODO(), objectId)
+	if err != nil {
+		dbError(w, req, err, "channel "+param["id"])
+		return
+	}
+	log.Printf("%s deleted channel %s\n", caller.Username, channel.Name)
 
 	//Response with json data
 	json.NewEncoder(w).Encode(result)
@@ -278,16 +547,9 @@ func (connection Connection) deleteSubscriptions(w http.ResponseWriter, req *htt
 
 func (connection Connection) sendMessages(w http.ResponseWriter, req *http.Request) {
 	w.Header().Set("Content-Type", "text/html")
-	// Confirm that user and password is correct
-	u, p, ok := req.BasicAuth()
+	// Confirm that the credentials are correct
+	caller, ok := authenticate(w, req)
 	if !ok {
-		fmt.Println("Error parsing basic auth")
-		w.WriteHeader(401)
-		return
-	}
-	valid := verifyUserPassword(u, p)
-	if !valid {
-		fmt.Println("Username and password not correct")
 		return
 	}
 
@@ -295,75 +557,72 @@ func (connection Connection) sendMessages(w http.ResponseWriter, req *http.Reque
 	params := req.URL.Query()
 	// Get channel name
 	searchChannel := params.Get("channel")
+	if searchChannel == "" {
+		writeProblem(w, req, http.StatusBadRequest, "no channel given, add ?channel=name to the url")
+		return
+	}
 
 	// Check if user is the owner of the Channel
 	var channel Subscription
-	connection.Subscriptions.FindOne(context.TODO(), bson.M{"name": searchChannel}).Decode(&channel)
-	fmt.Println("Username: " + u + ", Owner: " + channel.Owner)
-	if u != channel.Owner {
-		fmt.Println("Not the owner")
-		w.Header().Set("Content-Type", "text/plain")
-		w.Write([]byte("Permission Denied.\n"))
+	err := connection.Subscriptions.FindOne(context.TODO(), bson.M{"name": searchChannel}).Decode(&channel)
+	if err != nil {
+		dbError(w, req, err, "channel "+searchChannel)
+		return
+	}
+	if !caller.canPostTo(channel) {
+		permissionDenied(w, req, caller, "post to "+channel.Name)
 		return
 	}
 
 	// TODO: Change encoding to HTML
 	var message Message
-	err := json.NewDecoder(req.Body).Decode(&message)
+	err = json.NewDecoder(req.Body).Decode(&message)
 	if err != nil {
-		fmt.Printf("%v\n", err)
+		writeProblem(w, req, http.StatusBadRequest, "invalid json body: "+err.Error())
+		return
 	}
 
-	// Add time to message
-	currentTime := time.Now()
-	t := currentTime.Format("2006-01-02 15:04:05")
-	message.TimeCreated = t
-
-	// Insert message as embedded document
-	var doc bson.D
-	data, _ := bson.Marshal(message)
-	_ = bson.Unmarshal(data, &doc)
-	result, err := connection.Subscriptions.UpdateOne(
-		context.TODO(),
-		bson.M{"_id": channel.ID},
-		bson.M{"$push": bson.M{"Messages": doc}},
-	)
-	if err != nil {
-		log.Printf("%v\n", err)
+	message, queued, err := connection.postMessage(context.TODO(), caller, channel, message.Message)
+	if err != nil && err != errDeliveriesPending {
+		dbError(w, req, err, "message")
+		return
 	}
-	log.Printf("%+v\n", result)
-
-	// Send message to all subscribers
-	ownerEmail := channel.OwnerEmail
-	messageText := message.Message
+	w.Header().Set("Location", "/subscriptions/"+channel.ID.Hex()+"/messages/"+message.ID.Hex())
 	w.Header().Set("Content-Type", "text/plain")
-	for _, subs := range channel.Subscribers {
-		// Send actual emails here
-		userEmail := subs.Email
-		username := subs.Username
-		w.Write([]byte(ownerEmail + " sent message to " + username + " at " +
-			userEmail + " message: " + messageText + "\n"))
+	w.WriteHeader(http.StatusAccepted)
+	// The message is stored, so a retry by the client would post it twice
+	if err == errDeliveriesPending {
+		w.Write([]byte("Message stored, deliveries are queued shortly\n"))
+		return
 	}
+	w.Write([]byte("Message queued for " + strconv.Itoa(queued) + " subscribers\n"))
 
 }
 
 func (connection Connection) Subscribe(w http.ResponseWriter, req *http.Request) {
-	//Get parameters value
-	params := req.URL.Query()
-	// If no parameters Give error
-	if len(params) == 0 {
-		log.Panicln("No Username Given")
-		w.Header().Set("Content-Type", "text/plain")
-		w.Write([]byte("No Username Given. Add ?username=username to url"))
+	// Confirm that the credentials are correct
+	caller, ok := authenticate(w, req)
+	if !ok {
+		return
+	}
+	// Without a username callers subscribe themselves, only admins may
+	// subscribe someone else
+	username := req.URL.Query().Get("username")
+	if username == "" {
+		username = caller.Username
+	}
+	if !caller.canManageSubscriber(username) {
+		permissionDenied(w, req, caller, "subscribe "+username)
 		return
 	}
 	// Get user details from User server
-	username := params.Get("username")
-	var user User
-	getUserDetails(username, &user)
-	if user.Username == "" {
-		w.Header().Set("Content-Type", "text/plain")
-		w.Write([]byte("Username " + username + " not found\n"))
+	user, err := lookupUser(req.Context(), username)
+	if err != nil {
+		usersError(w, req, err, username)
+		return
+	}
+	if user.Email == "" {
+		writeProblem(w, req, http.StatusUnprocessableEntity, "user "+username+" has no email to confirm the subscription with")
 		return
 	}
 	shortuser := ShortUser{
@@ -374,109 +633,155 @@ func (connection Connection) Subscribe(w http.ResponseWriter, req *http.Request)
 	param := mux.Vars(req)
 	objectId, err := primitive.ObjectIDFromHex(param["id"])
 	if err != nil {
-		log.Println("Invalid ID")
+		invalidID(w, req, param["id"])
+		return
 	}
 	// Get Channel
 	var channel Subscription
-	connection.Subscriptions.FindOne(context.TODO(), bson.M{"_id": objectId}).Decode(&channel)
+	err = connection.Subscriptions.FindOne(context.TODO(), bson.M{"_id": objectId}).Decode(&channel)
+	if err != nil {
+		dbError(w, req, err, "channel "+param["id"])
+		return
+	}
+	if channel.Archived {
+		writeProblem(w, req, http.StatusGone, "channel "+channel.Name+" is archived")
+		return
+	}
+	// Subscribing twice changes nothing
+	if channel.hasSubscriber(username) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("User " + username + " is already subscribed to " + channel.Name + "\n"))
+		return
+	}
 
-	// Insert shortUser as embedded document
-	var doc bson.D
-	data, _ := bson.Marshal(shortuser)
-	_ = bson.Unmarshal(data, &doc)
-	connection.Subscriptions.UpdateOne(
-		context.TODO(),
-		bson.M{"_id": objectId},
-		bson.M{"$push": bson.M{"Subscribers": doc}},
-	)
+	// The subscription waits until the user confirms it from their email
+	pending, err := connection.createPending(context.TODO(), channel, shortuser)
+	if err != nil {
+		dbError(w, req, err, "pending subscription")
+		return
+	}
+	err = connection.Outbox.Notifier.Send(req.Context(), confirmEmail(channel, shortuser, connection.confirmLink(pending)))
+	if err != nil {
+		log.Printf("Sending confirmation to %s failed: %v\n", shortuser.Email, err)
+		writeProblem(w, req, http.StatusBadGateway, "could not send the confirmation email, try again later")
+		return
+	}
 
 	// Send back response
 	w.Header().Set("Content-Type", "text/plain")
-	w.Write([]byte("User " + username + " successfully subscribed to " + channel.Name + "\n"))
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte("Confirmation sent to " + shortuser.Email + ", open the link in it to subscribe " + username + " to " + channel.Name + "\n"))
 
 }
 
 func (connection Connection) Unsubscribe(w http.ResponseWriter, req *http.Request) {
-	//Get parameters value
-	params := req.URL.Query()
-	// If no parameters Give error
-	if len(params) == 0 {
-		log.Panicln("No Username Given")
-		w.Header().Set("Content-Type", "text/plain")
-		w.Write([]byte("No Username Given. Add ?username=username to url"))
+	// Confirm that the credentials are correct
+	caller, ok := authenticate(w, req)
+	if !ok {
+		return
+	}
+	username := req.URL.Query().Get("username")
+	if username == "" {
+		username = caller.Username
+	}
+	if !caller.canManageSubscriber(username) {
+		permissionDenied(w, req, caller, "unsubscribe "+username)
 		return
 	}
-	username := params.Get("username")
 
 	// Get channel document from collection
 	param := mux.Vars(req)
 	objectId, err := primitive.ObjectIDFromHex(param["id"])
 	if err != nil {
-		log.Println("Invalid ID")
+		invalidID(w, req, param["id"])
+		return
 	}
 
-	connection.Subscriptions.UpdateOne(
+	result, err := connection.Subscriptions.UpdateOne(
 		context.TODO(),
 		bson.M{"_id": objectId},
-		bson.M{"$pull": bson.M{"Subscribers": bson.M{"username": username}}},
+		pullSubscriber(username),
 	)
+	if err != nil {
+		dbError(w, req, err, "channel "+param["id"])
+		return
+	}
+	if result.MatchedCount == 0 {
+		writeProblem(w, req, http.StatusNotFound, "channel "+param["id"]+" not found")
+		return
+	}
+	// A confirmation still on its way should not subscribe them again
+	cancelled, err := connection.Pending.DeleteMany(context.TODO(), bson.M{"channel": objectId, "username": username})
+	if err != nil {
+		dbError(w, req, err, "pending subscription")
+		return
+	}
+	if result.ModifiedCount == 0 && cancelled.DeletedCount == 0 {
+		writeProblem(w, req, http.StatusNotFound, "user "+username+" is not subscribed to channel "+param["id"])
+		return
+	}
+
+	connection.Hub.touch(objectId)
 
 	// Send back response
 	w.Header().Set("Content-Type", "text/plain")
+	if result.ModifiedCount == 0 {
+		w.Write([]byte("Pending subscription of " + username + " cancelled\n"))
+		return
+	}
 	w.Write([]byte("User " + username + " successfully unsubscribed\n"))
 
 }
 
-func verifyUserPassword(username string, password string) bool {
-	url := "http://server-users:8081/verifyUser"
-	method := "POST"
-	client := &http.Client{
-		Timeout: time.Second * 10,
-	}
-	req, err := http.NewRequest(method, url, nil)
-	if err != nil {
-		fmt.Printf("Got error %s\n", err.Error())
-		return false
+// authenticate verifies the request's credentials with webUsers.
+// On failure the 401 or 502 problem has already been written.
+func authenticate(w http.ResponseWriter, req *http.Request) (Caller, bool) {
+	caller, err := verifyRequest(req)
+	if err == errNoCredentials || err == errBadCredentials {
+		w.Header().Set("WWW-Authenticate", `Basic realm="webSubscriptions", Bearer`)
+		writeProblem(w, req, http.StatusUnauthorized, err.Error())
+		return caller, false
 	}
-	req.SetBasicAuth(username, password)
-	response, err := client.Do(req)
 	if err != nil {
-		fmt.Printf("Got error %s", err.Error())
-		return false
-	}
-	defer response.Body.Close()
-	status := response.StatusCode
-	if status == 200 {
-		return true
-	} else {
-		return false
+		log.Printf("Verifying credentials failed: %v\n", err)
+		writeProblem(w, req, http.StatusBadGateway, "could not verify credentials with the users service")
+		return caller, false
 	}
-
+	return caller, true
 }
 
-func getUserDetails(username string, user *User) {
-	// Set up request
-	url := "http://server-users:8081/users?username=" + username
-	method := "GET"
-	client := &http.Client{
-		Timeout: time.Second * 10,
+// verifyRequest forwards the request's basic auth or bearer token to
+// webUsers and returns the user and roles the credentials belong to
+func verifyRequest(req *http.Request) (Caller, error) {
+	authorization := req.Header.Get("Authorization")
+	if authorization == "" {
+		return Caller{}, errNoCredentials
 	}
-	req, err := http.NewRequest(method, url, nil)
-	if err != nil {
-		fmt.Printf("Got error %s\n", err.Error())
-		return
+	identity, err := usersAPI.Verify(req.Context(), authorization)
+	if err == usersclient.ErrUnauthorized {
+		return Caller{}, errBadCredentials
 	}
-	response, err := client.Do(req)
 	if err != nil {
-		fmt.Printf("Got error %s", err.Error())
-		return
+		return Caller{}, err
 	}
-	defer response.Body.Close()
+	return Caller{Username: identity.Username, Roles: identity.Roles}, nil
+}
 
-	err = json.NewDecoder(response.Body).Decode(user)
+// lookupUser asks webUsers for the user including the email. It returns
+// usersclient.ErrNotFound only when webUsers answered that there is no
+// such user.
+func lookupUser(ctx context.Context, username string) (User, error) {
+	found, err := usersAPI.UserByUsername(ctx, username)
 	if err != nil {
-		log.Printf("%v\n", err)
-	}
-	return
-
+		return User{}, err
+	}
+	id, _ := primitive.ObjectIDFromHex(found.ID)
+	return User{
+		ID:       id,
+		Name:     found.Name,
+		Surname:  found.Surname,
+		Email:    found.Email,
+		Username: found.Username,
+		Dob:      found.Dob,
+	}, nil
 }
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// testDatabase connects to the Mongo in MONGODB_TEST_URI and returns a
+// fresh database that is dropped after the test
+func testDatabase(t *testing.T) *mongo.Database {
+	uri := os.Getenv("MONGODB_TEST_URI")
+	if uri == "" {
+		t.Skip("set MONGODB_TEST_URI to run tests against Mongo")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := client.Database("test_" + primitive.NewObjectID().Hex())
+	t.Cleanup(func() {
+		db.Drop(context.Background())
+		client.Disconnect(context.Background())
+	})
+	return db
+}
+
+func TestRemoveChannel(t *testing.T) {
+	db := testDatabase(t)
+	ctx := context.Background()
+	connection := Connection{
+		Subscriptions: db.Collection("Subscriptions"),
+		Messages:      db.Collection("Messages"),
+		Pending:       db.Collection("Pending"),
+		Outbox: &Outbox{
+			Jobs:        db.Collection("Outbox"),
+			DeadLetters: db.Collection("DeadLetters"),
+			Deliveries:  db.Collection("Deliveries"),
+		},
+	}
+	removed, kept := primitive.NewObjectID(), primitive.NewObjectID()
+	for _, channel := range []primitive.ObjectID{removed, kept} {
+		message := primitive.NewObjectID()
+		inserts := []struct {
+			collection *mongo.Collection
+			doc        bson.M
+		}{
+			{connection.Subscriptions, bson.M{"_id": channel, "name": channel.Hex()}},
+			{connection.Messages, bson.M{"_id": message, "channel": channel}},
+			{connection.Pending, bson.M{"channel": channel, "username": "pending"}},
+			{connection.Outbox.Jobs, bson.M{"message": message, "channel": channel}},
+			{connection.Outbox.DeadLetters, bson.M{"message": message, "channel": channel}},
+			{connection.Outbox.Deliveries, bson.M{"message": message, "channel": channel, "status": deliveryQueued}},
+			{connection.Outbox.Deliveries, bson.M{"message": message, "channel": channel, "status": deliverySent}},
+		}
+		for _, insert := range inserts {
+			if _, err := insert.collection.InsertOne(ctx, insert.doc); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	result, err := connection.removeChannel(ctx, removed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.DeletedCount != 1 {
+		t.Errorf("DeletedCount = %d, want 1", result.DeletedCount)
+	}
+
+	counts := []struct {
+		name       string
+		collection *mongo.Collection
+		filter     bson.M
+		want       int64
+	}{
+		{"channel", connection.Subscriptions, bson.M{"_id": removed}, 0},
+		{"messages", connection.Messages, bson.M{"channel": removed}, 0},
+		{"pending", connection.Pending, bson.M{"channel": removed}, 0},
+		{"jobs", connection.Outbox.Jobs, bson.M{"channel": removed}, 0},
+		{"dead letters", connection.Outbox.DeadLetters, bson.M{"channel": removed}, 0},
+		{"canceled deliveries", connection.Outbox.Deliveries, bson.M{"channel": removed, "status": deliveryCanceled}, 1},
+		{"sent deliveries", connection.Outbox.Deliveries, bson.M{"channel": removed, "status": deliverySent}, 1},
+		{"other channel", connection.Subscriptions, bson.M{"_id": kept}, 1},
+		{"other messages", connection.Messages, bson.M{"channel": kept}, 1},
+		{"other pending", connection.Pending, bson.M{"channel": kept}, 1},
+		{"other jobs", connection.Outbox.Jobs, bson.M{"channel": kept}, 1},
+		{"other dead letters", connection.Outbox.DeadLetters, bson.M{"channel": kept}, 1},
+		{"other queued deliveries", connection.Outbox.Deliveries, bson.M{"channel": kept, "status": deliveryQueued}, 1},
+	}
+	for _, count := range counts {
+		got, err := count.collection.CountDocuments(ctx, count.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != count.want {
+			t.Errorf("%s: %d documents, want %d", count.name, got, count.want)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// hasSubscriber reports if the user is on the channel's subscriber list
+func (channel Subscription) hasSubscriber(username string) bool {
+	for _, subs := range channel.Subscribers {
+		if subs.Username == username {
+			return true
+		}
+	}
+	return false
+}
+
+// notSubscribed matches channels the user is not subscribed to, so adding
+// them keeps the list set-like
+func notSubscribed(username string) bson.M {
+	return bson.M{"subscribers.username": bson.M{"$ne": username}}
+}
+
+// pullSubscriber removes every entry of the user
+func pullSubscriber(username string) bson.M {
+	return bson.M{"$pull": bson.M{"subscribers": bson.M{"username": username}}}
+}
+
+// How often a subscriber list that changes while it is cleaned is read again
+const dedupeAttempts = 5
+
+// dedupeChange is what cleaning one subscriber list removed
+type dedupeChange struct {
+	Channel primitive.ObjectID
+	Name    string
+	Removed map[string]int
+}
+
+// uniqueSubscribers keeps the first entry of every username. A webhook or
+// email found on a later copy is kept on the first one.
+func uniqueSubscribers(subscribers []ShortUser) ([]ShortUser, map[string]int) {
+	unique := []ShortUser{}
+	index := map[string]int{}
+	removed := map[string]int{}
+	for _, subs := range subscribers {
+		i, seen := index[subs.Username]
+		if !seen {
+			index[subs.Username] = len(unique)
+			unique = append(unique, subs)
+			continue
+		}
+		removed[subs.Username]++
+		if unique[i].Email == "" {
+			unique[i].Email = subs.Email
+		}
+		if unique[i].Webhook == nil {
+			unique[i].Webhook = subs.Webhook
+		}
+	}
+	return unique, removed
+}
+
+// dedupeSubscribers removes repeated usernames from every subscriber list.
+// With dryRun set nothing is written. It returns what was or would be
+// removed.
+func dedupeSubscribers(ctx context.Context, subscriptions *mongo.Collection, dryRun bool) ([]dedupeChange, error) {
+	var changes []dedupeChange
+	cursor, err := subscriptions.Find(ctx, bson.M{"subscribers.1": bson.M{"$exists": true}})
+	if err != nil {
+		return changes, err
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		change, err := dedupeChannel(ctx, subscriptions, cursor.Current, dryRun)
+		if err != nil {
+			return changes, err
+		}
+		if len(change.Removed) > 0 {
+			changes = append(changes, change)
+		}
+	}
+	return changes, cursor.Err()
+}
+
+// dedupeChannel cleans the subscriber list of one channel document. The
+// list is only replaced if it is still the one that was read, otherwise the
+// channel is read again so subscribers that joined meanwhile are kept.
+func dedupeChannel(ctx context.Context, subscriptions *mongo.Collection, doc bson.Raw, dryRun bool) (dedupeChange, error) {
+	for attempt := 1; ; attempt++ {
+		var channel Subscription
+		if err := bson.Unmarshal(doc, &channel); err != nil {
+			return dedupeChange{}, err
+		}
+		unique, removed := uniqueSubscribers(channel.Subscribers)
+		change := dedupeChange{Channel: channel.ID, Name: channel.Name, Removed: removed}
+		if len(removed) == 0 || dryRun {
+			return change, nil
+		}
+		result, err := subscriptions.UpdateOne(ctx,
+			bson.M{"_id": channel.ID, "subscribers": doc.Lookup("subscribers")},
+			bson.M{"$set": bson.M{"subscribers": unique}})
+		if err != nil {
+			return change, err
+		}
+		if result.MatchedCount == 1 {
+			return change, nil
+		}
+		if attempt == dedupeAttempts {
+			return change, fmt.Errorf("subscribers of %s kept changing, run again", channel.Name)
+		}
+		doc, err = subscriptions.FindOne(ctx, bson.M{"_id": channel.ID}).DecodeBytes()
+		if err == mongo.ErrNoDocuments {
+			// Deleted meanwhile, nothing left to clean
+			return dedupeChange{}, nil
+		}
+		if err != nil {
+			return change, err
+		}
+	}
+}
+
+// printDedupeReport writes one line per removed username and a total
+func printDedupeReport(out io.Writer, changes []dedupeChange, dryRun bool) {
+	verb := "Removed"
+	if dryRun {
+		verb = "Would remove"
+	}
+	total := 0
+	for _, change := range changes {
+		for username, count := range change.Removed {
+			fmt.Fprintf(out, "%s %d duplicate %s of %s from %s (%s)\n",
+				verb, count, plural(count, "entry", "entries"), username, change.Name, change.Channel.Hex())
+			total += count
+		}
+	}
+	fmt.Fprintf(out, "%s %d duplicate subscriber %s in %d channels\n", verb, total, plural(total, "entry", "entries"), len(changes))
+}
+
+// plural picks the word that fits the count
+func plural(count int, one string, many string) string {
+	if count == 1 {
+		return one
+	}
+	return many
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestUniqueSubscribers(t *testing.T) {
+	hook := &Webhook{URL: "https://example.com/hook"}
+	tests := []struct {
+		name        string
+		subscribers []ShortUser
+		want        []ShortUser
+		removed     map[string]int
+	}{
+		{
+			name:        "no duplicates",
+			subscribers: []ShortUser{{Username: "ann"}, {Username: "bob"}},
+			want:        []ShortUser{{Username: "ann"}, {Username: "bob"}},
+			removed:     map[string]int{},
+		},
+		{
+			name:        "keeps the first entry in order",
+			subscribers: []ShortUser{{Username: "ann", Email: "ann@example.com"}, {Username: "bob"}, {Username: "ann", Email: "old@example.com"}, {Username: "ann"}},
+			want:        []ShortUser{{Username: "ann", Email: "ann@example.com"}, {Username: "bob"}},
+			removed:     map[string]int{"ann": 2},
+		},
+		{
+			name:        "fills email and webhook from later copies",
+			subscribers: []ShortUser{{Username: "ann"}, {Username: "ann", Email: "ann@example.com"}, {Username: "ann", Webhook: hook}},
+			want:        []ShortUser{{Username: "ann", Email: "ann@example.com", Webhook: hook}},
+			removed:     map[string]int{"ann": 2},
+		},
+		{
+			name:        "empty list",
+			subscribers: nil,
+			want:        []ShortUser{},
+			removed:     map[string]int{},
+		},
+	}
+	for _, test := range tests {
+		unique, removed := uniqueSubscribers(test.subscribers)
+		if !reflect.DeepEqual(unique, test.want) {
+			t.Errorf("%s: unique = %+v, want %+v", test.name, unique, test.want)
+		}
+		if !reflect.DeepEqual(removed, test.removed) {
+			t.Errorf("%s: removed = %v, want %v", test.name, removed, test.removed)
+		}
+	}
+}
+
+func TestDedupeChannelKeepsNewSubscribers(t *testing.T) {
+	db := testDatabase(t)
+	ctx := context.Background()
+	subscriptions := db.Collection("Subscriptions")
+	id := primitive.NewObjectID()
+	_, err := subscriptions.InsertOne(ctx, Subscription{ID: id, Name: "news", Subscribers: []ShortUser{
+		{Username: "ann", Email: "ann@example.com"},
+		{Username: "ann", Email: "ann@example.com"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	read, err := subscriptions.FindOne(ctx, bson.M{"_id": id}).DecodeBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Someone subscribes after the list was read
+	_, err = subscriptions.UpdateOne(ctx, bson.M{"_id": id},
+		bson.M{"$push": bson.M{"subscribers": ShortUser{Username: "bob", Email: "bob@example.com"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	change, err := dedupeChannel(ctx, subscriptions, read, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(change.Removed, map[string]int{"ann": 1}) {
+		t.Errorf("removed %v, want one ann", change.Removed)
+	}
+	var channel Subscription
+	if err := subscriptions.FindOne(ctx, bson.M{"_id": id}).Decode(&channel); err != nil {
+		t.Fatal(err)
+	}
+	want := []ShortUser{
+		{Username: "ann", Email: "ann@example.com"},
+		{Username: "bob", Email: "bob@example.com"},
+	}
+	if !reflect.DeepEqual(channel.Subscribers, want) {
+		t.Errorf("subscribers = %+v, want %+v", channel.Subscribers, want)
+	}
+}
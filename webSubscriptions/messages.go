@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/FilipVdZel/pagination"
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Layout of Message.TimeCreated
+const timeCreatedLayout = "2006-01-02 15:04:05"
+
+// Fields of a message that can be sorted on and selected
+var (
+	messageSortable   = []pagination.Field{{Name: "createdAt", Type: bsontype.DateTime}}
+	messageSelectable = []string{"channel", "message", "timecreated", "createdAt", "author"}
+)
+
+// ensureMessageIndexes supports paging through a channel's messages by
+// ID and filtering them by time
+func ensureMessageIndexes(ctx context.Context, messages *mongo.Collection) error {
+	_, err := messages.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "channel", Value: 1}, {Key: "_id", Value: 1}}},
+		{Keys: bson.D{{Key: "channel", Value: 1}, {Key: "createdAt", Value: 1}, {Key: "_id", Value: 1}}},
+		{
+			Keys:    bson.D{{Key: "pendingDeliveries", Value: 1}, {Key: "createdAt", Value: 1}},
+			Options: options.Index().SetPartialFilterExpression(bson.M{"pendingDeliveries": true}),
+		},
+	})
+	return err
+}
+
+// parseMessageTime accepts RFC 3339 times and plain dates
+func parseMessageTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t, nil
+	}
+	return time.Time{}, errors.New("'" + value + "' is not a time, use RFC 3339 or YYYY-MM-DD")
+}
+
+// migrateEmbeddedMessages moves messages stored in a channel's Messages
+// array into the Messages collection. Messages keep their ID when they
+// have one, others get an ID from their place in the array so running it
+// twice is safe and equal messages are all kept.
+func migrateEmbeddedMessages(ctx context.Context, subscriptions *mongo.Collection, messages *mongo.Collection) (int, error) {
+	filter := bson.M{"$or": bson.A{
+		bson.M{"Messages": bson.M{"$exists": true}},
+		bson.M{"messages": bson.M{"$exists": true}},
+	}}
+	cursor, err := subscriptions.Find(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	moved := 0
+	for cursor.Next(ctx) {
+		var channel struct {
+			ID    primitive.ObjectID `bson:"_id"`
+			Owner string             `bson:"owner"`
+			Upper []Message          `bson:"Messages"`
+			Lower []Message          `bson:"messages"`
+		}
+		if err := cursor.Decode(&channel); err != nil {
+			return moved, err
+		}
+		for field, embedded := range map[string][]Message{"Messages": channel.Upper, "messages": channel.Lower} {
+			for i, message := range embedded {
+				message.Channel = channel.ID
+				message.Author = channel.Owner
+				if t, err := time.ParseInLocation(timeCreatedLayout, message.TimeCreated, time.Local); err == nil {
+					message.CreatedAt = t
+				} else if message.CreatedAt.IsZero() {
+					// Not older than the channel it was posted on
+					message.CreatedAt = channel.ID.Timestamp()
+				}
+				if message.ID.IsZero() {
+					message.ID = embeddedMessageID(channel.ID, field, i, message.CreatedAt)
+				}
+				_, err := messages.UpdateOne(ctx, bson.M{"_id": message.ID},
+					bson.M{"$setOnInsert": message},
+					options.Update().SetUpsert(true))
+				if err != nil {
+					return moved, err
+				}
+				moved++
+			}
+		}
+		_, err := subscriptions.UpdateOne(ctx,
+			bson.M{"_id": channel.ID},
+			bson.M{"$unset": bson.M{"Messages": "", "messages": ""}})
+		if err != nil {
+			return moved, err
+		}
+	}
+	return moved, cursor.Err()
+}
+
+// embeddedMessageID gives the message at index of the channel's array
+// the same ID on every run. The time part keeps the message in order by
+// ID, the rest comes from the channel, array and index.
+func embeddedMessageID(channel primitive.ObjectID, field string, index int, created time.Time) primitive.ObjectID {
+	sum := sha256.Sum256([]byte(channel.Hex() + "/" + field + "/" + strconv.Itoa(index)))
+	id := primitive.NewObjectIDFromTimestamp(created)
+	copy(id[4:], sum[:8])
+	return id
+}
+
+// errDeliveriesPending is returned when a message was stored but its
+// deliveries could not be queued yet, recoverPending queues them later
+var errDeliveriesPending = errors.New("message stored, deliveries are queued later")
+
+// postMessage stores the caller's message on the channel, publishes it to
+// live streams and queues it for every subscriber. It returns the message
+// and how many deliveries were queued. The message is stored marked
+// pending, so deliveries that were not queued are never lost. Callers check
+// canPostTo first.
+func (connection Connection) postMessage(ctx context.Context, caller Caller, channel Subscription, text string) (Message, int, error) {
+	// Add time to message
+	currentTime := time.Now()
+	message := Message{
+		ID:          primitive.NewObjectID(),
+		Channel:     channel.ID,
+		Message:     text,
+		TimeCreated: currentTime.Format(timeCreatedLayout),
+		CreatedAt:   currentTime,
+		Author:      caller.Username,
+		// Cleared once the deliveries are queued
+		PendingDeliveries: true,
+	}
+
+	// Store message in its own collection so channels do not grow
+	_, err := connection.Messages.InsertOne(ctx, message)
+	if err != nil {
+		return message, 0, err
+	}
+	log.Printf("Message %s posted to %s\n", message.ID.Hex(), channel.Name)
+	connection.Hub.posted(message)
+
+	// Queue an email or webhook call for every subscriber, the outbox workers send them
+	queued, err := connection.Outbox.enqueue(ctx, channel, message)
+	if err == nil {
+		err = connection.Outbox.enqueued(ctx, message.ID)
+	}
+	message.PendingDeliveries = false
+	if err != nil {
+		log.Printf("Queueing deliveries of message %s failed, retrying later: %v\n", message.ID.Hex(), err)
+		return message, 0, errDeliveriesPending
+	}
+	return message, queued, nil
+}
+
+// channelFromPath loads the channel named by the {id} route variable
+func (connection Connection) channelFromPath(w http.ResponseWriter, req *http.Request) (Subscription, bool) {
+	var channel Subscription
+	id := mux.Vars(req)["id"]
+	objectId, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		invalidID(w, req, id)
+		return channel, false
+	}
+	err = connection.Subscriptions.FindOne(context.TODO(), bson.M{"_id": objectId}).Decode(&channel)
+	if err != nil {
+		dbError(w, req, err, "channel "+id)
+		return channel, false
+	}
+	return channel, true
+}
+
+// Handlers
+func (connection Connection) getMessages(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	channel, ok := connection.channelFromPath(w, req)
+	if !ok {
+		return
+	}
+
+	params := req.URL.Query()
+	page, err := connection.Pager.Parse(params, messageSortable, messageSelectable)
+	if err != nil {
+		writeProblem(w, req, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Only messages of this channel, optionally within [from, to)
+	filter := bson.M{"channel": channel.ID}
+	created := bson.M{}
+	if from := params.Get("from"); from != "" {
+		t, err := parseMessageTime(from)
+		if err != nil {
+			writeProblem(w, req, http.StatusBadRequest, "from: "+err.Error())
+			return
+		}
+		created["$gte"] = t
+	}
+	if to := params.Get("to"); to != "" {
+		t, err := parseMessageTime(to)
+		if err != nil {
+			writeProblem(w, req, http.StatusBadRequest, "to: "+err.Error())
+			return
+		}
+		created["$lt"] = t
+	}
+	if len(created) > 0 {
+		filter["createdAt"] = created
+	}
+
+	docs, total, next, err := pagination.Find(context.TODO(), connection.Messages, req, page, filter, page.Projection(bson.M{}))
+	if err != nil {
+		dbError(w, req, err, "messages")
+		return
+	}
+	messages := make([]Message, len(docs))
+	ids := make([]primitive.ObjectID, len(docs))
+	for i, doc := range docs {
+		err = bson.Unmarshal(doc, &messages[i])
+		if err != nil {
+			serverError(w, req, err)
+			return
+		}
+		ids[i] = messages[i].ID
+	}
+	counts, err := deliveryCounts(context.TODO(), connection.Outbox.Deliveries, ids)
+	if err != nil {
+		dbError(w, req, err, "deliveries")
+		return
+	}
+	for i := range messages {
+		messages[i].Deliveries = counts[messages[i].ID]
+	}
+	json.NewEncoder(w).Encode(pagination.Page{
+		Data:  messages,
+		Total: total,
+		Limit: page.Limit,
+		Next:  next,
+	})
+}
+
+func (connection Connection) getMessage(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	channel, ok := connection.channelFromPath(w, req)
+	if !ok {
+		return
+	}
+	param := mux.Vars(req)
+	messageId, err := primitive.ObjectIDFromHex(param["msgId"])
+	if err != nil {
+		invalidID(w, req, param["msgId"])
+		return
+	}
+
+	var message Message
+	err = connection.Messages.FindOne(context.TODO(), bson.M{"_id": messageId, "channel": channel.ID}).Decode(&message)
+	if err != nil {
+		dbError(w, req, err, "message "+param["msgId"])
+		return
+	}
+	counts, err := deliveryCounts(context.TODO(), connection.Outbox.Deliveries, []primitive.ObjectID{message.ID})
+	if err != nil {
+		dbError(w, req, err, "deliveries")
+		return
+	}
+	message.Deliveries = counts[message.ID]
+	json.NewEncoder(w).Encode(message)
+}
+
+func (connection Connection) deleteMessage(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	// Confirm that the credentials are correct
+	caller, ok := authenticate(w, req)
+	if !ok {
+		return
+	}
+
+	// retrieve map of veriables from get url
+	param := mux.Vars(req)
+	messageId, err := primitive.ObjectIDFromHex(param["msgId"])
+	if err != nil {
+		invalidID(w, req, param["msgId"])
+		return
+	}
+	channel, ok := connection.channelFromPath(w, req)
+	if !ok {
+		return
+	}
+
+	// Owners, moderators and admins may remove messages
+	if !caller.canRemoveMessages(channel) {
+		permissionDenied(w, req, caller, "remove messages from "+channel.Name)
+		return
+	}
+
+	result, err := connection.Messages.DeleteOne(context.TODO(), bson.M{"_id": messageId, "channel": channel.ID})
+	if err != nil {
+		dbError(w, req, err, "message "+param["msgId"])
+		return
+	}
+	if result.DeletedCount == 0 {
+		writeProblem(w, req, http.StatusNotFound, "message "+param["msgId"]+" not found")
+		return
+	}
+	// A removed message must not be sent any more
+	canceled, err := connection.Outbox.cancel(context.TODO(), messageId)
+	if err != nil {
+		log.Printf("Canceling deliveries of message %s failed: %v\n", param["msgId"], err)
+	}
+	log.Printf("%s removed message %s from %s, %d deliveries canceled\n", caller.Username, param["msgId"], channel.Name, canceled)
+	json.NewEncoder(w).Encode(result)
+
+}
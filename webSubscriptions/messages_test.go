@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestEmbeddedMessageID(t *testing.T) {
+	channel := primitive.NewObjectID()
+	created := time.Date(2022, 1, 25, 10, 30, 0, 0, time.UTC)
+	id := embeddedMessageID(channel, "Messages", 0, created)
+	if again := embeddedMessageID(channel, "Messages", 0, created); again != id {
+		t.Errorf("ID changed between runs: %s and %s", id.Hex(), again.Hex())
+	}
+	if !id.Timestamp().Equal(created) {
+		t.Errorf("ID time = %v, want %v", id.Timestamp(), created)
+	}
+	// Equal messages posted in the same second stay apart
+	others := []primitive.ObjectID{
+		embeddedMessageID(channel, "Messages", 1, created),
+		embeddedMessageID(channel, "messages", 0, created),
+		embeddedMessageID(primitive.NewObjectID(), "Messages", 0, created),
+	}
+	for _, other := range others {
+		if other == id {
+			t.Errorf("different messages share ID %s", id.Hex())
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Settings of the migration lock
+const (
+	migrationLockID    = "lock"
+	migrationLockLease = 10 * time.Minute
+	migrationLockWait  = 2 * time.Second
+)
+
+// migration is one versioned change to the stored data. Migrations run
+// once, in order, and must be safe to run again if they fail halfway.
+type migration struct {
+	Version     int
+	Description string
+	Up          func(ctx context.Context, db *mongo.Database, collections Collections) error
+}
+
+// migrations lists every migration, new ones go at the end with the next
+// version
+var migrations = []migration{
+	{
+		Version:     1,
+		Description: "merge Subscribers into subscribers and move embedded messages to the Messages collection",
+		Up:          mergeChannelFields,
+	},
+}
+
+// appliedMigration is how an applied migration is recorded in the
+// Migrations collection
+type appliedMigration struct {
+	Version     int       `bson:"_id"`
+	Description string    `bson:"description"`
+	AppliedAt   time.Time `bson:"appliedAt"`
+	DurationMS  int64     `bson:"durationMs"`
+}
+
+// lockMigrations takes the lock document so only one replica migrates at a
+// time. A lock left by a crashed replica expires after the lease.
+func lockMigrations(ctx context.Context, coll *mongo.Collection, owner string) error {
+	for {
+		now := time.Now()
+		_, err := coll.UpdateOne(ctx,
+			bson.M{"_id": migrationLockID, "lockedUntil": bson.M{"$lt": now}},
+			bson.M{"$set": bson.M{"owner": owner, "lockedUntil": now.Add(migrationLockLease)}},
+			options.Update().SetUpsert(true))
+		if err == nil {
+			return nil
+		}
+		if !mongo.IsDuplicateKeyError(err) {
+			return err
+		}
+		// Somebody else holds the lock
+		select {
+		case <-ctx.Done():
+			return errors.New("waiting for the migration lock: " + ctx.Err().Error())
+		case <-time.After(migrationLockWait):
+		}
+	}
+}
+
+// unlockMigrations releases the lock if we still hold it
+func unlockMigrations(ctx context.Context, coll *mongo.Collection, owner string) error {
+	_, err := coll.DeleteOne(ctx, bson.M{"_id": migrationLockID, "owner": owner})
+	return err
+}
+
+// runMigrations applies the migrations that were not applied yet and
+// returns the versions it applied
+func runMigrations(ctx context.Context, db *mongo.Database, collections Collections) ([]int, error) {
+	coll := db.Collection(collections.Migrations)
+	host, _ := os.Hostname()
+	owner := fmt.Sprintf("%s-%d-%d", host, os.Getpid(), time.Now().UnixNano())
+	if err := lockMigrations(ctx, coll, owner); err != nil {
+		return nil, err
+	}
+	defer unlockMigrations(context.Background(), coll, owner)
+
+	// Look up what is applied only once we hold the lock, another replica
+	// may just have finished
+	cursor, err := coll.Find(ctx, bson.M{"_id": bson.M{"$ne": migrationLockID}})
+	if err != nil {
+		return nil, err
+	}
+	var done []appliedMigration
+	if err := cursor.All(ctx, &done); err != nil {
+		return nil, err
+	}
+	applied := map[int]bool{}
+	for _, record := range done {
+		applied[record.Version] = true
+	}
+
+	var ran []int
+	for _, m := range migrations {
+		if applied[m.Version] {
+			continue
+		}
+		log.Printf("Applying migration %d: %s\n", m.Version, m.Description)
+		start := time.Now()
+		if err := m.Up(ctx, db, collections); err != nil {
+			return ran, fmt.Errorf("migration %d failed: %v", m.Version, err)
+		}
+		_, err := coll.InsertOne(ctx, appliedMigration{
+			Version:     m.Version,
+			Description: m.Description,
+			AppliedAt:   time.Now(),
+			DurationMS:  time.Since(start).Milliseconds(),
+		})
+		if err != nil {
+			return ran, err
+		}
+		ran = append(ran, m.Version)
+	}
+	return ran, nil
+}
+
+// Migrations
+
+// mergeChannelFields fixes channels written under the capitalised keys.
+// Subscribers found under "Subscribers" join the ones under "subscribers",
+// keeping one entry per username, and embedded messages move to the
+// Messages collection.
+func mergeChannelFields(ctx context.Context, db *mongo.Database, collections Collections) error {
+	subscriptions := db.Collection(collections.Subscriptions)
+	cursor, err := subscriptions.Find(ctx, bson.M{"Subscribers": bson.M{"$exists": true}})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	merged := 0
+	for cursor.Next(ctx) {
+		var channel struct {
+			ID    primitive.ObjectID `bson:"_id"`
+			Upper []ShortUser        `bson:"Subscribers"`
+			Lower []ShortUser        `bson:"subscribers"`
+		}
+		if err := cursor.Decode(&channel); err != nil {
+			return err
+		}
+		// Entries already under the right key win
+		subscribers, _ := uniqueSubscribers(append(channel.Lower, channel.Upper...))
+		_, err := subscriptions.UpdateOne(ctx,
+			bson.M{"_id": channel.ID},
+			bson.M{"$set": bson.M{"subscribers": subscribers}, "$unset": bson.M{"Subscribers": ""}})
+		if err != nil {
+			return err
+		}
+		merged++
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+	if merged > 0 {
+		log.Printf("Merged the subscribers of %d channels\n", merged)
+	}
+
+	moved, err := migrateEmbeddedMessages(ctx, subscriptions, db.Collection(collections.Messages))
+	if moved > 0 {
+		log.Printf("Moved %d embedded messages to the Messages collection\n", moved)
+	}
+	return err
+}
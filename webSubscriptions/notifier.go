@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Email is a plain text message to one recipient
+type Email struct {
+	From    string
+	ReplyTo string
+	To      string
+	Subject string
+	Body    string
+}
+
+// Notifier delivers emails to subscribers
+type Notifier interface {
+	Send(ctx context.Context, email Email) error
+}
+
+// SMTPNotifier sends emails through an SMTP server
+type SMTPNotifier struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+	StartTLS bool
+	Timeout  time.Duration
+}
+
+// MemoryNotifier keeps sent emails in memory, for tests
+type MemoryNotifier struct {
+	mu   sync.Mutex
+	sent []Email
+}
+
+// FileNotifier appends every email to a file in mbox format
+type FileNotifier struct {
+	Path string
+	From string
+	mu   sync.Mutex
+}
+
+// loadNotifier picks the notifier of notifier.kind. smtp sends with the
+// smtp settings, file writes to notifier.file.
+func loadNotifier(config Config) (Notifier, error) {
+	switch config.Notifier {
+	case "smtp":
+		return &SMTPNotifier{
+			Host:     config.SMTPHost,
+			Port:     config.SMTPPort,
+			Username: config.SMTPUsername,
+			Password: config.SMTPPassword,
+			From:     config.EmailFrom,
+			StartTLS: config.SMTPStartTLS,
+			Timeout:  config.SMTPTimeout,
+		}, nil
+	case "file":
+		return &FileNotifier{Path: config.NotifierFile, From: config.EmailFrom}, nil
+	case "memory":
+		return &MemoryNotifier{}, nil
+	default:
+		return nil, errors.New("unknown notifier " + config.Notifier + ", use smtp, file or memory")
+	}
+}
+
+// messageEmail builds the email a subscriber receives for a channel message
+func messageEmail(channel Subscription, message Message, subscriber ShortUser) Email {
+	var body strings.Builder
+	fmt.Fprintf(&body, "Hi %s,\n\n", subscriber.Username)
+	fmt.Fprintf(&body, "%s posted a new message on %s:\n\n", channel.Owner, channel.Name)
+	body.WriteString(message.Message)
+	fmt.Fprintf(&body, "\n\nSent %s\n", message.TimeCreated)
+	fmt.Fprintf(&body, "You receive this email because you subscribed to %s.\n", channel.Name)
+	return Email{
+		ReplyTo: channel.OwnerEmail,
+		To:      subscriber.Email,
+		Subject: "[" + channel.Name + "] New message from " + channel.Owner,
+		Body:    body.String(),
+	}
+}
+
+// isBounce reports if the SMTP server or webhook rejected the message for
+// good, so retrying will not help
+func isBounce(err error) bool {
+	var smtpErr *textproto.Error
+	var hookErr *webhookError
+	switch {
+	case err == errWebhookRemoved:
+		return true
+	case errors.As(err, &smtpErr):
+		return smtpErr.Code >= 500
+	case errors.As(err, &hookErr):
+		return hookErr.Status == http.StatusGone
+	}
+	return false
+}
+
+// hasLineBreak reports if a header value would break out of its header
+func hasLineBreak(value string) bool {
+	return strings.ContainsAny(value, "\r\n")
+}
+
+// formatEmail renders the email as an RFC 5322 message with CRLF line
+// endings and a quoted-printable UTF-8 body
+func formatEmail(email Email) ([]byte, error) {
+	for _, value := range []string{email.From, email.ReplyTo, email.To, email.Subject} {
+		if hasLineBreak(value) {
+			return nil, errors.New("email header contains a line break")
+		}
+	}
+	if _, err := mail.ParseAddress(email.To); err != nil {
+		return nil, errors.New("invalid recipient " + email.To)
+	}
+	id := make([]byte, 12)
+	rand.Read(id)
+	domain := "localhost"
+	if at := strings.LastIndex(email.From, "@"); at >= 0 {
+		domain = email.From[at+1:]
+	}
+
+	var msg bytes.Buffer
+	msg.WriteString("From: " + email.From + "\r\n")
+	if email.ReplyTo != "" {
+		msg.WriteString("Reply-To: " + email.ReplyTo + "\r\n")
+	}
+	msg.WriteString("To: " + email.To + "\r\n")
+	msg.WriteString("Subject: " + mime.QEncoding.Encode("utf-8", email.Subject) + "\r\n")
+	msg.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	msg.WriteString("Message-ID: <" + hex.EncodeToString(id) + "@" + domain + ">\r\n")
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	msg.WriteString("Content-Transfer-Encoding: quoted-printable\r\n")
+	msg.WriteString("\r\n")
+	body := quotedprintable.NewWriter(&msg)
+	body.Write([]byte(strings.ReplaceAll(email.Body, "\n", "\r\n")))
+	body.Close()
+	return msg.Bytes(), nil
+}
+
+// Send delivers the email over SMTP, upgrading to TLS when configured
+func (n *SMTPNotifier) Send(ctx context.Context, email Email) error {
+	if email.From == "" {
+		email.From = n.From
+	}
+	msg, err := formatEmail(email)
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(n.Timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	addr := net.JoinHostPort(n.Host, strconv.Itoa(n.Port))
+	dialer := net.Dialer{Deadline: deadline}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(deadline)
+	client, err := smtp.NewClient(conn, n.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if n.StartTLS {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			return errors.New("smtp server " + addr + " does not support STARTTLS")
+		}
+		if err := client.StartTLS(&tls.Config{ServerName: n.Host}); err != nil {
+			return err
+		}
+	}
+	if n.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", n.Username, n.Password, n.Host)); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(email.From); err != nil {
+		return err
+	}
+	if err := client.Rcpt(email.To); err != nil {
+		return err
+	}
+	data, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := data.Write(msg); err != nil {
+		return err
+	}
+	if err := data.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// Send records the email
+func (n *MemoryNotifier) Send(ctx context.Context, email Email) error {
+	if _, err := formatEmail(email); err != nil {
+		return err
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.sent = append(n.sent, email)
+	return nil
+}
+
+// Sent returns a copy of the emails recorded so far
+func (n *MemoryNotifier) Sent() []Email {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]Email(nil), n.sent...)
+}
+
+// Send appends the formatted email to the file
+func (n *FileNotifier) Send(ctx context.Context, email Email) error {
+	if email.From == "" {
+		email.From = n.From
+	}
+	msg, err := formatEmail(email)
+	if err != nil {
+		return err
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	file, err := os.OpenFile(n.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	// mbox separator line
+	_, err = fmt.Fprintf(file, "From %s %s\n%s\n", email.From, time.Now().Format(time.ANSIC), msg)
+	if err != nil {
+		log.Printf("Writing email to %s failed: %v\n", n.Path, err)
+	}
+	return err
+}
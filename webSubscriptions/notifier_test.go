@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io/ioutil"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// smtpSink is an in-process SMTP server that keeps what it receives.
+// Recipients in reject are refused with a 550.
+type smtpSink struct {
+	listener net.Listener
+	reject   map[string]bool
+
+	mu       sync.Mutex
+	from     string
+	to       []string
+	messages []string
+}
+
+func newSMTPSink(t *testing.T) *smtpSink {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &smtpSink{listener: listener, reject: map[string]bool{}}
+	go sink.serve()
+	return sink
+}
+
+func (sink *smtpSink) port() int {
+	return sink.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (sink *smtpSink) close() {
+	sink.listener.Close()
+}
+
+func (sink *smtpSink) serve() {
+	for {
+		conn, err := sink.listener.Accept()
+		if err != nil {
+			return
+		}
+		go sink.session(conn)
+	}
+}
+
+// session speaks just enough SMTP for net/smtp
+func (sink *smtpSink) session(conn net.Conn) {
+	defer conn.Close()
+	text := textproto.NewConn(conn)
+	text.PrintfLine("220 sink ESMTP")
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch verb {
+		case "EHLO", "HELO":
+			text.PrintfLine("250-sink\r\n250 8BITMIME")
+		case "MAIL":
+			sink.mu.Lock()
+			sink.from = address(line)
+			sink.mu.Unlock()
+			text.PrintfLine("250 OK")
+		case "RCPT":
+			to := address(line)
+			if sink.reject[to] {
+				text.PrintfLine("550 no such user")
+				continue
+			}
+			sink.mu.Lock()
+			sink.to = append(sink.to, to)
+			sink.mu.Unlock()
+			text.PrintfLine("250 OK")
+		case "DATA":
+			text.PrintfLine("354 go ahead")
+			data, err := text.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			sink.mu.Lock()
+			sink.messages = append(sink.messages, string(data))
+			sink.mu.Unlock()
+			text.PrintfLine("250 queued")
+		case "QUIT":
+			text.PrintfLine("221 bye")
+			return
+		default:
+			text.PrintfLine("502 not implemented")
+		}
+	}
+}
+
+// address takes the address out of MAIL FROM:<a> and RCPT TO:<a>
+func address(line string) string {
+	start, end := strings.Index(line, "<"), strings.Index(line, ">")
+	if start < 0 || end < start {
+		return ""
+	}
+	return line[start+1 : end]
+}
+
+func TestFormatEmail(t *testing.T) {
+	msg, err := formatEmail(Email{
+		From:    "noreply@example.com",
+		ReplyTo: "owner@example.com",
+		To:      "ann@example.com",
+		Subject: "[Nieuws] Café opent",
+		Body:    "line one\nline twee é\n",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(strings.ReplaceAll(string(msg), "\r\n", ""), "\n") {
+		t.Error("message has bare LF line endings")
+	}
+	parsed, err := mail.ReadMessage(strings.NewReader(string(msg)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for header, want := range map[string]string{
+		"From":                      "noreply@example.com",
+		"Reply-To":                  "owner@example.com",
+		"To":                        "ann@example.com",
+		"Content-Type":              "text/plain; charset=UTF-8",
+		"Content-Transfer-Encoding": "quoted-printable",
+	} {
+		if got := parsed.Header.Get(header); got != want {
+			t.Errorf("%s = %q, want %q", header, got, want)
+		}
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(parsed.Header.Get("Subject"))
+	if err != nil || subject != "[Nieuws] Café opent" {
+		t.Errorf("Subject = %q (%v)", subject, err)
+	}
+	if !strings.HasSuffix(parsed.Header.Get("Message-ID"), "@example.com>") {
+		t.Errorf("Message-ID %q does not use the sender's domain", parsed.Header.Get("Message-ID"))
+	}
+	body, err := ioutil.ReadAll(quotedprintable.NewReader(parsed.Body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "line one\r\nline twee é\r\n" {
+		t.Errorf("body = %q", body)
+	}
+}
+
+func TestFormatEmailRejects(t *testing.T) {
+	tests := []struct {
+		name  string
+		email Email
+	}{
+		{"line break in subject", Email{To: "ann@example.com", Subject: "hi\r\nBcc: eve@example.com"}},
+		{"line break in reply-to", Email{To: "ann@example.com", ReplyTo: "a@example.com\nBcc: eve@example.com"}},
+		{"invalid recipient", Email{To: "not an address"}},
+		{"no recipient", Email{}},
+	}
+	for _, test := range tests {
+		if _, err := formatEmail(test.email); err == nil {
+			t.Errorf("%s: formatEmail accepted it", test.name)
+		}
+	}
+}
+
+func TestSMTPNotifierSend(t *testing.T) {
+	sink := newSMTPSink(t)
+	defer sink.close()
+	notifier := &SMTPNotifier{Host: "127.0.0.1", Port: sink.port(), From: "noreply@example.com", Timeout: 5 * time.Second}
+
+	err := notifier.Send(context.Background(), Email{To: "ann@example.com", Subject: "Hello", Body: "Hi Ann\n"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if sink.from != "noreply@example.com" {
+		t.Errorf("MAIL FROM = %q, want the notifier's From", sink.from)
+	}
+	if len(sink.to) != 1 || sink.to[0] != "ann@example.com" {
+		t.Errorf("RCPT TO = %v", sink.to)
+	}
+	if len(sink.messages) != 1 {
+		t.Fatalf("sink received %d messages, want 1", len(sink.messages))
+	}
+	parsed, err := mail.ReadMessage(bufio.NewReader(strings.NewReader(sink.messages[0])))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Header.Get("Subject") != "Hello" || parsed.Header.Get("From") != "noreply@example.com" {
+		t.Errorf("headers = %v", parsed.Header)
+	}
+}
+
+func TestSMTPNotifierSendBounce(t *testing.T) {
+	sink := newSMTPSink(t)
+	defer sink.close()
+	sink.reject["gone@example.com"] = true
+	notifier := &SMTPNotifier{Host: "127.0.0.1", Port: sink.port(), From: "noreply@example.com", Timeout: 5 * time.Second}
+
+	err := notifier.Send(context.Background(), Email{To: "gone@example.com", Subject: "Hello", Body: "Hi"})
+	if err == nil {
+		t.Fatal("Send succeeded for a rejected recipient")
+	}
+	if !isBounce(err) {
+		t.Errorf("isBounce(%v) = false, a 550 is permanent", err)
+	}
+}
+
+func TestSMTPNotifierSendUnreachable(t *testing.T) {
+	sink := newSMTPSink(t)
+	port := sink.port()
+	sink.close()
+	notifier := &SMTPNotifier{Host: "127.0.0.1", Port: port, From: "noreply@example.com", Timeout: time.Second}
+
+	err := notifier.Send(context.Background(), Email{To: "ann@example.com", Subject: "Hello"})
+	if err == nil {
+		t.Fatal("Send succeeded without a server")
+	}
+	if isBounce(err) {
+		t.Errorf("isBounce(%v) = true, a refused connection is worth retrying", err)
+	}
+}
+
+func TestIsBounce(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"mailbox unavailable", &textproto.Error{Code: 550, Msg: "no such user"}, true},
+		{"mailbox full", &textproto.Error{Code: 452, Msg: "try later"}, false},
+		{"wrapped smtp error", wrapError{&textproto.Error{Code: 554, Msg: "rejected"}}, true},
+		{"webhook gone", &webhookError{Status: http.StatusGone}, true},
+		{"webhook failing", &webhookError{Status: http.StatusInternalServerError}, false},
+		{"webhook removed", errWebhookRemoved, true},
+		{"network error", errors.New("connection refused"), false},
+		{"no error", nil, false},
+	}
+	for _, test := range tests {
+		if got := isBounce(test.err); got != test.want {
+			t.Errorf("%s: isBounce = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+// wrapError hides an error behind Unwrap
+type wrapError struct {
+	err error
+}
+
+func (w wrapError) Error() string { return "sending failed: " + w.err.Error() }
+func (w wrapError) Unwrap() error { return w.err }
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// How long a subscription waits for its confirmation
+const confirmTTL = 48 * time.Hour
+
+// Returned for confirmation tokens that are forged, mangled or too old
+var errBadConfirmToken = errors.New("confirmation link is not valid or has expired")
+
+// PendingSubscription is a subscription waiting for the user to confirm
+// it from the email sent to them
+type PendingSubscription struct {
+	ID        primitive.ObjectID `bson:"_id"`
+	Channel   primitive.ObjectID `bson:"channel"`
+	Username  string             `bson:"username"`
+	Email     string             `bson:"email"`
+	CreatedAt time.Time          `bson:"createdAt"`
+	ExpiresAt time.Time          `bson:"expiresAt"`
+}
+
+// loadConfirmSecret returns the configured secret. Without one links only
+// work until the service restarts.
+func loadConfirmSecret(configured string) []byte {
+	if configured != "" {
+		return []byte(configured)
+	}
+	log.Println("confirmSecret not set, using a random signing key")
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		log.Fatal(err)
+	}
+	return secret
+}
+
+// ensurePendingIndexes keeps one pending subscription per channel and
+// user and lets Mongo remove expired ones
+func ensurePendingIndexes(ctx context.Context, pending *mongo.Collection) error {
+	_, err := pending.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "channel", Value: 1}, {Key: "username", Value: 1}},
+			Options: options.Index().SetName("channel_username_unique").SetUnique(true),
+		},
+		{
+			Keys:    bson.M{"expiresAt": 1},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	})
+	return err
+}
+
+// signConfirmToken binds the pending subscription and its expiry
+func signConfirmToken(secret []byte, id primitive.ObjectID, expires time.Time) string {
+	payload := id.Hex() + "." + strconv.FormatInt(expires.Unix(), 10)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." +
+		base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifyConfirmToken checks the signature and expiry and returns the ID
+// of the pending subscription
+func verifyConfirmToken(secret []byte, token string) (primitive.ObjectID, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return primitive.NilObjectID, errBadConfirmToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return primitive.NilObjectID, errBadConfirmToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return primitive.NilObjectID, errBadConfirmToken
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return primitive.NilObjectID, errBadConfirmToken
+	}
+	fields := strings.Split(string(payload), ".")
+	if len(fields) != 2 {
+		return primitive.NilObjectID, errBadConfirmToken
+	}
+	expires, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return primitive.NilObjectID, errBadConfirmToken
+	}
+	id, err := primitive.ObjectIDFromHex(fields[0])
+	if err != nil {
+		return primitive.NilObjectID, errBadConfirmToken
+	}
+	return id, nil
+}
+
+// createPending stores a pending subscription, asking again replaces the
+// earlier one so only the newest link works
+func (connection Connection) createPending(ctx context.Context, channel Subscription, user ShortUser) (PendingSubscription, error) {
+	now := time.Now()
+	pending := PendingSubscription{
+		ID:        primitive.NewObjectID(),
+		Channel:   channel.ID,
+		Username:  user.Username,
+		Email:     user.Email,
+		CreatedAt: now,
+		ExpiresAt: now.Add(confirmTTL),
+	}
+	_, err := connection.Pending.DeleteMany(ctx, bson.M{"channel": channel.ID, "username": user.Username})
+	if err != nil {
+		return pending, err
+	}
+	_, err = connection.Pending.InsertOne(ctx, pending)
+	return pending, err
+}
+
+// confirmEmail asks the user to confirm the subscription with the link
+func confirmEmail(channel Subscription, user ShortUser, link string) Email {
+	var body strings.Builder
+	fmt.Fprintf(&body, "Hi %s,\n\n", user.Username)
+	fmt.Fprintf(&body, "Please confirm you want to receive the messages of %s by opening this link and pressing the button:\n\n", channel.Name)
+	fmt.Fprintf(&body, "%s\n\n", link)
+	fmt.Fprintf(&body, "The link works for %d hours. If you did not ask for this you can ignore this email.\n", int(confirmTTL.Hours()))
+	return Email{
+		To:      user.Email,
+		Subject: "Confirm your subscription to " + channel.Name,
+		Body:    body.String(),
+	}
+}
+
+// confirmLink is the URL the confirmation email points to
+func (connection Connection) confirmLink(pending PendingSubscription) string {
+	token := signConfirmToken(connection.ConfirmSecret, pending.ID, pending.ExpiresAt)
+	return strings.TrimRight(connection.PublicURL, "/") + "/subscribe/confirm?token=" + url.QueryEscape(token)
+}
+
+// confirmPageTemplate asks to confirm with a button. Opening the link
+// only shows it, so mail scanners that follow links subscribe no one.
+var confirmPageTemplate = template.Must(template.New("confirm").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Confirm your subscription</title></head>
+<body>
+<p>Subscribe {{.Username}} to {{.Channel}}?</p>
+<form method="post" action="">
+<input type="hidden" name="token" value="{{.Token}}">
+<button type="submit">Confirm subscription</button>
+</form>
+</body>
+</html>
+`))
+
+// Handlers
+
+// confirmPage shows the confirmation button for the link in the email
+func (connection Connection) confirmPage(w http.ResponseWriter, req *http.Request) {
+	token := req.URL.Query().Get("token")
+	if token == "" {
+		writeProblem(w, req, http.StatusBadRequest, "no token given, use the link from the confirmation email")
+		return
+	}
+	id, err := verifyConfirmToken(connection.ConfirmSecret, token)
+	if err != nil {
+		writeProblem(w, req, http.StatusBadRequest, err.Error())
+		return
+	}
+	var pending PendingSubscription
+	err = connection.Pending.FindOne(context.TODO(), bson.M{"_id": id}).Decode(&pending)
+	if err == mongo.ErrNoDocuments {
+		writeProblem(w, req, http.StatusNotFound, "subscription was already confirmed or replaced by a newer link")
+		return
+	}
+	if err != nil {
+		dbError(w, req, err, "pending subscription")
+		return
+	}
+	var channel Subscription
+	err = connection.Subscriptions.FindOne(context.TODO(), bson.M{"_id": pending.Channel}).Decode(&channel)
+	if err != nil {
+		dbError(w, req, err, "channel "+pending.Channel.Hex())
+		return
+	}
+
+	// The token is in the URL, keep it out of caches and referrers
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	err = confirmPageTemplate.Execute(w, map[string]string{
+		"Username": pending.Username,
+		"Channel":  channel.Name,
+		"Token":    token,
+	})
+	if err != nil {
+		log.Printf("Rendering the confirmation page failed: %v\n", err)
+	}
+}
+
+// ConfirmSubscription finishes a subscription from the form of the
+// confirmation page. Each link works once.
+func (connection Connection) ConfirmSubscription(w http.ResponseWriter, req *http.Request) {
+	token := req.FormValue("token")
+	if token == "" {
+		writeProblem(w, req, http.StatusBadRequest, "no token given, use the link from the confirmation email")
+		return
+	}
+	id, err := verifyConfirmToken(connection.ConfirmSecret, token)
+	if err != nil {
+		writeProblem(w, req, http.StatusBadRequest, err.Error())
+		return
+	}
+	var pending PendingSubscription
+	err = connection.Pending.FindOneAndDelete(context.TODO(), bson.M{"_id": id}).Decode(&pending)
+	if err == mongo.ErrNoDocuments {
+		writeProblem(w, req, http.StatusNotFound, "subscription was already confirmed or replaced by a newer link")
+		return
+	}
+	if err != nil {
+		dbError(w, req, err, "pending subscription")
+		return
+	}
+
+	// Only add the user when they are not on the list yet and the channel
+	// was not archived since they asked
+	shortuser := ShortUser{Username: pending.Username, Email: pending.Email}
+	filter := notSubscribed(pending.Username)
+	filter["_id"] = pending.Channel
+	filter["archived"] = bson.M{"$ne": true}
+	var channel Subscription
+	err = connection.Subscriptions.FindOneAndUpdate(context.TODO(),
+		filter,
+		bson.M{"$push": bson.M{"subscribers": shortuser}},
+	).Decode(&channel)
+	if err == mongo.ErrNoDocuments {
+		// The channel is gone or archived, or the user is subscribed already
+		err = connection.Subscriptions.FindOne(context.TODO(), bson.M{"_id": pending.Channel}).Decode(&channel)
+		if err != nil {
+			dbError(w, req, err, "channel "+pending.Channel.Hex())
+			return
+		}
+		if channel.Archived {
+			writeProblem(w, req, http.StatusGone, "channel "+channel.Name+" is archived")
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("User " + pending.Username + " is already subscribed to " + channel.Name + "\n"))
+		return
+	}
+	if err != nil {
+		dbError(w, req, err, "channel "+pending.Channel.Hex())
+		return
+	}
+	connection.Hub.touch(channel.ID)
+	log.Printf("%s confirmed the subscription to %s\n", pending.Username, channel.Name)
+
+	// Send back response
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte("User " + pending.Username + " successfully subscribed to " + channel.Name + "\n"))
+}
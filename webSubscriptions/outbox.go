@@ -0,0 +1,665 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/FilipVdZel/pagination"
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Defaults for the delivery queue
+const (
+	defaultOutboxWorkers = 4
+	defaultMaxAttempts   = 8
+	firstRetryDelay      = 30 * time.Second
+	maxRetryDelay        = time.Hour
+	deliveryLease        = 2 * time.Minute
+	outboxPollInterval   = 5 * time.Second
+	// Messages still marked pending after this get their deliveries
+	// queued by recoverPending
+	pendingGrace = time.Minute
+)
+
+// Fields of a dead letter that can be sorted on and selected
+var (
+	deadLetterSortable   = []pagination.Field{{Name: "failedAt", Type: bsontype.DateTime}}
+	deadLetterSelectable = []string{"message", "channel", "recipient", "email", "attempts", "lastError", "createdAt", "failedAt"}
+)
+
+// Ways a message reaches a subscriber
+const (
+	kindEmail   = "email"
+	kindWebhook = "webhook"
+)
+
+// DeliveryJob is one email or webhook call to one subscriber. Jobs wait in
+// the Outbox collection and move to DeadLetters when they keep failing.
+type DeliveryJob struct {
+	ID          primitive.ObjectID `json:"_id" bson:"_id"`
+	Message     primitive.ObjectID `json:"message" bson:"message"`
+	Channel     primitive.ObjectID `json:"channel" bson:"channel"`
+	Recipient   ShortUser          `json:"recipient" bson:"recipient"`
+	Kind        string             `json:"kind" bson:"kind,omitempty"`
+	Email       *Email             `json:"email,omitempty" bson:"email,omitempty"`
+	Webhook     *WebhookCall       `json:"webhook,omitempty" bson:"webhook,omitempty"`
+	Attempts    int                `json:"attempts" bson:"attempts"`
+	LastError   string             `json:"lastError,omitempty" bson:"lastError,omitempty"`
+	CreatedAt   time.Time          `json:"createdAt" bson:"createdAt"`
+	NextAttempt time.Time          `json:"nextAttempt" bson:"nextAttempt"`
+	LockedUntil time.Time          `json:"-" bson:"lockedUntil"`
+	FailedAt    time.Time          `json:"failedAt,omitempty" bson:"failedAt,omitempty"`
+}
+
+// Outbox delivers queued jobs with a pool of workers
+type Outbox struct {
+	Jobs          *mongo.Collection
+	DeadLetters   *mongo.Collection
+	Deliveries    *mongo.Collection
+	Subscriptions *mongo.Collection
+	Messages      *mongo.Collection
+	Notifier      Notifier
+	Webhooks      *WebhookSender
+	Workers       int
+	MaxAttempts   int
+	wake          chan struct{}
+}
+
+// newOutbox sets up the queue in the database with the outbox settings
+func newOutbox(db *mongo.Database, notifier Notifier, config Config) *Outbox {
+	return &Outbox{
+		Jobs:          db.Collection(config.Collections.Outbox),
+		DeadLetters:   db.Collection(config.Collections.DeadLetters),
+		Deliveries:    db.Collection(config.Collections.Deliveries),
+		Subscriptions: db.Collection(config.Collections.Subscriptions),
+		Messages:      db.Collection(config.Collections.Messages),
+		Notifier:      notifier,
+		Webhooks:      &WebhookSender{Client: newWebhookClient(config.WebhookTimeout)},
+		Workers:       config.OutboxWorkers,
+		MaxAttempts:   config.OutboxAttempts,
+		wake:          make(chan struct{}, 1),
+	}
+}
+
+// ensureOutboxIndexes supports claiming due jobs and listing dead letters
+func ensureOutboxIndexes(ctx context.Context, jobs *mongo.Collection, deadLetters *mongo.Collection) error {
+	_, err := jobs.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "nextAttempt", Value: 1}}},
+		{Keys: bson.D{{Key: "message", Value: 1}}},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = deadLetters.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "failedAt", Value: 1}, {Key: "_id", Value: 1}}},
+		{Keys: bson.D{{Key: "message", Value: 1}}},
+	})
+	return err
+}
+
+// retryDelay doubles the wait after every failed attempt, up to
+// maxRetryDelay, with some jitter so retries do not line up
+func retryDelay(attempts int) time.Duration {
+	delay := firstRetryDelay
+	for i := 1; i < attempts && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	return delay + time.Duration(rand.Int63n(int64(delay)/5+1))
+}
+
+// enqueue stores a queued delivery and a job for every email and webhook
+// of the channel's subscribers and returns how many are queued. A
+// subscriber listed twice is only sent the message once. Running it again
+// for the same message only adds what is missing: deliveries are unique
+// per message, subscriber and kind, and a job shares its delivery's ID.
+func (outbox *Outbox) enqueue(ctx context.Context, channel Subscription, message Message) (int, error) {
+	now := time.Now()
+	var deliveries []interface{}
+	subscribers := map[string]ShortUser{}
+	for _, subs := range channel.Subscribers {
+		if _, seen := subscribers[subs.Username]; seen {
+			continue
+		}
+		subscribers[subs.Username] = subs
+		// Webhook secrets stay in the channel, not in every job
+		recipient := ShortUser{Username: subs.Username, Email: subs.Email}
+		for _, kind := range subscriberKinds(subs) {
+			deliveries = append(deliveries, newDelivery(DeliveryJob{
+				ID:        primitive.NewObjectID(),
+				Message:   message.ID,
+				Channel:   channel.ID,
+				Recipient: recipient,
+				Kind:      kind,
+				CreatedAt: now,
+			}))
+		}
+	}
+	if len(deliveries) == 0 {
+		return 0, nil
+	}
+	// Deliveries go first so a worker never finishes a job without one
+	_, err := outbox.Deliveries.InsertMany(ctx, deliveries, options.InsertMany().SetOrdered(false))
+	if err != nil && !onlyDuplicates(err) {
+		return 0, err
+	}
+
+	// Every delivery still queued needs its job, existing jobs are kept
+	cursor, err := outbox.Deliveries.Find(ctx, bson.M{"message": message.ID, "status": deliveryQueued})
+	if err != nil {
+		return 0, err
+	}
+	var queued []Delivery
+	if err := cursor.All(ctx, &queued); err != nil {
+		return 0, err
+	}
+	var jobs []mongo.WriteModel
+	for _, delivery := range queued {
+		subs, ok := subscribers[delivery.Recipient.Username]
+		if !ok {
+			continue
+		}
+		job := DeliveryJob{
+			ID:          delivery.ID,
+			Message:     message.ID,
+			Channel:     channel.ID,
+			Recipient:   delivery.Recipient,
+			Kind:        delivery.Kind,
+			CreatedAt:   now,
+			NextAttempt: now,
+		}
+		switch delivery.Kind {
+		case kindEmail:
+			email := messageEmail(channel, message, subs)
+			job.Email = &email
+		case kindWebhook:
+			if subs.Webhook == nil {
+				continue
+			}
+			payload, err := messagePayload(job.ID, channel, message, subs)
+			if err != nil {
+				return 0, err
+			}
+			job.Webhook = &WebhookCall{URL: subs.Webhook.URL, Payload: payload}
+		}
+		jobs = append(jobs, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"_id": job.ID}).
+			SetUpdate(bson.M{"$setOnInsert": job}).
+			SetUpsert(true))
+	}
+	if len(jobs) > 0 {
+		_, err = outbox.Jobs.BulkWrite(ctx, jobs, options.BulkWrite().SetOrdered(false))
+		if err != nil && !onlyDuplicates(err) {
+			return 0, err
+		}
+	}
+	outbox.signal()
+	return len(queued), nil
+}
+
+// subscriberKinds lists how the subscriber gets messages
+func subscriberKinds(subs ShortUser) []string {
+	var kinds []string
+	if subs.Email != "" {
+		kinds = append(kinds, kindEmail)
+	}
+	if subs.Webhook != nil {
+		kinds = append(kinds, kindWebhook)
+	}
+	return kinds
+}
+
+// onlyDuplicates reports if every write of a bulk write failed on a unique
+// index, meaning the documents were there already
+func onlyDuplicates(err error) bool {
+	var bulk mongo.BulkWriteException
+	if !errors.As(err, &bulk) || bulk.WriteConcernError != nil || len(bulk.WriteErrors) == 0 {
+		return false
+	}
+	for _, writeErr := range bulk.WriteErrors {
+		if writeErr.Code != 11000 {
+			return false
+		}
+	}
+	return true
+}
+
+// recoverPending queues the deliveries of messages whose enqueue did not
+// finish, for instance because the replica posting them crashed. Messages
+// younger than pendingGrace may still be enqueued by their request.
+func (outbox *Outbox) recoverPending(ctx context.Context) {
+	ticker := time.NewTicker(pendingGrace)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		cursor, err := outbox.Messages.Find(ctx, bson.M{
+			"pendingDeliveries": true,
+			"createdAt":         bson.M{"$lt": time.Now().Add(-pendingGrace)},
+		})
+		if err != nil {
+			log.Printf("Looking for messages without deliveries failed: %v\n", err)
+			continue
+		}
+		var messages []Message
+		if err := cursor.All(ctx, &messages); err != nil {
+			log.Printf("Looking for messages without deliveries failed: %v\n", err)
+			continue
+		}
+		for _, message := range messages {
+			var channel Subscription
+			err := outbox.Subscriptions.FindOne(ctx, bson.M{"_id": message.Channel}).Decode(&channel)
+			if err != nil && err != mongo.ErrNoDocuments {
+				log.Printf("Queueing deliveries of message %s failed: %v\n", message.ID.Hex(), err)
+				continue
+			}
+			// The channel of the message is gone, nobody is left to send to
+			if err == nil {
+				queued, err := outbox.enqueue(ctx, channel, message)
+				if err != nil {
+					log.Printf("Queueing deliveries of message %s failed: %v\n", message.ID.Hex(), err)
+					continue
+				}
+				log.Printf("Queued %d deliveries of message %s after an interrupted post\n", queued, message.ID.Hex())
+			}
+			if err := outbox.enqueued(ctx, message.ID); err != nil {
+				log.Printf("Clearing pending deliveries of message %s failed: %v\n", message.ID.Hex(), err)
+			}
+		}
+	}
+}
+
+// cancel stops the deliveries of a removed message. Queued jobs and dead
+// letters are dropped and deliveries not sent yet are marked canceled. A
+// job a worker is sending right now may still go out.
+func (outbox *Outbox) cancel(ctx context.Context, message primitive.ObjectID) (int64, error) {
+	return outbox.cancelWhere(ctx, bson.M{"message": message})
+}
+
+// cancelChannel stops the deliveries of every message of a removed channel
+func (outbox *Outbox) cancelChannel(ctx context.Context, channel primitive.ObjectID) (int64, error) {
+	return outbox.cancelWhere(ctx, bson.M{"channel": channel})
+}
+
+// cancelWhere drops the jobs and dead letters matching the filter and marks
+// their deliveries canceled. It returns the number of jobs dropped.
+func (outbox *Outbox) cancelWhere(ctx context.Context, filter bson.M) (int64, error) {
+	jobs, err := outbox.Jobs.DeleteMany(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	_, err = outbox.DeadLetters.DeleteMany(ctx, filter)
+	if err != nil {
+		return jobs.DeletedCount, err
+	}
+	now := time.Now()
+	unsent := bson.M{"status": bson.M{"$in": bson.A{deliveryQueued, deliveryFailed}}}
+	for key, value := range filter {
+		unsent[key] = value
+	}
+	_, err = outbox.Deliveries.UpdateMany(ctx, unsent,
+		bson.M{"$set": bson.M{"status": deliveryCanceled, "canceledAt": now, "updatedAt": now}})
+	return jobs.DeletedCount, err
+}
+
+// enqueued clears the marker of a message whose deliveries are all queued
+func (outbox *Outbox) enqueued(ctx context.Context, message primitive.ObjectID) error {
+	_, err := outbox.Messages.UpdateOne(ctx, bson.M{"_id": message}, bson.M{"$unset": bson.M{"pendingDeliveries": ""}})
+	return err
+}
+
+// signal wakes an idle worker without blocking
+func (outbox *Outbox) signal() {
+	select {
+	case outbox.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run starts the workers and blocks until the context is cancelled
+func (outbox *Outbox) Run(ctx context.Context) {
+	log.Printf("Starting %d delivery workers\n", outbox.Workers)
+	go outbox.recoverPending(ctx)
+	done := make(chan struct{})
+	for i := 0; i < outbox.Workers; i++ {
+		go func() {
+			outbox.work(ctx)
+			done <- struct{}{}
+		}()
+	}
+	for i := 0; i < outbox.Workers; i++ {
+		<-done
+	}
+}
+
+// work claims and delivers jobs until none are due, then waits for new
+// jobs or the next poll
+func (outbox *Outbox) work(ctx context.Context) {
+	ticker := time.NewTicker(outboxPollInterval)
+	defer ticker.Stop()
+	for {
+		job, err := outbox.claim(ctx)
+		switch {
+		case err == nil:
+			// More jobs may be due, let another idle worker look
+			outbox.signal()
+			outbox.deliver(ctx, job)
+			continue
+		case err != mongo.ErrNoDocuments:
+			log.Printf("Claiming delivery job failed: %v\n", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-outbox.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// claim locks the job that is due first. A worker that dies keeps the
+// lock for deliveryLease, after that another worker picks the job up.
+func (outbox *Outbox) claim(ctx context.Context) (DeliveryJob, error) {
+	var job DeliveryJob
+	now := time.Now()
+	err := outbox.Jobs.FindOneAndUpdate(ctx,
+		bson.M{"nextAttempt": bson.M{"$lte": now}, "lockedUntil": bson.M{"$lte": now}},
+		bson.M{"$set": bson.M{"lockedUntil": now.Add(deliveryLease)}, "$inc": bson.M{"attempts": 1}},
+		options.FindOneAndUpdate().
+			SetSort(bson.D{{Key: "nextAttempt", Value: 1}}).
+			SetReturnDocument(options.After),
+	).Decode(&job)
+	return job, err
+}
+
+// kind is how the job reaches the subscriber, jobs from before webhooks
+// are emails
+func (job DeliveryJob) kind() string {
+	if job.Kind == "" {
+		return kindEmail
+	}
+	return job.Kind
+}
+
+// send makes one attempt at the job. Webhooks are signed with the
+// subscriber's current secrets so a rotation applies to queued jobs too.
+func (outbox *Outbox) send(ctx context.Context, job DeliveryJob) error {
+	switch {
+	case job.kind() == kindEmail && job.Email != nil:
+		return outbox.Notifier.Send(ctx, *job.Email)
+	case job.kind() == kindWebhook && job.Webhook != nil:
+		hook, err := subscriberWebhook(ctx, outbox.Subscriptions, job.Channel, job.Recipient.Username)
+		if err != nil {
+			return err
+		}
+		call := *job.Webhook
+		call.URL = hook.URL
+		return outbox.Webhooks.Send(ctx, job.ID, call, hook.secrets(time.Now()))
+	}
+	return errors.New("job " + job.ID.Hex() + " has nothing to send")
+}
+
+// deliver sends the email and removes the job, schedules a retry or
+// moves it to the dead letters
+func (outbox *Outbox) deliver(ctx context.Context, job DeliveryJob) {
+	sendCtx, cancel := context.WithTimeout(ctx, deliveryLease/2)
+	err := outbox.send(sendCtx, job)
+	cancel()
+	if err == nil {
+		outbox.record(ctx, job, deliverySent)
+		if _, err := outbox.Jobs.DeleteOne(ctx, bson.M{"_id": job.ID}); err != nil {
+			log.Printf("Removing delivered job %s failed: %v\n", job.ID.Hex(), err)
+		}
+		return
+	}
+
+	job.LastError = err.Error()
+	// The server refused the address, trying again will not help
+	if isBounce(err) || job.Attempts >= outbox.MaxAttempts {
+		status := deliveryFailed
+		if isBounce(err) {
+			status = deliveryBounced
+		}
+		log.Printf("Giving up on %s of message %s to %s after %d attempts: %v\n",
+			job.kind(), job.Message.Hex(), job.Recipient.Username, job.Attempts, err)
+		if err := outbox.bury(ctx, job); err != nil {
+			log.Printf("Moving job %s to dead letters failed: %v\n", job.ID.Hex(), err)
+		}
+		outbox.record(ctx, job, status)
+		return
+	}
+	outbox.record(ctx, job, deliveryQueued)
+	next := time.Now().Add(retryDelay(job.Attempts))
+	log.Printf("Sending %s of message %s to %s failed, retrying at %s: %v\n",
+		job.kind(), job.Message.Hex(), job.Recipient.Username, next.Format(time.RFC3339), err)
+	_, err = outbox.Jobs.UpdateOne(ctx,
+		bson.M{"_id": job.ID},
+		bson.M{"$set": bson.M{"nextAttempt": next, "lockedUntil": time.Time{}, "lastError": job.LastError}})
+	if err != nil {
+		log.Printf("Rescheduling job %s failed: %v\n", job.ID.Hex(), err)
+	}
+}
+
+// record updates the delivery of the job, a failure is only logged as
+// the job itself is what gets retried
+func (outbox *Outbox) record(ctx context.Context, job DeliveryJob, status string) {
+	if err := setDeliveryStatus(ctx, outbox.Deliveries, job, status); err != nil {
+		log.Printf("Recording delivery %s as %s failed: %v\n", job.ID.Hex(), status, err)
+	}
+}
+
+// bury moves the job to the dead letters. The job is written before it is
+// removed, so a crash in between leaves a copy rather than losing it.
+func (outbox *Outbox) bury(ctx context.Context, job DeliveryJob) error {
+	job.FailedAt = time.Now()
+	job.LockedUntil = time.Time{}
+	_, err := outbox.DeadLetters.ReplaceOne(ctx, bson.M{"_id": job.ID}, job, options.Replace().SetUpsert(true))
+	if err != nil {
+		return err
+	}
+	_, err = outbox.Jobs.DeleteOne(ctx, bson.M{"_id": job.ID})
+	return err
+}
+
+// replay puts a dead letter back in the queue with a fresh set of attempts
+func (outbox *Outbox) replay(ctx context.Context, job DeliveryJob) error {
+	job.Attempts = 0
+	job.NextAttempt = time.Now()
+	job.LockedUntil = time.Time{}
+	job.FailedAt = time.Time{}
+	_, err := outbox.Jobs.ReplaceOne(ctx, bson.M{"_id": job.ID}, job, options.Replace().SetUpsert(true))
+	if err != nil {
+		return err
+	}
+	_, err = outbox.DeadLetters.DeleteOne(ctx, bson.M{"_id": job.ID})
+	if err != nil {
+		return err
+	}
+	outbox.record(ctx, job, deliveryQueued)
+	outbox.signal()
+	return nil
+}
+
+// deadLetterFilter narrows dead letters down by ?channel= and ?message=
+func deadLetterFilter(w http.ResponseWriter, req *http.Request) (bson.M, bool) {
+	filter := bson.M{}
+	for _, field := range []string{"channel", "message"} {
+		value := req.URL.Query().Get(field)
+		if value == "" {
+			continue
+		}
+		id, err := primitive.ObjectIDFromHex(value)
+		if err != nil {
+			invalidID(w, req, value)
+			return nil, false
+		}
+		filter[field] = id
+	}
+	return filter, true
+}
+
+// deadLetterFromPath loads the dead letter named by the {id} route variable
+func (connection Connection) deadLetterFromPath(w http.ResponseWriter, req *http.Request) (DeliveryJob, bool) {
+	var job DeliveryJob
+	id := mux.Vars(req)["id"]
+	objectId, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		invalidID(w, req, id)
+		return job, false
+	}
+	err = connection.Outbox.DeadLetters.FindOne(context.TODO(), bson.M{"_id": objectId}).Decode(&job)
+	if err != nil {
+		dbError(w, req, err, "dead letter "+id)
+		return job, false
+	}
+	return job, true
+}
+
+// Handlers
+func (connection Connection) getDeadLetters(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if _, ok := requireAdmin(w, req, "inspect dead letters"); !ok {
+		return
+	}
+	page, err := connection.Pager.Parse(req.URL.Query(), deadLetterSortable, deadLetterSelectable)
+	if err != nil {
+		writeProblem(w, req, http.StatusBadRequest, err.Error())
+		return
+	}
+	filter, ok := deadLetterFilter(w, req)
+	if !ok {
+		return
+	}
+
+	docs, total, next, err := pagination.Find(context.TODO(), connection.Outbox.DeadLetters, req, page, filter, page.Projection(bson.M{}))
+	if err != nil {
+		dbError(w, req, err, "dead letters")
+		return
+	}
+	jobs := make([]DeliveryJob, len(docs))
+	for i, doc := range docs {
+		err = bson.Unmarshal(doc, &jobs[i])
+		if err != nil {
+			serverError(w, req, err)
+			return
+		}
+	}
+	json.NewEncoder(w).Encode(pagination.Page{
+		Data:  jobs,
+		Total: total,
+		Limit: page.Limit,
+		Next:  next,
+	})
+}
+
+func (connection Connection) getDeadLetter(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if _, ok := requireAdmin(w, req, "inspect dead letters"); !ok {
+		return
+	}
+	job, ok := connection.deadLetterFromPath(w, req)
+	if !ok {
+		return
+	}
+	json.NewEncoder(w).Encode(job)
+}
+
+func (connection Connection) replayDeadLetter(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	caller, ok := requireAdmin(w, req, "replay dead letters")
+	if !ok {
+		return
+	}
+	job, ok := connection.deadLetterFromPath(w, req)
+	if !ok {
+		return
+	}
+	err := connection.Outbox.replay(context.TODO(), job)
+	if err != nil {
+		dbError(w, req, err, "dead letter "+job.ID.Hex())
+		return
+	}
+	log.Printf("%s replayed dead letter %s\n", caller.Username, job.ID.Hex())
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]int{"replayed": 1})
+}
+
+// replayDeadLetters replays every dead letter matching ?channel= and ?message=
+func (connection Connection) replayDeadLetters(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	caller, ok := requireAdmin(w, req, "replay dead letters")
+	if !ok {
+		return
+	}
+	filter, ok := deadLetterFilter(w, req)
+	if !ok {
+		return
+	}
+	cursor, err := connection.Outbox.DeadLetters.Find(context.TODO(), filter)
+	if err != nil {
+		dbError(w, req, err, "dead letters")
+		return
+	}
+	defer cursor.Close(context.TODO())
+
+	replayed := 0
+	for cursor.Next(context.TODO()) {
+		var job DeliveryJob
+		if err := cursor.Decode(&job); err != nil {
+			serverError(w, req, err)
+			return
+		}
+		if err := connection.Outbox.replay(context.TODO(), job); err != nil {
+			dbError(w, req, err, "dead letter "+job.ID.Hex())
+			return
+		}
+		replayed++
+	}
+	if err := cursor.Err(); err != nil {
+		dbError(w, req, err, "dead letters")
+		return
+	}
+	log.Printf("%s replayed %d dead letters\n", caller.Username, replayed)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]int{"replayed": replayed})
+}
+
+func (connection Connection) deleteDeadLetter(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	caller, ok := requireAdmin(w, req, "discard dead letters")
+	if !ok {
+		return
+	}
+	id := mux.Vars(req)["id"]
+	objectId, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		invalidID(w, req, id)
+		return
+	}
+	result, err := connection.Outbox.DeadLetters.DeleteOne(context.TODO(), bson.M{"_id": objectId})
+	if err != nil {
+		dbError(w, req, err, "dead letter "+id)
+		return
+	}
+	if result.DeletedCount == 0 {
+		writeProblem(w, req, http.StatusNotFound, "dead letter "+id+" not found")
+		return
+	}
+	log.Printf("%s discarded dead letter %s\n", caller.Username, id)
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		attempts int
+		base     time.Duration
+	}{
+		{0, firstRetryDelay},
+		{1, firstRetryDelay},
+		{2, 2 * firstRetryDelay},
+		{3, 4 * firstRetryDelay},
+		{5, 16 * firstRetryDelay},
+		{8, maxRetryDelay},
+		{100, maxRetryDelay},
+	}
+	for _, test := range tests {
+		for i := 0; i < 20; i++ {
+			delay := retryDelay(test.attempts)
+			// Jitter adds up to a fifth
+			if delay < test.base || delay > test.base+test.base/5 {
+				t.Errorf("retryDelay(%d) = %v, want %v plus up to a fifth", test.attempts, delay, test.base)
+				break
+			}
+		}
+	}
+}
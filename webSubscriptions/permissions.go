@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+)
+
+// Roles assigned by webUsers
+const (
+	roleUser      = "user"
+	roleModerator = "moderator"
+	roleAdmin     = "admin"
+)
+
+// Caller is the user behind a verified request
+type Caller struct {
+	Username string   `json:"username"`
+	Roles    []string `json:"roles"`
+}
+
+// hasRole reports if the caller holds the role
+func (caller Caller) hasRole(role string) bool {
+	for _, r := range caller.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// owns reports if the caller created the channel
+func (caller Caller) owns(channel Subscription) bool {
+	return caller.Username != "" && caller.Username == channel.Owner
+}
+
+// canEditChannel reports if the caller may update or delete the channel
+func (caller Caller) canEditChannel(channel Subscription) bool {
+	return caller.owns(channel) || caller.hasRole(roleAdmin)
+}
+
+// canPostTo reports if the caller may send messages on the channel
+func (caller Caller) canPostTo(channel Subscription) bool {
+	return caller.owns(channel)
+}
+
+// canRemoveMessages reports if the caller may remove messages from the channel
+func (caller Caller) canRemoveMessages(channel Subscription) bool {
+	return caller.owns(channel) || caller.hasRole(roleModerator) || caller.hasRole(roleAdmin)
+}
+
+// canViewDeliveries reports if the caller may see who received the channel's messages
+func (caller Caller) canViewDeliveries(channel Subscription) bool {
+	return caller.owns(channel) || caller.hasRole(roleAdmin)
+}
+
+// canManageSubscriber reports if the caller may change how the subscriber
+// receives messages
+func (caller Caller) canManageSubscriber(username string) bool {
+	return (caller.Username != "" && caller.Username == username) || caller.hasRole(roleAdmin)
+}
+
+// canViewUserChannels reports if the caller may list the channels the
+// user owns or is subscribed to
+func (caller Caller) canViewUserChannels(username string) bool {
+	return (caller.Username != "" && caller.Username == username) || caller.hasRole(roleAdmin)
+}
+
+// permissionDenied writes the response for a caller that lacks the right
+func permissionDenied(w http.ResponseWriter, req *http.Request, caller Caller, action string) {
+	writeProblem(w, req, http.StatusForbidden, "user "+caller.Username+" may not "+action)
+}
+
+// requireAdmin authenticates the request and checks the caller is an admin
+func requireAdmin(w http.ResponseWriter, req *http.Request, action string) (Caller, bool) {
+	caller, ok := authenticate(w, req)
+	if !ok {
+		return caller, false
+	}
+	if !caller.hasRole(roleAdmin) {
+		permissionDenied(w, req, caller, action)
+		return caller, false
+	}
+	return caller, true
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/FilipVdZel/golang-mods/usersclient"
+	"github.com/FilipVdZel/problem"
+)
+
+// Errors are answered with RFC 7807 problems from the shared problem module
+var (
+	writeProblem       = problem.Write
+	writeProblemErrors = problem.WriteErrors
+	invalidID          = problem.InvalidID
+	serverError        = problem.ServerError
+	dbError            = problem.DBError
+)
+
+// usersError maps a failed webUsers lookup of the user onto the matching
+// status
+func usersError(w http.ResponseWriter, req *http.Request, err error, username string) {
+	switch {
+	case err == usersclient.ErrNotFound:
+		writeProblem(w, req, http.StatusNotFound, "user "+username+" not found")
+	case err == usersclient.ErrCircuitOpen:
+		writeProblem(w, req, http.StatusServiceUnavailable, "the users service is unavailable, try again later")
+	default:
+		log.Printf("%s %s: looking up %s: %v\n", req.Method, req.URL.Path, username, err)
+		writeProblem(w, req, http.StatusBadGateway, "could not look up "+username+" with the users service")
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/FilipVdZel/golang-mods/usersclient"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// How often channel data is compared with webUsers by default
+const defaultReconcileInterval = time.Hour
+
+// driftMissingUser is the Field of a user webUsers does not know
+const driftMissingUser = "missing user"
+
+// driftFix is one copy of user data that did not match webUsers
+type driftFix struct {
+	Channel  primitive.ObjectID
+	Name     string
+	Username string
+	// owneremail, subscriber email, or missing user
+	Field string
+	From  string
+	To    string
+}
+
+// userDirectory looks users up in webUsers once per run
+type userDirectory map[string]*User
+
+// get returns the user, or nil when webUsers does not know them
+func (directory userDirectory) get(ctx context.Context, username string) (*User, error) {
+	if user, ok := directory[username]; ok {
+		return user, nil
+	}
+	user, err := lookupUser(ctx, username)
+	if err == usersclient.ErrNotFound {
+		directory[username] = nil
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	directory[username] = &user
+	return &user, nil
+}
+
+// reconcile compares every channel's copies of user emails with webUsers
+// and fixes the ones that drifted. Users webUsers no longer knows are only
+// reported, they may be renamed with the event not handled yet, and a
+// deletion is cascaded by its user.deleted event. With dryRun set nothing
+// is written. Any lookup failure stops the run.
+func (consumer *UserEventConsumer) reconcile(ctx context.Context, dryRun bool) ([]driftFix, error) {
+	subscriptions := consumer.connection.Subscriptions
+	var fixes []driftFix
+	directory := userDirectory{}
+
+	cursor, err := subscriptions.Find(ctx, bson.M{},
+		options.Find().SetProjection(bson.M{"name": 1, "owner": 1, "owneremail": 1, "subscribers.username": 1, "subscribers.email": 1}))
+	if err != nil {
+		return fixes, err
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		var channel Subscription
+		if err := cursor.Decode(&channel); err != nil {
+			return fixes, err
+		}
+		var found []driftFix
+		if channel.Owner != "" {
+			owner, err := directory.get(ctx, channel.Owner)
+			if err != nil {
+				return fixes, err
+			}
+			switch {
+			case owner == nil:
+				found = append(found, driftFix{Username: channel.Owner, Field: driftMissingUser})
+			case owner.Email != "" && owner.Email != channel.OwnerEmail:
+				// A blank email means webUsers did not show it, never copy that
+				found = append(found, driftFix{Username: channel.Owner, Field: "owneremail", From: channel.OwnerEmail, To: owner.Email})
+			}
+		}
+		for _, subs := range channel.Subscribers {
+			user, err := directory.get(ctx, subs.Username)
+			if err != nil {
+				return fixes, err
+			}
+			switch {
+			case user == nil:
+				found = append(found, driftFix{Username: subs.Username, Field: driftMissingUser})
+			case subs.Email != "" && user.Email != "" && user.Email != subs.Email:
+				// Webhook-only subscribers have no email and keep it that way
+				found = append(found, driftFix{Username: subs.Username, Field: "subscriber email", From: subs.Email, To: user.Email})
+			}
+		}
+		for _, fix := range found {
+			fix.Channel, fix.Name = channel.ID, channel.Name
+			fixes = append(fixes, fix)
+			if dryRun || fix.Field == driftMissingUser {
+				continue
+			}
+			if err := consumer.applyDriftFix(ctx, fix); err != nil {
+				return fixes, err
+			}
+		}
+	}
+	return fixes, cursor.Err()
+}
+
+// applyDriftFix writes the email webUsers has
+func (consumer *UserEventConsumer) applyDriftFix(ctx context.Context, fix driftFix) error {
+	subscriptions := consumer.connection.Subscriptions
+	if fix.Field == "owneremail" {
+		_, err := subscriptions.UpdateOne(ctx,
+			bson.M{"_id": fix.Channel, "owner": fix.Username},
+			bson.M{"$set": bson.M{"owneremail": fix.To}})
+		return err
+	}
+	_, err := subscriptions.UpdateOne(ctx,
+		bson.M{"_id": fix.Channel},
+		bson.M{"$set": bson.M{"subscribers.$[subscriber].email": fix.To}},
+		options.Update().SetArrayFilters(options.ArrayFilters{Filters: []interface{}{
+			bson.M{"subscriber.username": fix.Username, "subscriber.email": fix.From},
+		}}))
+	return err
+}
+
+// reconcileEvery runs reconcile at the interval until the context ends
+func (consumer *UserEventConsumer) reconcileEvery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		fixes, err := consumer.reconcile(ctx, false)
+		fixed, missing := countDrift(fixes)
+		if fixed > 0 {
+			log.Printf("Reconciling user data fixed %d copies\n", fixed)
+		}
+		if missing > 0 {
+			log.Printf("Reconciling user data found %d copies of users webUsers does not know\n", missing)
+		}
+		if err != nil {
+			log.Printf("Reconciling user data failed: %v\n", err)
+		}
+	}
+}
+
+// countDrift splits the fixes into fixed copies and missing users
+func countDrift(fixes []driftFix) (fixed int, missing int) {
+	for _, fix := range fixes {
+		if fix.Field == driftMissingUser {
+			missing++
+		} else {
+			fixed++
+		}
+	}
+	return fixed, missing
+}
+
+// printDriftReport writes one line per fix and a total
+func printDriftReport(out io.Writer, fixes []driftFix, dryRun bool) {
+	verb := "Fixed"
+	if dryRun {
+		verb = "Would fix"
+	}
+	for _, fix := range fixes {
+		if fix.Field == driftMissingUser {
+			fmt.Fprintf(out, "Found %s (%s): %s is not known to webUsers, left for its user.deleted event\n", fix.Name, fix.Channel.Hex(), fix.Username)
+			continue
+		}
+		fmt.Fprintf(out, "%s %s (%s): %s of %s %s -> %s\n", verb, fix.Name, fix.Channel.Hex(), fix.Field, fix.Username, fix.From, fix.To)
+	}
+	fixed, missing := countDrift(fixes)
+	fmt.Fprintf(out, "%s %d drifted %s\n", verb, fixed, plural(fixed, "copy", "copies"))
+	if missing > 0 {
+		fmt.Fprintf(out, "Found %d %s of unknown users\n", missing, plural(missing, "copy", "copies"))
+	}
+}
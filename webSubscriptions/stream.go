@@ -0,0 +1,431 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Settings of the message streams
+const (
+	hubClientBuffer     = 64
+	streamHeartbeat     = 15 * time.Second
+	streamReplayBatch   = 500
+	streamRetryInterval = 3 * time.Second
+	changeStreamBackoff = 5 * time.Second
+	// Replicas store messages slightly out of order, a reconnecting
+	// stream replays from this long before its last message
+	streamReplayOverlap = 10 * time.Second
+	// Message IDs the hub remembers to drop duplicates
+	hubRecentMessages = 1024
+)
+
+// Errors of a change stream that can not be resumed from its token
+var changeStreamLost = map[int32]bool{
+	260: true, // InvalidResumeToken
+	280: true, // ChangeStreamFatalError
+	286: true, // ChangeStreamHistoryLost
+}
+
+// Hub fans new messages out to the streams listening on their channel.
+// With change streams every replica sees every message, otherwise only
+// messages posted to this process are published.
+type Hub struct {
+	mu       sync.Mutex
+	channels map[primitive.ObjectID]map[*hubClient]bool
+	// Set while the change stream is open, while it is down local
+	// messages are published directly
+	watching bool
+	// Recently published messages, a message posted while the stream was
+	// down comes again once it resumes
+	recent     map[primitive.ObjectID]bool
+	recentList []primitive.ObjectID
+}
+
+// hubClient receives the messages of one channel. A client that falls
+// behind is closed so it can reconnect and catch up from the database.
+// presence is signalled when listeners or subscribers of the channel
+// change, clients that do not care can ignore it.
+type hubClient struct {
+	channel  primitive.ObjectID
+	messages chan Message
+	presence chan struct{}
+}
+
+func newHub() *Hub {
+	return &Hub{
+		channels: map[primitive.ObjectID]map[*hubClient]bool{},
+		recent:   map[primitive.ObjectID]bool{},
+	}
+}
+
+// subscribe registers a client for the channel's messages
+func (hub *Hub) subscribe(channel primitive.ObjectID) *hubClient {
+	client := &hubClient{
+		channel:  channel,
+		messages: make(chan Message, hubClientBuffer),
+		presence: make(chan struct{}, 1),
+	}
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	if hub.channels[channel] == nil {
+		hub.channels[channel] = map[*hubClient]bool{}
+	}
+	hub.channels[channel][client] = true
+	hub.notify(channel)
+	return client
+}
+
+// unsubscribe removes the client, it is safe to call more than once
+func (hub *Hub) unsubscribe(client *hubClient) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	hub.remove(client)
+}
+
+// remove drops the client and closes its messages, hub.mu must be held
+func (hub *Hub) remove(client *hubClient) {
+	clients := hub.channels[client.channel]
+	if !clients[client] {
+		return
+	}
+	delete(clients, client)
+	if len(clients) == 0 {
+		delete(hub.channels, client.channel)
+	}
+	close(client.messages)
+	hub.notify(client.channel)
+}
+
+// notify signals presence to the channel's clients. A client that has not
+// handled the last signal yet keeps that one. hub.mu must be held.
+func (hub *Hub) notify(channel primitive.ObjectID) {
+	for client := range hub.channels[channel] {
+		select {
+		case client.presence <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// touch tells the channel's clients its subscribers changed
+func (hub *Hub) touch(channel primitive.ObjectID) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	hub.notify(channel)
+}
+
+// listeners returns how many clients follow the channel
+func (hub *Hub) listeners(channel primitive.ObjectID) int {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	return len(hub.channels[channel])
+}
+
+// publish hands the message to every client of its channel without
+// blocking on slow clients. A message published shortly before is
+// dropped.
+func (hub *Hub) publish(message Message) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	if hub.recent[message.ID] {
+		return
+	}
+	hub.recent[message.ID] = true
+	hub.recentList = append(hub.recentList, message.ID)
+	if len(hub.recentList) > hubRecentMessages {
+		delete(hub.recent, hub.recentList[0])
+		hub.recentList = hub.recentList[1:]
+	}
+	for client := range hub.channels[message.Channel] {
+		select {
+		case client.messages <- message:
+		default:
+			log.Printf("Stream client on %s is too slow, disconnecting it\n", message.Channel.Hex())
+			hub.remove(client)
+		}
+	}
+}
+
+// posted publishes a message stored by this process. While the hub follows
+// a change stream the message arrives through it instead.
+func (hub *Hub) posted(message Message) {
+	hub.mu.Lock()
+	watching := hub.watching
+	hub.mu.Unlock()
+	if !watching {
+		hub.publish(message)
+	}
+}
+
+// watch follows inserts into the messages collection. Standalone Mongo
+// servers have no change streams, then an error is returned and the hub
+// keeps publishing local messages only. While the stream is down local
+// messages are published directly until it is reopened.
+func (hub *Hub) watch(ctx context.Context, messages *mongo.Collection) error {
+	pipeline := mongo.Pipeline{{{Key: "$match", Value: bson.M{"operationType": "insert"}}}}
+	stream, err := messages.Watch(ctx, pipeline)
+	if err != nil {
+		return err
+	}
+	hub.setWatching(true)
+
+	go func() {
+		for {
+			err := hub.follow(ctx, stream)
+			hub.setWatching(false)
+			token := stream.ResumeToken()
+			stream.Close(context.Background())
+			if lostChangeStream(err) {
+				log.Println("Message change stream can not be resumed, restarting it from now")
+				token = nil
+			}
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(changeStreamBackoff):
+				}
+				opts := options.ChangeStream()
+				if token != nil {
+					opts.SetResumeAfter(token)
+				}
+				stream, err = messages.Watch(ctx, pipeline, opts)
+				if err == nil {
+					hub.setWatching(true)
+					break
+				}
+				log.Printf("Reopening message change stream failed: %v\n", err)
+				if lostChangeStream(err) {
+					token = nil
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// setWatching records if the change stream is open
+func (hub *Hub) setWatching(watching bool) {
+	hub.mu.Lock()
+	hub.watching = watching
+	hub.mu.Unlock()
+}
+
+// lostChangeStream reports if the error means the resume token is no
+// longer valid
+func lostChangeStream(err error) bool {
+	var server mongo.ServerError
+	if !errors.As(err, &server) {
+		return false
+	}
+	for code := range changeStreamLost {
+		if server.HasErrorCode(int(code)) {
+			return true
+		}
+	}
+	return false
+}
+
+// follow publishes inserts from the change stream until it fails and
+// returns why it stopped
+func (hub *Hub) follow(ctx context.Context, stream *mongo.ChangeStream) error {
+	for stream.Next(ctx) {
+		var event struct {
+			FullDocument Message `bson:"fullDocument"`
+		}
+		if err := stream.Decode(&event); err != nil {
+			log.Printf("Decoding message change failed: %v\n", err)
+			continue
+		}
+		hub.publish(event.FullDocument)
+	}
+	err := stream.Err()
+	if err != nil && ctx.Err() == nil {
+		log.Printf("Message change stream stopped: %v\n", err)
+	}
+	return err
+}
+
+// writeEvent writes one server-sent event
+func writeEvent(w http.ResponseWriter, id string, event string, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", id, event, payload)
+	return err
+}
+
+// sentMessages remembers what a stream sent recently so messages that
+// come again through the hub or an overlapping replay are skipped
+type sentMessages struct {
+	ids    map[primitive.ObjectID]time.Time
+	newest time.Time
+}
+
+func newSentMessages() *sentMessages {
+	return &sentMessages{ids: map[primitive.ObjectID]time.Time{}}
+}
+
+// add records a message and forgets the ones well before the newest
+func (sent *sentMessages) add(id primitive.ObjectID, createdAt time.Time) {
+	sent.ids[id] = createdAt
+	if createdAt.After(sent.newest) {
+		sent.newest = createdAt
+		for old, at := range sent.ids {
+			if at.Before(sent.newest.Add(-2 * streamReplayOverlap)) {
+				delete(sent.ids, old)
+			}
+		}
+	}
+}
+
+// has reports if the message was sent
+func (sent *sentMessages) has(id primitive.ObjectID) bool {
+	_, ok := sent.ids[id]
+	return ok
+}
+
+// messageTime is when the message was stored, messages from before
+// createdAt fall back to the time in their ID
+func messageTime(message Message) time.Time {
+	if message.CreatedAt.IsZero() {
+		return message.ID.Timestamp()
+	}
+	return message.CreatedAt
+}
+
+// replayMessages sends the channel's messages stored since streamReplayOverlap
+// before the last event, in (createdAt, _id) order. Messages another
+// replica stored a little late are not skipped this way, at the cost of
+// sending some messages within the overlap again.
+func (connection Connection) replayMessages(ctx context.Context, w http.ResponseWriter, channel primitive.ObjectID, last primitive.ObjectID, sent *sentMessages) error {
+	since := last.Timestamp()
+	var lastMessage Message
+	err := connection.Messages.FindOne(ctx, bson.M{"_id": last, "channel": channel}).Decode(&lastMessage)
+	if err == nil {
+		since = messageTime(lastMessage)
+	} else if err != mongo.ErrNoDocuments {
+		return err
+	}
+	sent.add(last, since)
+
+	filter := bson.M{"channel": channel, "createdAt": bson.M{"$gte": since.Add(-streamReplayOverlap)}}
+	for {
+		cursor, err := connection.Messages.Find(ctx, filter,
+			options.Find().SetSort(bson.D{{Key: "createdAt", Value: 1}, {Key: "_id", Value: 1}}).SetLimit(streamReplayBatch))
+		if err != nil {
+			return err
+		}
+		var missed []Message
+		if err := cursor.All(ctx, &missed); err != nil {
+			return err
+		}
+		for _, message := range missed {
+			if sent.has(message.ID) {
+				continue
+			}
+			if err := writeEvent(w, message.ID.Hex(), "message", message); err != nil {
+				return err
+			}
+			sent.add(message.ID, messageTime(message))
+		}
+		if len(missed) < streamReplayBatch {
+			return nil
+		}
+		next := missed[len(missed)-1]
+		filter = bson.M{"channel": channel, "$or": bson.A{
+			bson.M{"createdAt": bson.M{"$gt": next.CreatedAt}},
+			bson.M{"createdAt": next.CreatedAt, "_id": bson.M{"$gt": next.ID}},
+		}}
+	}
+}
+
+// Handlers
+
+// getStream sends new messages of the channel as server-sent events.
+// Clients that reconnect with Last-Event-ID first get what they missed.
+func (connection Connection) getStream(w http.ResponseWriter, req *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeProblem(w, req, http.StatusInternalServerError, "streaming is not supported")
+		return
+	}
+	channel, ok := connection.channelFromPath(w, req)
+	if !ok {
+		return
+	}
+	lastID := req.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = req.URL.Query().Get("lastEventId")
+	}
+	var last primitive.ObjectID
+	if lastID != "" {
+		id, err := primitive.ObjectIDFromHex(lastID)
+		if err != nil {
+			invalidID(w, req, lastID)
+			return
+		}
+		last = id
+	}
+
+	// Listen before replaying so nothing posted in between is lost
+	client := connection.Hub.subscribe(channel.ID)
+	defer connection.Hub.unsubscribe(client)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", streamRetryInterval.Milliseconds())
+
+	ctx := req.Context()
+	sent := newSentMessages()
+	if !last.IsZero() {
+		err := connection.replayMessages(ctx, w, channel.ID, last, sent)
+		if err != nil {
+			log.Printf("Replaying messages of %s failed: %v\n", channel.Name, err)
+			return
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case message, open := <-client.messages:
+			if !open {
+				// Too slow, the client reconnects with Last-Event-ID
+				return
+			}
+			// Already sent while replaying
+			if sent.has(message.ID) {
+				continue
+			}
+			if err := writeEvent(w, message.ID.Hex(), "message", message); err != nil {
+				return
+			}
+			sent.add(message.ID, messageTime(message))
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
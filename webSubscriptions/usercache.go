@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/FilipVdZel/golang-mods/usersclient"
+)
+
+// newUsersAPI returns the cached webUsers client of the users settings.
+// The client reads zero as its default, in the config it turns a retry or
+// cache off.
+func newUsersAPI(config Config) *usersclient.CachedClient {
+	clientConfig := usersclient.Config{
+		BaseURL:    config.UsersURL,
+		ServiceKey: config.ServiceKey,
+		Timeout:    config.UsersTimeout,
+		Retries:    config.UsersRetries,
+	}
+	if clientConfig.Retries == 0 {
+		clientConfig.Retries = -1
+	}
+	cacheConfig := usersclient.CacheConfig{
+		Size:          config.UserCacheSize,
+		ProfileTTL:    config.UserCacheTTL,
+		CredentialTTL: config.CredentialTTL,
+	}
+	if cacheConfig.Size == 0 {
+		cacheConfig.Size = -1
+	}
+	if cacheConfig.ProfileTTL == 0 {
+		cacheConfig.ProfileTTL = -1
+	}
+	if cacheConfig.CredentialTTL == 0 {
+		cacheConfig.CredentialTTL = -1
+	}
+	return usersclient.NewCached(usersclient.New(clientConfig), cacheConfig)
+}
+
+// Handlers
+
+// getCacheStats shows how well the user caches of this replica work
+func (connection Connection) getCacheStats(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if _, ok := requireAdmin(w, req, "see cache statistics"); !ok {
+		return
+	}
+	json.NewEncoder(w).Encode(usersAPI.Stats())
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/FilipVdZel/pagination"
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ensureChannelIndexes supports looking up the channels a user is
+// subscribed to or owns, page by page
+func ensureChannelIndexes(ctx context.Context, subscriptions *mongo.Collection) error {
+	_, err := subscriptions.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "subscribers.username", Value: 1}, {Key: "_id", Value: 1}},
+			Options: options.Index().SetName("subscriber_username"),
+		},
+		{
+			Keys:    bson.D{{Key: "owner", Value: 1}, {Key: "_id", Value: 1}},
+			Options: options.Index().SetName("owner"),
+		},
+	})
+	return err
+}
+
+// userFromPath authenticates the request and returns the username in the
+// path when the caller may see that user's channels
+func userFromPath(w http.ResponseWriter, req *http.Request) (string, bool) {
+	caller, ok := authenticate(w, req)
+	if !ok {
+		return "", false
+	}
+	username := mux.Vars(req)["username"]
+	if !caller.canViewUserChannels(username) {
+		permissionDenied(w, req, caller, "see the channels of "+username)
+		return "", false
+	}
+	return username, true
+}
+
+// writeChannelPage answers with one page of channels matching the filter
+func (connection Connection) writeChannelPage(w http.ResponseWriter, req *http.Request, page pagination.Request, filter bson.M, projection bson.M) {
+	docs, total, next, err := pagination.Find(context.TODO(), connection.Subscriptions, req, page, filter, projection)
+	if err != nil {
+		dbError(w, req, err, "subscriptions")
+		return
+	}
+	channels := make([]Subscription, len(docs))
+	for i, doc := range docs {
+		err = bson.Unmarshal(doc, &channels[i])
+		if err != nil {
+			serverError(w, req, err)
+			return
+		}
+	}
+	json.NewEncoder(w).Encode(pagination.Page{
+		Data:  channels,
+		Total: total,
+		Limit: page.Limit,
+		Next:  next,
+	})
+}
+
+// Handlers
+
+// getUserSubscriptions lists the channels the user is subscribed to. Only
+// the user's own entry of each subscriber list is shown.
+func (connection Connection) getUserSubscriptions(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	username, ok := userFromPath(w, req)
+	if !ok {
+		return
+	}
+	page, err := connection.Pager.Parse(req.URL.Query(), channelSortable, channelSelectable)
+	if err != nil {
+		writeProblem(w, req, http.StatusBadRequest, err.Error())
+		return
+	}
+	own := bson.M{"$elemMatch": bson.M{"username": username}}
+	projection := page.Projection(bson.M{"name": 1, "description": 1, "owner": 1, "owneremail": 1, "subscribers": 1})
+	if _, ok := projection["subscribers"]; ok {
+		projection["subscribers"] = own
+	}
+	connection.writeChannelPage(w, req, page, bson.M{"subscribers.username": username}, projection)
+}
+
+// getUserChannels lists the channels the user owns
+func (connection Connection) getUserChannels(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	username, ok := userFromPath(w, req)
+	if !ok {
+		return
+	}
+	page, err := connection.Pager.Parse(req.URL.Query(), channelSortable, channelSelectable)
+	if err != nil {
+		writeProblem(w, req, http.StatusBadRequest, err.Error())
+		return
+	}
+	connection.writeChannelPage(w, req, page, bson.M{"owner": username}, page.Projection(bson.M{}))
+}
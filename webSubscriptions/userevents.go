@@ -0,0 +1,388 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/FilipVdZel/golang-mods/usersclient"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Settings of the user event consumer
+const (
+	userEventPollInterval = 2 * time.Second
+	userEventBatch        = 500
+	// Events of webUsers replicas can be stored slightly out of order, so
+	// every poll looks back this far and skips events it already handled
+	userEventOverlap = 10 * time.Second
+	// Handled events are remembered a while longer than the overlap
+	userEventMemory     = 24 * time.Hour
+	userEventCheckpoint = "checkpoint"
+	// How long a replica may take to handle a claimed event before
+	// another one takes over
+	userEventLease = time.Minute
+)
+
+// What claim found for an event
+const (
+	claimTaken = iota // this replica handles the event
+	claimDone         // the event was handled already
+	claimBusy         // another replica is handling it
+)
+
+// Types of user lifecycle events written by webUsers
+const (
+	eventUserCreated = "user.created"
+	eventUserUpdated = "user.updated"
+	eventUserRenamed = "user.renamed"
+	eventUserDeleted = "user.deleted"
+)
+
+// What happens to the channels of a deleted user
+const (
+	ownerPolicyArchive  = "archive"
+	ownerPolicyTransfer = "transfer"
+)
+
+// UserEvent is a change to a user as webUsers records it in UserEvents
+type UserEvent struct {
+	ID               primitive.ObjectID `bson:"_id"`
+	Type             string             `bson:"type"`
+	UserID           primitive.ObjectID `bson:"userId"`
+	Username         string             `bson:"username"`
+	PreviousUsername string             `bson:"previousUsername,omitempty"`
+	Email            string             `bson:"email,omitempty"`
+	Changed          []string           `bson:"changed,omitempty"`
+	CreatedAt        time.Time          `bson:"createdAt"`
+}
+
+// UserEventConsumer applies user changes to the copies of usernames and
+// emails kept in channel data. Every replica runs one, an event is handled
+// by whichever claims it first.
+type UserEventConsumer struct {
+	Events  *mongo.Collection
+	Handled *mongo.Collection
+	// Policy is archive or transfer, transfers go to TransferTo
+	Policy     string
+	TransferTo string
+	connection Connection
+	// Events this replica dropped from its user caches, with their time
+	invalidated map[primitive.ObjectID]time.Time
+}
+
+// newUserEventConsumer follows the events with the users.deletePolicy
+func newUserEventConsumer(db *mongo.Database, connection Connection, config Config) *UserEventConsumer {
+	return &UserEventConsumer{
+		Events:      db.Collection(config.Collections.UserEvents),
+		Handled:     db.Collection(config.Collections.HandledUserEvents),
+		Policy:      config.DeletePolicy,
+		TransferTo:  config.DeleteTransferTo,
+		connection:  connection,
+		invalidated: map[primitive.ObjectID]time.Time{},
+	}
+}
+
+// ensureHandledIndexes lets Mongo forget handled events
+func ensureHandledIndexes(ctx context.Context, handled *mongo.Collection) error {
+	_, err := handled.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.M{"expiresAt": 1},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	return err
+}
+
+// Run handles new events until the context ends
+func (consumer *UserEventConsumer) Run(ctx context.Context) {
+	log.Printf("Following user events, channels of deleted users are %sd\n", consumer.Policy)
+	ticker := time.NewTicker(userEventPollInterval)
+	defer ticker.Stop()
+	for {
+		if err := consumer.poll(ctx); err != nil {
+			log.Printf("Handling user events failed: %v\n", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// poll handles the events since the checkpoint in (createdAt, _id) order,
+// a page at a time. It stops at the first failure so the event is tried
+// again on the next poll, and at an event another replica is handling so
+// events of a user stay in order. The checkpoint only moves past events
+// that are done.
+func (consumer *UserEventConsumer) poll(ctx context.Context) error {
+	var checkpoint struct {
+		At time.Time `bson:"at"`
+	}
+	err := consumer.Handled.FindOne(ctx, bson.M{"_id": userEventCheckpoint}).Decode(&checkpoint)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return err
+	}
+	since := checkpoint.At.Add(-userEventOverlap)
+	var done time.Time
+	defer func() {
+		if !done.IsZero() {
+			consumer.advance(done)
+		}
+	}()
+	filter := bson.M{"createdAt": bson.M{"$gte": since}}
+	for {
+		cursor, err := consumer.Events.Find(ctx, filter,
+			options.Find().SetSort(bson.D{{Key: "createdAt", Value: 1}, {Key: "_id", Value: 1}}).SetLimit(userEventBatch))
+		if err != nil {
+			return err
+		}
+		var events []UserEvent
+		if err := cursor.All(ctx, &events); err != nil {
+			return err
+		}
+		consumer.invalidate(events, since)
+		for _, event := range events {
+			state, err := consumer.claim(ctx, event)
+			if err != nil {
+				return err
+			}
+			switch state {
+			case claimBusy:
+				return nil
+			case claimTaken:
+				if err := consumer.handle(ctx, event); err != nil {
+					// Give the event back so it is retried
+					consumer.release(event)
+					return errors.New(event.Type + " of " + event.Username + ": " + err.Error())
+				}
+				if err := consumer.finish(ctx, event); err != nil {
+					return err
+				}
+			}
+			done = event.CreatedAt
+		}
+		if len(events) < userEventBatch {
+			return nil
+		}
+		// The next page starts after the last event of this one
+		last := events[len(events)-1]
+		filter = bson.M{"$or": bson.A{
+			bson.M{"createdAt": bson.M{"$gt": last.CreatedAt}},
+			bson.M{"createdAt": last.CreatedAt, "_id": bson.M{"$gt": last.ID}},
+		}}
+	}
+}
+
+// advance moves the checkpoint forward to at, never back
+func (consumer *UserEventConsumer) advance(at time.Time) {
+	_, err := consumer.Handled.UpdateOne(context.Background(),
+		bson.M{"_id": userEventCheckpoint},
+		bson.M{"$max": bson.M{"at": at}},
+		options.Update().SetUpsert(true))
+	if err != nil {
+		log.Printf("Saving the user event checkpoint failed: %v\n", err)
+	}
+}
+
+// invalidate drops the users of new events from this replica's caches.
+// Every replica does this, not only the one that claims the event. since
+// is where the poll started reading.
+func (consumer *UserEventConsumer) invalidate(events []UserEvent, since time.Time) {
+	for _, event := range events {
+		if _, done := consumer.invalidated[event.ID]; done || event.Type == eventUserCreated {
+			continue
+		}
+		consumer.invalidated[event.ID] = event.CreatedAt
+		usersAPI.Invalidate(event.Username, event.PreviousUsername)
+		wsSessions.recheck(event.Username, event.PreviousUsername)
+	}
+	// Events before since are not read again
+	for id, created := range consumer.invalidated {
+		if created.Before(since) {
+			delete(consumer.invalidated, id)
+		}
+	}
+}
+
+// claim takes the event for this replica with a lease. An event stays
+// pending until finish marks it done, a released or expired claim can be
+// taken by any replica. Records without pending are done.
+func (consumer *UserEventConsumer) claim(ctx context.Context, event UserEvent) (int, error) {
+	now := time.Now()
+	_, err := consumer.Handled.InsertOne(ctx, bson.M{
+		"_id":        event.ID,
+		"type":       event.Type,
+		"pending":    true,
+		"leaseUntil": now.Add(userEventLease),
+		"handledAt":  now,
+		"expiresAt":  now.Add(userEventMemory),
+	})
+	if err == nil {
+		return claimTaken, nil
+	}
+	if !mongo.IsDuplicateKeyError(err) {
+		return claimBusy, err
+	}
+	taken, err := consumer.Handled.UpdateOne(ctx,
+		bson.M{"_id": event.ID, "pending": true, "leaseUntil": bson.M{"$lt": now}},
+		bson.M{"$set": bson.M{"leaseUntil": now.Add(userEventLease), "handledAt": now}})
+	if err != nil {
+		return claimBusy, err
+	}
+	if taken.ModifiedCount == 1 {
+		return claimTaken, nil
+	}
+	count, err := consumer.Handled.CountDocuments(ctx, bson.M{"_id": event.ID, "pending": true})
+	if err != nil {
+		return claimBusy, err
+	}
+	if count > 0 {
+		return claimBusy, nil
+	}
+	return claimDone, nil
+}
+
+// finish marks a claimed event as done
+func (consumer *UserEventConsumer) finish(ctx context.Context, event UserEvent) error {
+	_, err := consumer.Handled.UpdateOne(ctx,
+		bson.M{"_id": event.ID},
+		bson.M{"$unset": bson.M{"pending": "", "leaseUntil": ""}, "$set": bson.M{"handledAt": time.Now()}})
+	return err
+}
+
+// release ends the lease on a failed event so the next poll of any
+// replica retries it
+func (consumer *UserEventConsumer) release(event UserEvent) {
+	_, err := consumer.Handled.UpdateOne(context.Background(),
+		bson.M{"_id": event.ID, "pending": true},
+		bson.M{"$set": bson.M{"leaseUntil": time.Time{}}})
+	if err != nil {
+		log.Printf("Releasing user event %s failed: %v\n", event.ID.Hex(), err)
+	}
+}
+
+// handle applies one event, events that do not concern channels are skipped
+func (consumer *UserEventConsumer) handle(ctx context.Context, event UserEvent) error {
+	switch event.Type {
+	case eventUserDeleted:
+		return consumer.userDeleted(ctx, event.Username)
+	case eventUserRenamed:
+		if err := consumer.userRenamed(ctx, event.PreviousUsername, event.Username); err != nil {
+			return err
+		}
+	}
+	if contains(event.Changed, "email") {
+		return consumer.emailChanged(ctx, event.Username, event.Email)
+	}
+	return nil
+}
+
+// emailChanged replaces the copies of the user's email. Subscribers that
+// only receive webhooks have no email and keep it that way.
+func (consumer *UserEventConsumer) emailChanged(ctx context.Context, username string, email string) error {
+	if username == "" || email == "" {
+		return nil
+	}
+	connection := consumer.connection
+	subscribed, err := connection.Subscriptions.UpdateMany(ctx,
+		bson.M{"subscribers": bson.M{"$elemMatch": bson.M{"username": username, "email": bson.M{"$exists": true, "$ne": email}}}},
+		bson.M{"$set": bson.M{"subscribers.$[subscriber].email": email}},
+		options.Update().SetArrayFilters(options.ArrayFilters{Filters: []interface{}{
+			bson.M{"subscriber.username": username, "subscriber.email": bson.M{"$exists": true}},
+		}}))
+	if err != nil {
+		return err
+	}
+	owned, err := connection.Subscriptions.UpdateMany(ctx,
+		bson.M{"owner": username, "owneremail": bson.M{"$ne": email}},
+		bson.M{"$set": bson.M{"owneremail": email}})
+	if err != nil {
+		return err
+	}
+	_, err = connection.Pending.UpdateMany(ctx, bson.M{"username": username}, bson.M{"$set": bson.M{"email": email}})
+	if err != nil {
+		return err
+	}
+	log.Printf("Email of %s updated on %d subscriptions and %d owned channels\n", username, subscribed.ModifiedCount, owned.ModifiedCount)
+	return nil
+}
+
+// userDeleted removes the user's subscriptions and hands their channels
+// over according to the policy
+func (consumer *UserEventConsumer) userDeleted(ctx context.Context, username string) error {
+	if username == "" {
+		return nil
+	}
+	connection := consumer.connection
+	result, err := connection.Subscriptions.UpdateMany(ctx, bson.M{"subscribers.username": username}, pullSubscriber(username))
+	if err != nil {
+		return err
+	}
+	_, err = connection.Pending.DeleteMany(ctx, bson.M{"username": username})
+	if err != nil {
+		return err
+	}
+	log.Printf("Deleted user %s was removed from %d channels\n", username, result.ModifiedCount)
+
+	if consumer.Policy == ownerPolicyTransfer {
+		owner, err := lookupUser(ctx, consumer.TransferTo)
+		if err != nil && err != usersclient.ErrNotFound {
+			return err
+		}
+		if err == nil {
+			result, err = connection.Subscriptions.UpdateMany(ctx,
+				bson.M{"owner": username},
+				bson.M{"$set": bson.M{"owner": owner.Username, "owneremail": owner.Email, "previousOwner": username}})
+			if err != nil {
+				return err
+			}
+			log.Printf("Transferred %d channels of deleted user %s to %s\n", result.ModifiedCount, username, owner.Username)
+			return nil
+		}
+		log.Printf("Transfer target %s not found, archiving the channels of %s instead\n", consumer.TransferTo, username)
+	}
+	result, err = connection.Subscriptions.UpdateMany(ctx,
+		bson.M{"owner": username},
+		bson.M{
+			"$set":   bson.M{"archived": true, "previousOwner": username},
+			"$unset": bson.M{"owner": "", "owneremail": ""},
+		})
+	if err != nil {
+		return err
+	}
+	log.Printf("Archived %d channels of deleted user %s\n", result.ModifiedCount, username)
+	return nil
+}
+
+// userRenamed moves everything kept under the old username to the new one
+func (consumer *UserEventConsumer) userRenamed(ctx context.Context, from string, to string) error {
+	if from == "" || to == "" || from == to {
+		return nil
+	}
+	connection := consumer.connection
+	_, err := connection.Subscriptions.UpdateMany(ctx,
+		bson.M{"subscribers.username": from},
+		bson.M{"$set": bson.M{"subscribers.$[subscriber].username": to}},
+		options.Update().SetArrayFilters(options.ArrayFilters{Filters: []interface{}{bson.M{"subscriber.username": from}}}))
+	if err != nil {
+		return err
+	}
+	owned, err := connection.Subscriptions.UpdateMany(ctx, bson.M{"owner": from}, bson.M{"$set": bson.M{"owner": to}})
+	if err != nil {
+		return err
+	}
+	_, err = connection.Messages.UpdateMany(ctx, bson.M{"author": from}, bson.M{"$set": bson.M{"author": to}})
+	if err != nil {
+		return err
+	}
+	_, err = connection.Pending.UpdateMany(ctx, bson.M{"username": from}, bson.M{"$set": bson.M{"username": to}})
+	if err != nil {
+		return err
+	}
+	log.Printf("Renamed %s to %s, %d owned channels moved\n", from, to, owned.ModifiedCount)
+	return nil
+}
@@ -0,0 +1,67 @@
+package usersclient
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBreaker(t *testing.T) {
+	// Each step records a result or checks allow, in order
+	type step struct {
+		record  *bool
+		abandon bool
+		wait    time.Duration
+		allow   bool
+	}
+	ok, fail := true, false
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"stays closed below the threshold", []step{
+			{record: &fail}, {record: &fail}, {allow: true},
+		}},
+		{"opens at the threshold", []step{
+			{record: &fail}, {record: &fail}, {record: &fail}, {allow: false},
+		}},
+		{"a success resets the count", []step{
+			{record: &fail}, {record: &fail}, {record: &ok}, {record: &fail}, {record: &fail}, {allow: true},
+		}},
+		{"lets one trial through after the cooldown", []step{
+			{record: &fail}, {record: &fail}, {record: &fail},
+			{wait: 30 * time.Millisecond, allow: true}, {allow: false},
+		}},
+		{"a good trial closes it", []step{
+			{record: &fail}, {record: &fail}, {record: &fail},
+			{wait: 30 * time.Millisecond, allow: true}, {record: &ok}, {allow: true}, {allow: true},
+		}},
+		{"a failed trial opens it again", []step{
+			{record: &fail}, {record: &fail}, {record: &fail},
+			{wait: 30 * time.Millisecond, allow: true}, {record: &fail}, {allow: false},
+		}},
+		{"an abandoned trial lets the next one through", []step{
+			{record: &fail}, {record: &fail}, {record: &fail},
+			{wait: 30 * time.Millisecond, allow: true}, {abandon: true}, {allow: true}, {allow: false},
+		}},
+		{"an abandoned call does not count", []step{
+			{record: &fail}, {record: &fail}, {abandon: true}, {allow: true},
+		}},
+	}
+	for _, test := range tests {
+		b := &breaker{threshold: 3, cooldown: 20 * time.Millisecond}
+		for i, s := range test.steps {
+			if s.record != nil {
+				b.record(*s.record)
+				continue
+			}
+			if s.abandon {
+				b.abandon()
+				continue
+			}
+			time.Sleep(s.wait)
+			if got := b.allow(); got != s.allow {
+				t.Errorf("%s: step %d allow = %v, want %v", test.name, i, got, s.allow)
+			}
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package usersclient
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+)
+
+// Defaults used for zero CacheConfig fields
+const (
+	DefaultCacheSize     = 10000
+	DefaultProfileTTL    = 5 * time.Minute
+	DefaultCredentialTTL = 30 * time.Second
+)
+
+// CacheConfig sizes the caches of a CachedClient. A negative size or TTL
+// turns that cache off.
+type CacheConfig struct {
+	Size          int
+	ProfileTTL    time.Duration
+	CredentialTTL time.Duration
+}
+
+// CacheStats are the statistics of both caches
+type CacheStats struct {
+	Profiles    Stats `json:"profiles"`
+	Credentials Stats `json:"credentials"`
+}
+
+// CachedClient remembers user profiles and recently verified credentials.
+// Call Invalidate when webUsers reports a change to a user.
+type CachedClient struct {
+	*Client
+	profiles    *lru
+	credentials *lru
+}
+
+// NewCached wraps the client with caches
+func NewCached(client *Client, config CacheConfig) *CachedClient {
+	if config.Size == 0 {
+		config.Size = DefaultCacheSize
+	}
+	if config.ProfileTTL == 0 {
+		config.ProfileTTL = DefaultProfileTTL
+	}
+	if config.CredentialTTL == 0 {
+		config.CredentialTTL = DefaultCredentialTTL
+	}
+	return &CachedClient{
+		Client:      client,
+		profiles:    newLRU(config.Size, config.ProfileTTL),
+		credentials: newLRU(config.Size, config.CredentialTTL),
+	}
+}
+
+// credentialKey hashes the Authorization value so no password or token is
+// kept in memory
+func credentialKey(authorization string) string {
+	sum := sha256.Sum256([]byte(authorization))
+	return hex.EncodeToString(sum[:])
+}
+
+// Verify returns the cached identity of recently verified credentials.
+// Rejected credentials are never cached.
+func (cached *CachedClient) Verify(ctx context.Context, authorization string) (Identity, error) {
+	key := credentialKey(authorization)
+	if value, ok := cached.credentials.get(key); ok {
+		return value.(Identity), nil
+	}
+	generation := cached.credentials.current()
+	identity, err := cached.Client.Verify(ctx, authorization)
+	if err == nil {
+		cached.credentials.put(key, identity, generation)
+	}
+	return identity, err
+}
+
+// UserByUsername returns the cached profile or looks it up
+func (cached *CachedClient) UserByUsername(ctx context.Context, username string) (User, error) {
+	if value, ok := cached.profiles.get(username); ok {
+		return value.(User), nil
+	}
+	generation := cached.profiles.current()
+	user, err := cached.Client.UserByUsername(ctx, username)
+	if err == nil {
+		cached.profiles.put(username, user, generation)
+	}
+	return user, err
+}
+
+// Invalidate drops the cached profiles and credentials of the users
+func (cached *CachedClient) Invalidate(usernames ...string) int {
+	drop := map[string]bool{}
+	for _, username := range usernames {
+		if username != "" {
+			drop[username] = true
+		}
+	}
+	if len(drop) == 0 {
+		return 0
+	}
+	removed := cached.profiles.removeIf(func(key string, value interface{}) bool {
+		return drop[key]
+	})
+	removed += cached.credentials.removeIf(func(key string, value interface{}) bool {
+		return drop[value.(Identity).Username]
+	})
+	return removed
+}
+
+// Stats returns the hit, miss and eviction counters of both caches
+func (cached *CachedClient) Stats() CacheStats {
+	return CacheStats{
+		Profiles:    cached.profiles.snapshot(),
+		Credentials: cached.credentials.snapshot(),
+	}
+}
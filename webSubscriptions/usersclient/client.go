@@ -0,0 +1,274 @@
+// Package usersclient talks to the webUsers API. Calls take a context,
+// failures come back as typed errors, and temporary failures are retried
+// with jittered backoff behind a circuit breaker.
+package usersclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Defaults used for zero Config fields
+const (
+	DefaultBaseURL          = "http://server-users:8081"
+	DefaultTimeout          = 5 * time.Second
+	DefaultRetries          = 2
+	defaultBackoff          = 100 * time.Millisecond
+	defaultBreakerThreshold = 5
+	defaultBreakerCooldown  = 30 * time.Second
+)
+
+// Errors returned by the client. Other failures are a *StatusError or the
+// error of the transport.
+var (
+	// ErrNotFound is returned when webUsers has no such user
+	ErrNotFound = errors.New("user not found")
+	// ErrUnauthorized is returned for credentials webUsers rejects
+	ErrUnauthorized = errors.New("credentials are not correct")
+	// ErrCircuitOpen is returned without calling webUsers after too many
+	// failures in a row
+	ErrCircuitOpen = errors.New("webUsers is unavailable, circuit breaker is open")
+)
+
+// StatusError is an unexpected response status
+type StatusError struct {
+	Op     string
+	Status int
+}
+
+func (err *StatusError) Error() string {
+	return fmt.Sprintf("%s: webUsers responded %d %s", err.Op, err.Status, http.StatusText(err.Status))
+}
+
+// Temporary reports if trying again later may succeed
+func (err *StatusError) Temporary() bool {
+	return err.Status >= 500 || err.Status == http.StatusTooManyRequests
+}
+
+// Config sets up a Client, zero fields get the defaults
+type Config struct {
+	BaseURL    string
+	ServiceKey string
+	// Timeout of a single attempt
+	Timeout time.Duration
+	// Retries after the first attempt of a call, negative turns them off
+	Retries int
+	// Backoff before the first retry, doubled for every next one
+	Backoff time.Duration
+	// Failures in a row that open the breaker and how long it stays open
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+}
+
+// User is a user as webUsers shows it to services
+type User struct {
+	ID       string `json:"_id,omitempty"`
+	Username string `json:"username,omitempty"`
+	Name     string `json:"name,omitempty"`
+	Surname  string `json:"surname,omitempty"`
+	Email    string `json:"email,omitempty"`
+	Dob      string `json:"dob,omitempty"`
+}
+
+// Identity is who a set of credentials belongs to
+type Identity struct {
+	ID       string   `json:"id"`
+	Username string   `json:"username"`
+	Roles    []string `json:"roles"`
+}
+
+// Client calls webUsers, it is safe for concurrent use
+type Client struct {
+	baseURL    string
+	serviceKey string
+	http       *http.Client
+	retries    int
+	backoff    time.Duration
+	breaker    *breaker
+}
+
+// New returns a client for the config
+func New(config Config) *Client {
+	if config.BaseURL == "" {
+		config.BaseURL = DefaultBaseURL
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultTimeout
+	}
+	if config.Retries < 0 {
+		config.Retries = 0
+	} else if config.Retries == 0 {
+		config.Retries = DefaultRetries
+	}
+	if config.Backoff <= 0 {
+		config.Backoff = defaultBackoff
+	}
+	if config.BreakerThreshold <= 0 {
+		config.BreakerThreshold = defaultBreakerThreshold
+	}
+	if config.BreakerCooldown <= 0 {
+		config.BreakerCooldown = defaultBreakerCooldown
+	}
+	return &Client{
+		baseURL:    strings.TrimRight(config.BaseURL, "/"),
+		serviceKey: config.ServiceKey,
+		http:       &http.Client{Timeout: config.Timeout},
+		retries:    config.Retries,
+		backoff:    config.Backoff,
+		breaker:    &breaker{threshold: config.BreakerThreshold, cooldown: config.BreakerCooldown},
+	}
+}
+
+// Verify returns who the Authorization header value belongs to
+func (client *Client) Verify(ctx context.Context, authorization string) (Identity, error) {
+	var identity Identity
+	header := http.Header{"Authorization": {authorization}}
+	err := client.do(ctx, "POST", "/verifyUser", header, func(response *http.Response) error {
+		switch response.StatusCode {
+		case http.StatusOK:
+		case http.StatusUnauthorized:
+			return ErrUnauthorized
+		default:
+			return &StatusError{Op: "verify", Status: response.StatusCode}
+		}
+		if err := json.NewDecoder(response.Body).Decode(&identity); err != nil {
+			return err
+		}
+		if identity.Username == "" {
+			return errors.New("verify: response has no username")
+		}
+		return nil
+	})
+	return identity, err
+}
+
+// UserByUsername looks the user up including the email, which webUsers
+// only shows with the service key
+func (client *Client) UserByUsername(ctx context.Context, username string) (User, error) {
+	var user User
+	header := http.Header{}
+	if client.serviceKey != "" {
+		header.Set("X-Service-Key", client.serviceKey)
+	}
+	path := "/users?username=" + url.QueryEscape(username)
+	err := client.do(ctx, "GET", path, header, func(response *http.Response) error {
+		if response.StatusCode != http.StatusOK {
+			return &StatusError{Op: "user " + username, Status: response.StatusCode}
+		}
+		// Users are returned in a page, the username is unique
+		var page struct {
+			Data []User `json:"data"`
+		}
+		if err := json.NewDecoder(response.Body).Decode(&page); err != nil {
+			return err
+		}
+		for _, found := range page.Data {
+			if found.Username == username {
+				user = found
+				return nil
+			}
+		}
+		return ErrNotFound
+	})
+	return user, err
+}
+
+// do sends the request until it succeeds, fails for good or runs out of
+// retries. read turns a response into the call's result.
+func (client *Client) do(ctx context.Context, method string, path string, header http.Header, read func(*http.Response) error) error {
+	var err error
+	for attempt := 0; attempt <= client.retries; attempt++ {
+		if attempt > 0 {
+			if waitErr := sleep(ctx, jitter(client.backoff<<uint(attempt-1))); waitErr != nil {
+				return err
+			}
+		}
+		if !client.breaker.allow() {
+			return ErrCircuitOpen
+		}
+		err = client.attempt(ctx, method, path, header, read)
+		if ctx.Err() != nil {
+			// The caller gave up, that says nothing about webUsers
+			client.breaker.abandon()
+			return err
+		}
+		temporary := isTemporary(ctx, err)
+		client.breaker.record(!temporary)
+		if !temporary {
+			return err
+		}
+	}
+	return err
+}
+
+// attempt sends the request once
+func (client *Client) attempt(ctx context.Context, method string, path string, header http.Header, read func(*http.Response) error) error {
+	request, err := http.NewRequest(method, client.baseURL+path, nil)
+	if err != nil {
+		return err
+	}
+	request = request.WithContext(ctx)
+	for key, values := range header {
+		request.Header[key] = values
+	}
+	if id := RequestID(ctx); id != "" {
+		request.Header.Set(RequestIDHeader, id)
+	}
+	response, err := client.http.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	// Drain the body so the connection can be reused
+	defer io.Copy(ioutil.Discard, io.LimitReader(response.Body, 64<<10))
+	return read(response)
+}
+
+// isTemporary reports if the error is worth a retry. Network failures and
+// 5xx responses are, answers like not found and a canceled context are not.
+func isTemporary(ctx context.Context, err error) bool {
+	if err == nil || ctx.Err() != nil {
+		return false
+	}
+	if err == ErrNotFound || err == ErrUnauthorized {
+		return false
+	}
+	var status *StatusError
+	if errors.As(err, &status) {
+		return status.Temporary()
+	}
+	var syntax *json.SyntaxError
+	if errors.As(err, &syntax) {
+		return false
+	}
+	return true
+}
+
+// jitter picks a random wait up to d so clients do not retry in step
+func jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(d))) + 1
+}
+
+// sleep waits for d or until the context ends
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,40 @@
+package usersclient
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCanceledCallLeavesBreakerOpen(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	client := New(Config{BaseURL: server.URL, Retries: -1, BreakerThreshold: 2, BreakerCooldown: 20 * time.Millisecond})
+
+	for i := 0; i < 2; i++ {
+		if _, err := client.Verify(context.Background(), "Basic x"); err == nil {
+			t.Fatal("Verify succeeded against a failing server")
+		}
+	}
+	if _, err := client.Verify(context.Background(), "Basic x"); err != ErrCircuitOpen {
+		t.Fatalf("Verify after %d failures: %v, want ErrCircuitOpen", 2, err)
+	}
+
+	// The trial after the cooldown is canceled by its caller
+	time.Sleep(30 * time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := client.Verify(ctx, "Basic x"); err == nil || err == ErrCircuitOpen {
+		t.Fatalf("canceled Verify: %v, want the context error", err)
+	}
+	if client.breaker.failures < 2 {
+		t.Errorf("canceled trial closed the breaker, %d failures left", client.breaker.failures)
+	}
+	if !client.breaker.allow() {
+		t.Error("canceled trial kept the next trial from being made")
+	}
+}
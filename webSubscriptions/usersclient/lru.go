@@ -0,0 +1,145 @@
+package usersclient
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// Stats counts how a cache was used
+type Stats struct {
+	Size          int    `json:"size"`
+	Capacity      int    `json:"capacity"`
+	Hits          uint64 `json:"hits"`
+	Misses        uint64 `json:"misses"`
+	Evictions     uint64 `json:"evictions"`
+	Expirations   uint64 `json:"expirations"`
+	Invalidations uint64 `json:"invalidations"`
+}
+
+// lru keeps at most capacity entries for ttl each, the least recently used
+// entry makes room for new ones
+type lru struct {
+	capacity int
+	ttl      time.Duration
+
+	mu      sync.Mutex
+	order   *list.List
+	entries map[string]*list.Element
+	stats   Stats
+	// Counts invalidations, a value looked up while one happened may be
+	// stale and is not stored
+	generation uint64
+}
+
+type lruEntry struct {
+	key     string
+	value   interface{}
+	expires time.Time
+}
+
+// newLRU returns a cache, a capacity or ttl below one keeps nothing
+func newLRU(capacity int, ttl time.Duration) *lru {
+	if capacity < 0 || ttl <= 0 {
+		capacity = 0
+	}
+	return &lru{
+		capacity: capacity,
+		ttl:      ttl,
+		order:    list.New(),
+		entries:  map[string]*list.Element{},
+	}
+}
+
+// enabled reports if the cache keeps anything at all
+func (cache *lru) enabled() bool {
+	return cache.capacity > 0 && cache.ttl > 0
+}
+
+// get returns the value if it is cached and not expired
+func (cache *lru) get(key string) (interface{}, bool) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	element, ok := cache.entries[key]
+	if !ok {
+		cache.stats.Misses++
+		return nil, false
+	}
+	entry := element.Value.(*lruEntry)
+	if time.Now().After(entry.expires) {
+		cache.removeElement(element)
+		cache.stats.Expirations++
+		cache.stats.Misses++
+		return nil, false
+	}
+	cache.order.MoveToFront(element)
+	cache.stats.Hits++
+	return entry.value, true
+}
+
+// current returns the generation to pass to put after a lookup
+func (cache *lru) current() uint64 {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	return cache.generation
+}
+
+// put stores the value for the cache's ttl, unless entries were
+// invalidated since the generation was taken
+func (cache *lru) put(key string, value interface{}, generation uint64) {
+	if !cache.enabled() {
+		return
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if generation != cache.generation {
+		return
+	}
+	expires := time.Now().Add(cache.ttl)
+	if element, ok := cache.entries[key]; ok {
+		entry := element.Value.(*lruEntry)
+		entry.value, entry.expires = value, expires
+		cache.order.MoveToFront(element)
+		return
+	}
+	cache.entries[key] = cache.order.PushFront(&lruEntry{key: key, value: value, expires: expires})
+	for cache.order.Len() > cache.capacity {
+		cache.removeElement(cache.order.Back())
+		cache.stats.Evictions++
+	}
+}
+
+// removeIf drops every entry the function matches and returns how many
+func (cache *lru) removeIf(match func(key string, value interface{}) bool) int {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	cache.generation++
+	removed := 0
+	for element := cache.order.Front(); element != nil; {
+		next := element.Next()
+		entry := element.Value.(*lruEntry)
+		if match(entry.key, entry.value) {
+			cache.removeElement(element)
+			removed++
+		}
+		element = next
+	}
+	cache.stats.Invalidations += uint64(removed)
+	return removed
+}
+
+// removeElement unlinks the entry, cache.mu must be held
+func (cache *lru) removeElement(element *list.Element) {
+	cache.order.Remove(element)
+	delete(cache.entries, element.Value.(*lruEntry).key)
+}
+
+// snapshot returns the current counters
+func (cache *lru) snapshot() Stats {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	stats := cache.stats
+	stats.Size = cache.order.Len()
+	stats.Capacity = cache.capacity
+	return stats
+}
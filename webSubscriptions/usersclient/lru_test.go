@@ -0,0 +1,94 @@
+package usersclient
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLRUEvictsLeastRecentlyUsed(t *testing.T) {
+	cache := newLRU(2, time.Minute)
+	cache.put("a", 1, cache.current())
+	cache.put("b", 2, cache.current())
+	// Reading a makes b the least recently used
+	if _, ok := cache.get("a"); !ok {
+		t.Fatal("a is missing")
+	}
+	cache.put("c", 3, cache.current())
+
+	tests := []struct {
+		key  string
+		want bool
+	}{
+		{"a", true},
+		{"b", false},
+		{"c", true},
+	}
+	for _, test := range tests {
+		if _, ok := cache.get(test.key); ok != test.want {
+			t.Errorf("get(%s) found = %v, want %v", test.key, ok, test.want)
+		}
+	}
+	stats := cache.snapshot()
+	if stats.Size != 2 || stats.Evictions != 1 {
+		t.Errorf("size %d evictions %d, want 2 and 1", stats.Size, stats.Evictions)
+	}
+}
+
+func TestLRUExpires(t *testing.T) {
+	cache := newLRU(10, 20*time.Millisecond)
+	cache.put("a", 1, cache.current())
+	time.Sleep(30 * time.Millisecond)
+	if _, ok := cache.get("a"); ok {
+		t.Error("expired entry was returned")
+	}
+	if stats := cache.snapshot(); stats.Expirations != 1 || stats.Size != 0 {
+		t.Errorf("expirations %d size %d, want 1 and 0", stats.Expirations, stats.Size)
+	}
+}
+
+func TestLRUDisabled(t *testing.T) {
+	tests := []struct {
+		capacity int
+		ttl      time.Duration
+	}{
+		{0, time.Minute},
+		{-1, time.Minute},
+		{10, 0},
+		{10, -time.Second},
+	}
+	for _, test := range tests {
+		cache := newLRU(test.capacity, test.ttl)
+		cache.put("a", 1, cache.current())
+		if _, ok := cache.get("a"); ok {
+			t.Errorf("newLRU(%d, %v) kept an entry", test.capacity, test.ttl)
+		}
+	}
+}
+
+func TestLRUSkipsPutAfterInvalidation(t *testing.T) {
+	cache := newLRU(10, time.Minute)
+	// A lookup started, then the user changed
+	generation := cache.current()
+	cache.removeIf(func(key string, value interface{}) bool { return key == "a" })
+	cache.put("a", "stale", generation)
+	if _, ok := cache.get("a"); ok {
+		t.Error("value looked up before the invalidation was stored")
+	}
+}
+
+func TestLRURemoveIf(t *testing.T) {
+	cache := newLRU(10, time.Minute)
+	for _, key := range []string{"ann", "bob", "anna"} {
+		cache.put(key, key, cache.current())
+	}
+	removed := cache.removeIf(func(key string, value interface{}) bool { return value.(string)[:2] == "an" })
+	if removed != 2 {
+		t.Errorf("removed %d, want 2", removed)
+	}
+	if _, ok := cache.get("bob"); !ok {
+		t.Error("bob was removed too")
+	}
+	if stats := cache.snapshot(); stats.Invalidations != 2 {
+		t.Errorf("invalidations %d, want 2", stats.Invalidations)
+	}
+}
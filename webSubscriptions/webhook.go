@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// How long the old secret keeps signing deliveries after a rotation
+const secretRotationGrace = 24 * time.Hour
+
+// Headers sent with every webhook delivery
+const (
+	webhookIDHeader        = "X-Webhook-Id"
+	webhookTimestampHeader = "X-Webhook-Timestamp"
+	webhookSignatureHeader = "X-Webhook-Signature"
+)
+
+// Returned when the subscriber removed the webhook while a delivery was queued
+var errWebhookRemoved = errors.New("webhook was removed by the subscriber")
+
+// Webhook is a URL a subscriber receives messages on. The secret is only
+// shown when it is created or rotated.
+type Webhook struct {
+	URL               string    `json:"url" bson:"url"`
+	Secret            string    `json:"-" bson:"secret"`
+	PreviousSecret    string    `json:"-" bson:"previousSecret,omitempty"`
+	PreviousExpiresAt time.Time `json:"-" bson:"previousExpiresAt,omitempty"`
+	CreatedAt         time.Time `json:"createdAt" bson:"createdAt"`
+}
+
+// WebhookCall is the request a webhook job makes
+type WebhookCall struct {
+	URL     string `json:"url" bson:"url"`
+	Payload string `json:"payload" bson:"payload"`
+}
+
+// webhookInput is the body of PUT .../webhook
+type webhookInput struct {
+	URL string `json:"url"`
+	// false stops emails so the subscriber only gets the webhook
+	Email *bool `json:"email"`
+}
+
+// webhookSecretResponse shows a new secret once
+type webhookSecretResponse struct {
+	URL               string     `json:"url"`
+	Secret            string     `json:"secret"`
+	PreviousExpiresAt *time.Time `json:"previousExpiresAt,omitempty"`
+}
+
+// webhookError is a webhook that answered with a status other than 2xx
+type webhookError struct {
+	Status int
+}
+
+func (err *webhookError) Error() string {
+	return "webhook responded with " + strconv.Itoa(err.Status) + " " + http.StatusText(err.Status)
+}
+
+// WebhookSender posts signed payloads
+type WebhookSender struct {
+	Client *http.Client
+}
+
+// newWebhookSecret returns a random secret to sign payloads with
+func newWebhookSecret() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return "whsec_" + hex.EncodeToString(secret), nil
+}
+
+// webhookAllowPrivate lets webhooks reach loopback, private and link-local
+// addresses. main sets it from webhooks.allowPrivate.
+var webhookAllowPrivate bool
+
+// Address ranges webhooks may not reach unless webhookAllowPrivate is set
+var webhookBlockedNets = parseCIDRs(
+	"0.0.0.0/8",      // this network
+	"10.0.0.0/8",     // private
+	"100.64.0.0/10",  // carrier-grade NAT
+	"127.0.0.0/8",    // loopback
+	"169.254.0.0/16", // link-local, cloud metadata
+	"172.16.0.0/12",  // private
+	"192.168.0.0/16", // private
+	"::/128",         // unspecified
+	"::1/128",        // loopback
+	"fc00::/7",       // unique local
+	"fe80::/10",      // link-local
+)
+
+var errWebhookAddress = errors.New("webhooks can not reach loopback, private or link-local addresses")
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, nets[i], _ = net.ParseCIDR(cidr)
+	}
+	return nets
+}
+
+// blockedWebhookIP reports if webhooks may not connect to the address
+func blockedWebhookIP(ip net.IP) bool {
+	if webhookAllowPrivate {
+		return false
+	}
+	if ip.IsMulticast() || ip.IsUnspecified() {
+		return true
+	}
+	for _, blocked := range webhookBlockedNets {
+		if blocked.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// webhookDialControl runs after the host name is resolved, so names that
+// point at internal addresses, now or after a DNS change, are refused too
+func webhookDialControl(network string, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || blockedWebhookIP(ip) {
+		return errWebhookAddress
+	}
+	return nil
+}
+
+// newWebhookClient calls webhooks without proxies or redirects and only
+// connects to public addresses
+func newWebhookClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{Timeout: timeout, Control: webhookDialControl}
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   timeout,
+			ResponseHeaderTimeout: timeout,
+			MaxIdleConnsPerHost:   2,
+			IdleConnTimeout:       90 * time.Second,
+		},
+		// A redirect is a failed call, following it could reach any address
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// validateWebhookURL accepts absolute http and https URLs that do not name
+// a loopback, private or link-local address. Host names are checked again
+// on every call once they are resolved.
+func validateWebhookURL(raw string) error {
+	parsed, err := url.Parse(raw)
+	if err != nil || parsed.Host == "" || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+		return errors.New("url must be an absolute http or https URL")
+	}
+	host := strings.TrimSuffix(strings.ToLower(parsed.Hostname()), ".")
+	if ip := net.ParseIP(host); ip != nil && blockedWebhookIP(ip) {
+		return errWebhookAddress
+	}
+	if !webhookAllowPrivate && (host == "localhost" || strings.HasSuffix(host, ".localhost")) {
+		return errWebhookAddress
+	}
+	return nil
+}
+
+// secrets returns the secrets deliveries are signed with right now
+func (hook Webhook) secrets(now time.Time) []string {
+	secrets := []string{hook.Secret}
+	if hook.PreviousSecret != "" && now.Before(hook.PreviousExpiresAt) {
+		secrets = append(secrets, hook.PreviousSecret)
+	}
+	return secrets
+}
+
+// signPayload computes the signature of a payload sent at the timestamp.
+// Receivers compute HMAC-SHA256 over "<timestamp>.<body>" with their
+// secret and compare it to any v1= entry of the signature header.
+func signPayload(secret string, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// messagePayload is the JSON a webhook receives for a channel message
+func messagePayload(id primitive.ObjectID, channel Subscription, message Message, subscriber ShortUser) (string, error) {
+	payload, err := json.Marshal(map[string]interface{}{
+		"id":   id.Hex(),
+		"type": "message.created",
+		"channel": map[string]string{
+			"_id":  channel.ID.Hex(),
+			"name": channel.Name,
+		},
+		"message":    message,
+		"subscriber": subscriber.Username,
+	})
+	return string(payload), err
+}
+
+// Send posts the payload with a fresh timestamp, signed with every secret
+func (sender *WebhookSender) Send(ctx context.Context, id primitive.ObjectID, call WebhookCall, secrets []string) error {
+	payload := []byte(call.Payload)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	var signatures []string
+	for _, secret := range secrets {
+		signatures = append(signatures, "v1="+signPayload(secret, timestamp, payload))
+	}
+
+	request, err := http.NewRequest("POST", call.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	request = request.WithContext(ctx)
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "webSubscriptions-webhook")
+	request.Header.Set(webhookIDHeader, id.Hex())
+	request.Header.Set(webhookTimestampHeader, timestamp)
+	request.Header.Set(webhookSignatureHeader, strings.Join(signatures, ","))
+	response, err := sender.Client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(response.Body, 64<<10))
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return &webhookError{Status: response.StatusCode}
+	}
+	return nil
+}
+
+// subscriberWebhook looks up the current webhook of a channel subscriber
+func subscriberWebhook(ctx context.Context, subscriptions *mongo.Collection, channelID primitive.ObjectID, username string) (Webhook, error) {
+	// Only the subscriber's own entry is read, not the whole channel
+	var channel Subscription
+	err := subscriptions.FindOne(ctx, bson.M{"_id": channelID},
+		options.FindOne().SetProjection(bson.M{"subscribers": bson.M{"$elemMatch": bson.M{"username": username}}}),
+	).Decode(&channel)
+	if err == mongo.ErrNoDocuments {
+		return Webhook{}, errWebhookRemoved
+	}
+	if err != nil {
+		return Webhook{}, err
+	}
+	for _, subs := range channel.Subscribers {
+		if subs.Username == username && subs.Webhook != nil {
+			return *subs.Webhook, nil
+		}
+	}
+	return Webhook{}, errWebhookRemoved
+}
+
+// webhookTarget authenticates the request and loads the channel. Only the
+// subscriber and admins may manage a subscriber's webhook.
+func (connection Connection) webhookTarget(w http.ResponseWriter, req *http.Request) (Subscription, string, bool) {
+	caller, ok := authenticate(w, req)
+	if !ok {
+		return Subscription{}, "", false
+	}
+	username := mux.Vars(req)["username"]
+	if !caller.canManageSubscriber(username) {
+		permissionDenied(w, req, caller, "manage webhooks of "+username)
+		return Subscription{}, "", false
+	}
+	channel, ok := connection.channelFromPath(w, req)
+	return channel, username, ok
+}
+
+// Handlers
+func (connection Connection) putWebhook(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	channel, username, ok := connection.webhookTarget(w, req)
+	if !ok {
+		return
+	}
+	var input webhookInput
+	err := json.NewDecoder(req.Body).Decode(&input)
+	if err != nil {
+		writeProblem(w, req, http.StatusBadRequest, "invalid json body: "+err.Error())
+		return
+	}
+	if err := validateWebhookURL(input.URL); err != nil {
+		writeProblemErrors(w, req, http.StatusUnprocessableEntity, "webhook is not valid", map[string]string{"url": err.Error()})
+		return
+	}
+	if channel.Archived {
+		writeProblem(w, req, http.StatusGone, "channel "+channel.Name+" is archived")
+		return
+	}
+	// Webhooks only go to confirmed subscribers, subscribing goes through
+	// the opt-in email first
+	if !channel.hasSubscriber(username) {
+		writeProblem(w, req, http.StatusNotFound, username+" is not subscribed to "+channel.Name+", subscribe first")
+		return
+	}
+	secret, err := newWebhookSecret()
+	if err != nil {
+		serverError(w, req, err)
+		return
+	}
+	hook := Webhook{URL: input.URL, Secret: secret, CreatedAt: time.Now()}
+
+	update := bson.M{"$set": bson.M{"subscribers.$.webhook": hook}}
+	if input.Email != nil && !*input.Email {
+		update["$unset"] = bson.M{"subscribers.$.email": ""}
+	}
+	result, err := connection.Subscriptions.UpdateOne(context.TODO(),
+		bson.M{"_id": channel.ID, "archived": bson.M{"$ne": true}, "subscribers.username": username}, update)
+	if err != nil {
+		dbError(w, req, err, "channel "+channel.ID.Hex())
+		return
+	}
+	if result.MatchedCount == 0 {
+		// Unsubscribed or archived since the channel was read
+		writeProblem(w, req, http.StatusConflict, "subscriber "+username+" changed at the same time, try again")
+		return
+	}
+	log.Printf("Webhook for %s on %s set to %s\n", username, channel.Name, hook.URL)
+	json.NewEncoder(w).Encode(webhookSecretResponse{URL: hook.URL, Secret: hook.Secret})
+}
+
+func (connection Connection) deleteWebhook(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	channel, username, ok := connection.webhookTarget(w, req)
+	if !ok {
+		return
+	}
+	result, err := connection.Subscriptions.UpdateOne(context.TODO(),
+		bson.M{"_id": channel.ID, "subscribers": bson.M{"$elemMatch": bson.M{"username": username, "webhook": bson.M{"$exists": true}}}},
+		bson.M{"$unset": bson.M{"subscribers.$.webhook": ""}})
+	if err != nil {
+		dbError(w, req, err, "channel "+channel.ID.Hex())
+		return
+	}
+	if result.MatchedCount == 0 {
+		writeProblem(w, req, http.StatusNotFound, "subscriber "+username+" has no webhook on "+channel.Name)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// rotateWebhookSecret issues a new secret. The old one keeps signing
+// deliveries for secretRotationGrace so receivers can switch over.
+func (connection Connection) rotateWebhookSecret(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	channel, username, ok := connection.webhookTarget(w, req)
+	if !ok {
+		return
+	}
+	var hook *Webhook
+	for _, subs := range channel.Subscribers {
+		if subs.Username == username && subs.Webhook != nil {
+			hook = subs.Webhook
+		}
+	}
+	if hook == nil {
+		writeProblem(w, req, http.StatusNotFound, "subscriber "+username+" has no webhook on "+channel.Name)
+		return
+	}
+	secret, err := newWebhookSecret()
+	if err != nil {
+		serverError(w, req, err)
+		return
+	}
+	expires := time.Now().Add(secretRotationGrace)
+
+	// Only rotate if nobody else rotated in between
+	result, err := connection.Subscriptions.UpdateOne(context.TODO(),
+		bson.M{"_id": channel.ID, "subscribers": bson.M{"$elemMatch": bson.M{"username": username, "webhook.secret": hook.Secret}}},
+		bson.M{"$set": bson.M{
+			"subscribers.$.webhook.secret":            secret,
+			"subscribers.$.webhook.previousSecret":    hook.Secret,
+			"subscribers.$.webhook.previousExpiresAt": expires,
+		}})
+	if err != nil {
+		dbError(w, req, err, "channel "+channel.ID.Hex())
+		return
+	}
+	if result.MatchedCount == 0 {
+		writeProblem(w, req, http.StatusConflict, "webhook of "+username+" changed at the same time, try again")
+		return
+	}
+	log.Printf("Webhook secret for %s on %s rotated\n", username, channel.Name)
+	json.NewEncoder(w).Encode(webhookSecretResponse{URL: hook.URL, Secret: secret, PreviousExpiresAt: &expires})
+}
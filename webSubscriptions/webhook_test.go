@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestValidateWebhookURL(t *testing.T) {
+	tests := []struct {
+		url string
+		ok  bool
+	}{
+		{"https://example.com/hook", true},
+		{"http://203.0.113.10:8080/hook", true},
+		{"ftp://example.com/hook", false},
+		{"/relative/hook", false},
+		{"http://localhost:9000/hook", false},
+		{"http://api.localhost/hook", false},
+		{"http://127.0.0.1/hook", false},
+		{"http://10.1.2.3/hook", false},
+		{"http://172.20.0.5/hook", false},
+		{"http://192.168.1.1/hook", false},
+		{"http://169.254.169.254/latest/meta-data", false},
+		{"http://[::1]/hook", false},
+		{"http://[fd00::1]/hook", false},
+		{"http://[::ffff:127.0.0.1]/hook", false},
+		{"http://0.0.0.0/hook", false},
+	}
+	for _, test := range tests {
+		err := validateWebhookURL(test.url)
+		if (err == nil) != test.ok {
+			t.Errorf("validateWebhookURL(%s) = %v, want ok %v", test.url, err, test.ok)
+		}
+	}
+}
+
+func TestWebhookClientRefusesLoopback(t *testing.T) {
+	called := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		called = true
+	}))
+	defer server.Close()
+
+	sender := &WebhookSender{Client: newWebhookClient(time.Second)}
+	err := sender.Send(context.Background(), primitive.NewObjectID(), WebhookCall{URL: server.URL, Payload: "{}"}, []string{"secret"})
+	if !errors.Is(err, errWebhookAddress) {
+		t.Errorf("Send to %s = %v, want %v", server.URL, err, errWebhookAddress)
+	}
+	if called {
+		t.Error("the loopback server was called")
+	}
+}
+
+func TestWebhookClientDoesNotFollowRedirects(t *testing.T) {
+	webhookAllowPrivate = true
+	defer func() { webhookAllowPrivate = false }()
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		t.Error("the redirect was followed")
+	}))
+	defer target.Close()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.Redirect(w, req, target.URL, http.StatusTemporaryRedirect)
+	}))
+	defer server.Close()
+
+	sender := &WebhookSender{Client: newWebhookClient(time.Second)}
+	err := sender.Send(context.Background(), primitive.NewObjectID(), WebhookCall{URL: server.URL, Payload: "{}"}, []string{"secret"})
+	var hookErr *webhookError
+	if !errors.As(err, &hookErr) || hookErr.Status != http.StatusTemporaryRedirect {
+		t.Errorf("Send = %v, want the redirect as a failed call", err)
+	}
+}
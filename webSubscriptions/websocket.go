@@ -0,0 +1,434 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/FilipVdZel/golang-mods/usersclient"
+	"github.com/gorilla/websocket"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Settings of WebSocket sessions
+const (
+	wsWriteWait       = 10 * time.Second
+	wsPongWait        = 60 * time.Second
+	wsPingPeriod      = wsPongWait * 9 / 10
+	wsMaxFrameSize    = 64 << 10
+	wsSendBuffer      = 256
+	wsMaxChannels     = 50
+	wsCloseSlowReason = "client is too slow, reconnect and catch up with GET /subscriptions/{id}/messages"
+	// Credentials are checked again this often and when the user changes
+	wsReauthInterval     = time.Minute
+	wsCloseRevokedReason = "credentials are no longer valid, reconnect to sign in again"
+)
+
+// wsFrame is a JSON frame in either direction.
+//
+// From the client:
+//
+//	{"type":"subscribe","channel":"<id>"}
+//	{"type":"unsubscribe","channel":"<id>"}
+//	{"type":"publish","channel":"<id>","text":"hello","ref":"1"}
+//
+// From the server: subscribed, unsubscribed, message, presence, ack and
+// error. ack and error repeat the ref of the frame they answer.
+type wsFrame struct {
+	Type        string   `json:"type"`
+	Channel     string   `json:"channel,omitempty"`
+	Text        string   `json:"text,omitempty"`
+	Ref         string   `json:"ref,omitempty"`
+	Message     *Message `json:"message,omitempty"`
+	Listeners   *int     `json:"listeners,omitempty"`
+	Subscribers *int     `json:"subscribers,omitempty"`
+	Queued      *int     `json:"queued,omitempty"`
+	Error       string   `json:"error,omitempty"`
+}
+
+// wsSession is one authenticated WebSocket connection following any
+// number of channels
+type wsSession struct {
+	connection    Connection
+	conn          *websocket.Conn
+	authorization string
+	send          chan wsFrame
+	done          chan struct{}
+	closeOnce     sync.Once
+	// Signals reauthLoop to check the credentials now
+	recheck chan struct{}
+
+	mu       sync.Mutex
+	caller   Caller
+	channels map[primitive.ObjectID]*hubClient
+}
+
+// wsSessionSet is every open session of this process so user changes can
+// reach them
+type wsSessionSet struct {
+	mu       sync.Mutex
+	sessions map[*wsSession]bool
+}
+
+// wsSessions are the open sessions, user events ask them to check their
+// credentials again
+var wsSessions = &wsSessionSet{sessions: map[*wsSession]bool{}}
+
+func (set *wsSessionSet) add(session *wsSession) {
+	set.mu.Lock()
+	set.sessions[session] = true
+	set.mu.Unlock()
+}
+
+func (set *wsSessionSet) remove(session *wsSession) {
+	set.mu.Lock()
+	delete(set.sessions, session)
+	set.mu.Unlock()
+}
+
+// recheck asks the sessions of the users to verify their credentials
+func (set *wsSessionSet) recheck(usernames ...string) {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	for session := range set.sessions {
+		username := session.currentCaller().Username
+		for _, changed := range usernames {
+			if changed != "" && changed == username {
+				select {
+				case session.recheck <- struct{}{}:
+				default:
+				}
+				break
+			}
+		}
+	}
+}
+
+// wsAllowedOrigins are the other origins that may open websockets, * allows
+// all of them. main sets them from websocket.allowedOrigins.
+var wsAllowedOrigins []string
+
+// wsUpgrader accepts same origin requests and wsAllowedOrigins
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  4096,
+	WriteBufferSize: 4096,
+	CheckOrigin:     checkOrigin,
+}
+
+func checkOrigin(req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	parsed, err := url.Parse(origin)
+	if err == nil && strings.EqualFold(parsed.Host, req.Host) {
+		return true
+	}
+	for _, allowed := range wsAllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// queue hands a frame to the writer. A session whose buffer is full is
+// closed instead of letting it hold up the hub.
+func (session *wsSession) queue(frame wsFrame) {
+	select {
+	case session.send <- frame:
+	case <-session.done:
+	default:
+		session.close(websocket.CloseTryAgainLater, wsCloseSlowReason)
+	}
+}
+
+// close ends the session once with the close code and reason
+func (session *wsSession) close(code int, reason string) {
+	session.closeOnce.Do(func() {
+		close(session.done)
+		message := websocket.FormatCloseMessage(code, reason)
+		session.conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(wsWriteWait))
+		session.conn.Close()
+	})
+}
+
+// currentCaller is the user as of the last credential check
+func (session *wsSession) currentCaller() Caller {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	return session.caller
+}
+
+// reauthLoop verifies the session's credentials every wsReauthInterval
+// and when asked to, so revoked tokens, changed passwords and removed
+// roles end or update the session
+func (session *wsSession) reauthLoop() {
+	ticker := time.NewTicker(wsReauthInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-session.done:
+			return
+		case <-ticker.C:
+		case <-session.recheck:
+		}
+		session.reauthenticate()
+	}
+}
+
+// reauthenticate closes the session when webUsers rejects its credentials.
+// When webUsers can not be reached the session keeps its last identity.
+func (session *wsSession) reauthenticate() {
+	identity, err := usersAPI.Verify(context.Background(), session.authorization)
+	if err == usersclient.ErrUnauthorized {
+		log.Printf("Closing websocket session of %s, its credentials are no longer valid\n", session.currentCaller().Username)
+		session.close(websocket.ClosePolicyViolation, wsCloseRevokedReason)
+		return
+	}
+	if err != nil {
+		log.Printf("Checking websocket credentials failed: %v\n", err)
+		return
+	}
+	session.mu.Lock()
+	session.caller = Caller{Username: identity.Username, Roles: identity.Roles}
+	session.mu.Unlock()
+}
+
+// fail answers a client frame with an error
+func (session *wsSession) fail(request wsFrame, msg string) {
+	session.queue(wsFrame{Type: "error", Channel: request.Channel, Ref: request.Ref, Error: msg})
+}
+
+// writeLoop writes queued frames and pings the client
+func (session *wsSession) writeLoop() {
+	ping := time.NewTicker(wsPingPeriod)
+	defer ping.Stop()
+	for {
+		select {
+		case <-session.done:
+			return
+		case frame := <-session.send:
+			session.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := session.conn.WriteJSON(frame); err != nil {
+				session.close(websocket.CloseGoingAway, "")
+				return
+			}
+		case <-ping.C:
+			if err := session.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait)); err != nil {
+				session.close(websocket.CloseGoingAway, "")
+				return
+			}
+		}
+	}
+}
+
+// readLoop handles client frames until the connection closes. The read
+// deadline moves forward with every pong.
+func (session *wsSession) readLoop() {
+	session.conn.SetReadLimit(wsMaxFrameSize)
+	session.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	session.conn.SetPongHandler(func(string) error {
+		return session.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+	for {
+		_, data, err := session.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		session.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		var frame wsFrame
+		if err := json.Unmarshal(data, &frame); err != nil {
+			session.fail(frame, "frames must be JSON objects")
+			continue
+		}
+		switch frame.Type {
+		case "subscribe":
+			session.subscribe(frame)
+		case "unsubscribe":
+			session.unsubscribe(frame)
+		case "publish":
+			session.publish(frame)
+		default:
+			session.fail(frame, "unknown frame type '"+frame.Type+"', use subscribe, unsubscribe or publish")
+		}
+	}
+}
+
+// channel loads the channel a frame refers to
+func (session *wsSession) channel(frame wsFrame) (Subscription, bool) {
+	var channel Subscription
+	id, err := primitive.ObjectIDFromHex(frame.Channel)
+	if err != nil {
+		session.fail(frame, "'"+frame.Channel+"' is not a valid id, expected 24 hex characters")
+		return channel, false
+	}
+	err = session.connection.Subscriptions.FindOne(context.TODO(), bson.M{"_id": id}).Decode(&channel)
+	if err != nil {
+		session.fail(frame, "channel "+frame.Channel+" not found")
+		return channel, false
+	}
+	return channel, true
+}
+
+func (session *wsSession) subscribe(frame wsFrame) {
+	channel, ok := session.channel(frame)
+	if !ok {
+		return
+	}
+	session.mu.Lock()
+	if session.channels[channel.ID] != nil {
+		session.mu.Unlock()
+		session.queue(wsFrame{Type: "subscribed", Channel: frame.Channel, Ref: frame.Ref})
+		return
+	}
+	if len(session.channels) >= wsMaxChannels {
+		session.mu.Unlock()
+		session.fail(frame, "a connection can follow at most 50 channels")
+		return
+	}
+	client := session.connection.Hub.subscribe(channel.ID)
+	session.channels[channel.ID] = client
+	session.mu.Unlock()
+
+	session.queue(wsFrame{Type: "subscribed", Channel: frame.Channel, Ref: frame.Ref})
+	go session.forward(client)
+}
+
+func (session *wsSession) unsubscribe(frame wsFrame) {
+	id, err := primitive.ObjectIDFromHex(frame.Channel)
+	if err != nil {
+		session.fail(frame, "'"+frame.Channel+"' is not a valid id, expected 24 hex characters")
+		return
+	}
+	session.mu.Lock()
+	client := session.channels[id]
+	delete(session.channels, id)
+	session.mu.Unlock()
+	if client != nil {
+		session.connection.Hub.unsubscribe(client)
+	}
+	session.queue(wsFrame{Type: "unsubscribed", Channel: frame.Channel, Ref: frame.Ref})
+}
+
+// publish posts a message with the same rules as POST /messages
+func (session *wsSession) publish(frame wsFrame) {
+	channel, ok := session.channel(frame)
+	if !ok {
+		return
+	}
+	caller := session.currentCaller()
+	if !caller.canPostTo(channel) {
+		session.fail(frame, "user "+caller.Username+" may not post to "+channel.Name)
+		return
+	}
+	if strings.TrimSpace(frame.Text) == "" {
+		session.fail(frame, "text is required")
+		return
+	}
+	message, queued, err := session.connection.postMessage(context.TODO(), caller, channel, frame.Text)
+	if err == errDeliveriesPending {
+		// Stored, the count is not known yet
+		session.queue(wsFrame{Type: "ack", Channel: frame.Channel, Ref: frame.Ref, Message: &message})
+		return
+	}
+	if err != nil {
+		log.Printf("Publishing over websocket failed: %v\n", err)
+		session.fail(frame, "message could not be stored")
+		return
+	}
+	session.queue(wsFrame{Type: "ack", Channel: frame.Channel, Ref: frame.Ref, Message: &message, Queued: &queued})
+}
+
+// forward passes the hub's messages and presence changes of one channel
+// on to the client until the channel is unsubscribed or the session ends
+func (session *wsSession) forward(client *hubClient) {
+	channel := client.channel.Hex()
+	for {
+		select {
+		case <-session.done:
+			return
+		case message, open := <-client.messages:
+			if !open {
+				session.mu.Lock()
+				current := session.channels[client.channel] == client
+				session.mu.Unlock()
+				if current {
+					// The hub dropped us for being too slow
+					session.close(websocket.CloseTryAgainLater, wsCloseSlowReason)
+				}
+				return
+			}
+			session.queue(wsFrame{Type: "message", Channel: channel, Message: &message})
+		case <-client.presence:
+			session.queue(session.presence(client.channel))
+		}
+	}
+}
+
+// presence counts who follows the channel live and who is subscribed to it
+func (session *wsSession) presence(id primitive.ObjectID) wsFrame {
+	listeners := session.connection.Hub.listeners(id)
+	frame := wsFrame{Type: "presence", Channel: id.Hex(), Listeners: &listeners}
+	var channel Subscription
+	err := session.connection.Subscriptions.FindOne(context.TODO(), bson.M{"_id": id},
+		options.FindOne().SetProjection(bson.M{"subscribers": 1})).Decode(&channel)
+	if err == nil {
+		subscribers := len(channel.Subscribers)
+		frame.Subscribers = &subscribers
+	}
+	return frame
+}
+
+// Handlers
+
+// getWebSocket upgrades an authenticated request to a WebSocket session.
+// Browsers can not set headers on WebSockets, so ?access_token= is
+// accepted as a bearer token.
+func (connection Connection) getWebSocket(w http.ResponseWriter, req *http.Request) {
+	if token := req.URL.Query().Get("access_token"); token != "" && req.Header.Get("Authorization") == "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	caller, ok := authenticate(w, req)
+	if !ok {
+		return
+	}
+	conn, err := wsUpgrader.Upgrade(w, req, nil)
+	if err != nil {
+		// The upgrader already responded
+		log.Printf("Upgrading to websocket failed: %v\n", err)
+		return
+	}
+	session := &wsSession{
+		connection:    connection,
+		conn:          conn,
+		authorization: req.Header.Get("Authorization"),
+		caller:        caller,
+		send:          make(chan wsFrame, wsSendBuffer),
+		done:          make(chan struct{}),
+		recheck:       make(chan struct{}, 1),
+		channels:      map[primitive.ObjectID]*hubClient{},
+	}
+	log.Printf("%s opened a websocket session\n", caller.Username)
+	wsSessions.add(session)
+	go session.writeLoop()
+	go session.reauthLoop()
+	session.readLoop()
+
+	wsSessions.remove(session)
+	session.close(websocket.CloseNormalClosure, "")
+	session.mu.Lock()
+	for id, client := range session.channels {
+		delete(session.channels, id)
+		connection.Hub.unsubscribe(client)
+	}
+	session.mu.Unlock()
+	log.Printf("%s closed a websocket session\n", session.currentCaller().Username)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Roles a user can hold
+const (
+	roleUser      = "user"
+	roleModerator = "moderator"
+	roleAdmin     = "admin"
+)
+
+// All roles in the order they are reported
+var knownRoles = []string{roleUser, roleModerator, roleAdmin}
+
+// isKnownRole reports if the role is one of knownRoles
+func isKnownRole(role string) bool {
+	for _, known := range knownRoles {
+		if role == known {
+			return true
+		}
+	}
+	return false
+}
+
+// adminSeed records that a username from adminUsers was granted admin,
+// so the grant is never repeated for a new user taking the same name
+type adminSeed struct {
+	Username string             `bson:"_id"`
+	UserID   primitive.ObjectID `bson:"userId"`
+	SeededAt time.Time          `bson:"seededAt"`
+}
+
+// seedAdmins stores the admin role on the existing users named in
+// adminUsers, once per username. Names without a user yet are skipped and
+// seeded on a later start, so create those accounts and restart.
+func (connection Connection) seedAdmins(ctx context.Context, seeds *mongo.Collection, usernames []string) error {
+	for _, username := range usernames {
+		var user User
+		err := connection.Users.FindOne(ctx, bson.M{"username": username}).Decode(&user)
+		if err == mongo.ErrNoDocuments {
+			if n, err := seeds.CountDocuments(ctx, bson.M{"_id": username}); err == nil && n == 0 {
+				log.Printf("Admin user %s does not exist yet, register it and restart to grant admin\n", username)
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		// Claim the username first so replicas starting together grant once
+		_, err = seeds.InsertOne(ctx, adminSeed{Username: username, UserID: user.ID, SeededAt: time.Now()})
+		if mongo.IsDuplicateKeyError(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		_, err = connection.Users.UpdateOne(ctx, bson.M{"_id": user.ID}, bson.M{"$addToSet": bson.M{"roles": roleAdmin}})
+		if err != nil {
+			seeds.DeleteOne(ctx, bson.M{"_id": username})
+			return err
+		}
+		log.Printf("Granted admin to %s\n", username)
+		connection.emit(UserEvent{Type: eventUserUpdated, UserID: user.ID, Username: user.Username, Email: user.Email, Changed: []string{"roles"}})
+	}
+	return nil
+}
+
+// effectiveRoles returns the roles stored on the user plus implied ones.
+// Every user has the user role.
+func (connection Connection) effectiveRoles(user User) []string {
+	has := map[string]bool{roleUser: true}
+	for _, role := range user.Roles {
+		has[role] = true
+	}
+	roles := make([]string, 0, len(has))
+	for _, role := range knownRoles {
+		if has[role] {
+			roles = append(roles, role)
+		}
+	}
+	return roles
+}
+
+// hasRole reports if the user holds the role
+func (connection Connection) hasRole(user User, role string) bool {
+	for _, r := range connection.effectiveRoles(user) {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// isAdmin reports if the user may manage other users
+func (connection Connection) isAdmin(user User) bool {
+	return connection.hasRole(user, roleAdmin)
+}
+
+// authorizeUser checks that the caller may modify the target user.
+// Users can only change their own record, admins can change anyone.
+// On failure the 401 or 403 response has already been written.
+func (connection Connection) authorizeUser(w http.ResponseWriter, req *http.Request, target primitive.ObjectID) (User, bool) {
+	caller, err := connection.authenticate(req)
+	if err != nil {
+		authenticationFailed(w, req, err)
+		return caller, false
+	}
+	if caller.ID != target && !connection.isAdmin(caller) {
+		writeProblem(w, req, http.StatusForbidden, "user "+caller.Username+" can only modify their own account")
+		return caller, false
+	}
+	return caller, true
+}
+
+// authenticationFailed answers a failed authenticate, with a 401 when the
+// credentials are wrong and a 500 when they could not be checked
+func authenticationFailed(w http.ResponseWriter, req *http.Request, err error) {
+	if !isCredentialError(err) {
+		serverError(w, req, err)
+		return
+	}
+	unauthorized(w, req, err)
+}
+
+// unauthorized writes a 401 asking for basic auth or a bearer token
+func unauthorized(w http.ResponseWriter, req *http.Request, err error) {
+	w.Header().Set("WWW-Authenticate", `Basic realm="webUsers", Bearer`)
+	writeProblem(w, req, http.StatusUnauthorized, "authentication required: "+err.Error())
+}
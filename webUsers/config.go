@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/FilipVdZel/settings"
+)
+
+// Config is the effective configuration. Every setting starts at its
+// default and is overridden by the config file, then the environment and
+// then the command line.
+type Config struct {
+	Listen string
+	// Timeouts of the HTTP server
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+
+	MongoURI            string
+	MongoDatabase       string
+	MongoConnectTimeout time.Duration
+	Collections         Collections
+
+	TokenSecret string
+	ServiceKey  string
+	AdminUsers  []string
+
+	// Source of every setting by key
+	sources settings.Sources
+}
+
+// Collections names the collections in the database. webSubscriptions
+// reads UserEvents and must use the same name.
+type Collections struct {
+	Users         string
+	RevokedTokens string
+	UserEvents    string
+	AdminSeeds    string
+}
+
+// defaultConfig is the configuration without file, environment or flags
+func defaultConfig() Config {
+	return Config{
+		Listen:              ":8081",
+		ReadHeaderTimeout:   10 * time.Second,
+		ReadTimeout:         30 * time.Second,
+		WriteTimeout:        30 * time.Second,
+		IdleTimeout:         2 * time.Minute,
+		MongoURI:            "mongodb://mongodb:27017",
+		MongoDatabase:       "myDB",
+		MongoConnectTimeout: 5 * time.Second,
+		Collections: Collections{
+			Users:         "Users",
+			RevokedTokens: "RevokedTokens",
+			UserEvents:    "UserEvents",
+			AdminSeeds:    "AdminSeeds",
+		},
+	}
+}
+
+// settings lists every setting in the order they are printed
+func (config *Config) settings() []settings.Setting {
+	return []settings.Setting{
+		{Key: "listen", Env: "LISTEN_ADDR", Usage: "address the API listens on", Value: &config.Listen},
+		{Key: "http.readHeaderTimeout", Env: "HTTP_READ_HEADER_TIMEOUT", Usage: "time allowed to read request headers", Value: &config.ReadHeaderTimeout},
+		{Key: "http.readTimeout", Env: "HTTP_READ_TIMEOUT", Usage: "time allowed to read a whole request", Value: &config.ReadTimeout},
+		{Key: "http.writeTimeout", Env: "HTTP_WRITE_TIMEOUT", Usage: "time allowed to write a response", Value: &config.WriteTimeout},
+		{Key: "http.idleTimeout", Env: "HTTP_IDLE_TIMEOUT", Usage: "how long idle keep-alive connections stay open", Value: &config.IdleTimeout},
+		{Key: "mongo.uri", Env: "MONGO_URI", Usage: "mongodb connection string", Value: &config.MongoURI, Redact: settings.RedactURI},
+		{Key: "mongo.database", Env: "MONGO_DATABASE", Usage: "database holding the collections", Value: &config.MongoDatabase},
+		{Key: "mongo.connectTimeout", Env: "MONGO_CONNECT_TIMEOUT", Usage: "time allowed to connect at startup", Value: &config.MongoConnectTimeout},
+		{Key: "collections.users", Env: "COLLECTION_USERS", Usage: "collection of users", Value: &config.Collections.Users},
+		{Key: "collections.revokedTokens", Env: "COLLECTION_REVOKED_TOKENS", Usage: "collection of revoked tokens", Value: &config.Collections.RevokedTokens},
+		{Key: "collections.userEvents", Env: "COLLECTION_USER_EVENTS", Usage: "collection user changes are written to", Value: &config.Collections.UserEvents},
+		{Key: "collections.adminSeeds", Env: "COLLECTION_ADMIN_SEEDS", Usage: "collection recording which adminUsers were granted admin", Value: &config.Collections.AdminSeeds},
+		{Key: "tokenSecret", Env: "TOKEN_SECRET", Usage: "key signing tokens, random when empty", Value: &config.TokenSecret, Redact: settings.RedactSecret},
+		{Key: "serviceKey", Env: "SERVICE_KEY", Usage: "key other services send to see emails", Value: &config.ServiceKey, Redact: settings.RedactSecret},
+		{Key: "adminUsers", Env: "ADMIN_USERS", Usage: "comma separated usernames granted the admin role once at startup", Value: &config.AdminUsers},
+	}
+}
+
+// registerConfigFlags adds -config, -print-config and a flag per setting
+func registerConfigFlags(flags *flag.FlagSet) *settings.Flags {
+	defaults := defaultConfig()
+	return settings.RegisterFlags(flags, defaults.settings())
+}
+
+// loadConfig layers the config file, the environment and the flags that
+// were set over the defaults and validates the result
+func loadConfig(flags *flag.FlagSet, registered *settings.Flags) (Config, error) {
+	config := defaultConfig()
+	sources, err := settings.Load(flags, registered, config.settings())
+	config.sources = sources
+	if err != nil {
+		return config, err
+	}
+	return config, config.validate()
+}
+
+// validate reports every invalid setting at once
+func (config Config) validate() error {
+	var problems []string
+	check := func(ok bool, problem string) {
+		if !ok {
+			problems = append(problems, problem)
+		}
+	}
+	check(settings.ValidListen(config.Listen), "listen must be an address like :8081")
+	check(config.ReadHeaderTimeout > 0, "http.readHeaderTimeout must be positive")
+	check(config.ReadTimeout > 0, "http.readTimeout must be positive")
+	check(config.WriteTimeout > 0, "http.writeTimeout must be positive")
+	check(config.IdleTimeout > 0, "http.idleTimeout must be positive")
+	check(strings.HasPrefix(config.MongoURI, "mongodb://") || strings.HasPrefix(config.MongoURI, "mongodb+srv://"),
+		"mongo.uri must start with mongodb:// or mongodb+srv://")
+	check(config.MongoDatabase != "", "mongo.database must not be empty")
+	check(config.MongoConnectTimeout > 0, "mongo.connectTimeout must be positive")
+	names := map[string]string{}
+	for _, s := range config.settings() {
+		if !strings.HasPrefix(s.Key, "collections.") {
+			continue
+		}
+		name := s.String()
+		check(name != "", s.Key+" must not be empty")
+		if other, ok := names[name]; ok && name != "" {
+			check(false, s.Key+" and "+other+" must be different collections")
+		}
+		names[name] = s.Key
+	}
+	if len(problems) > 0 {
+		return errors.New("invalid config: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// describe returns a line per setting with its redacted value and source
+func (config Config) describe() []string {
+	return settings.Describe(config.settings(), config.sources)
+}
+
+// printConfig writes the effective config
+func printConfig(w io.Writer, config Config) {
+	settings.Print(w, config.settings(), config.sources)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/FilipVdZel/settings"
+)
+
+// withEnv sets the variables for the test and restores them afterwards.
+// An empty value unsets the variable.
+func withEnv(t *testing.T, vars map[string]string) func() {
+	saved := map[string]*string{}
+	for name, value := range vars {
+		if old, ok := os.LookupEnv(name); ok {
+			saved[name] = &old
+		} else {
+			saved[name] = nil
+		}
+		if value == "" {
+			os.Unsetenv(name)
+		} else {
+			os.Setenv(name, value)
+		}
+	}
+	return func() {
+		for name, old := range saved {
+			if old == nil {
+				os.Unsetenv(name)
+			} else {
+				os.Setenv(name, *old)
+			}
+		}
+	}
+}
+
+// load parses the arguments like main does
+func load(args ...string) (Config, error) {
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	registered := registerConfigFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return Config{}, err
+	}
+	return loadConfig(flags, registered)
+}
+
+func TestLoadConfigLayers(t *testing.T) {
+	file, err := ioutil.TempFile("", "config-*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	// JSON is read like YAML
+	file.WriteString(`{"listen": ":9001", "http": {"readTimeout": "45s"}, "adminUsers": ["ann", "bob"], "mongo": {"database": "fromFile"}}`)
+	file.Close()
+	defer withEnv(t, map[string]string{
+		"CONFIG_FILE":    "",
+		"MONGO_DATABASE": "fromEnv",
+		"ADMIN_USERS":    "",
+		"LISTEN_ADDR":    "",
+	})()
+
+	config, err := load("-config", file.Name(), "-listen", ":9002")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		key    string
+		got    interface{}
+		want   interface{}
+		source string
+	}{
+		{"http.writeTimeout", config.WriteTimeout, 30 * time.Second, settings.SourceDefault},
+		{"http.readTimeout", config.ReadTimeout, 45 * time.Second, settings.SourceFile},
+		{"adminUsers", config.AdminUsers, []string{"ann", "bob"}, settings.SourceFile},
+		{"mongo.database", config.MongoDatabase, "fromEnv", settings.SourceEnv},
+		{"listen", config.Listen, ":9002", settings.SourceFlag},
+	}
+	for _, test := range tests {
+		if !reflect.DeepEqual(test.got, test.want) {
+			t.Errorf("%s = %v, want %v", test.key, test.got, test.want)
+		}
+		if source := config.sources[test.key]; source != test.source {
+			t.Errorf("%s came from %s, want %s", test.key, source, test.source)
+		}
+	}
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	defer withEnv(t, map[string]string{
+		"CONFIG_FILE":            "",
+		"COLLECTION_USERS":       "Events",
+		"COLLECTION_USER_EVENTS": "Events",
+		"HTTP_READ_TIMEOUT":      "0s",
+	})()
+	_, err := load()
+	if err == nil {
+		t.Fatal("loadConfig accepted an invalid config")
+	}
+	for _, want := range []string{"http.readTimeout must be positive", "must be different collections"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not mention %q", err, want)
+		}
+	}
+}
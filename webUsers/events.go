@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Types of user lifecycle events
+const (
+	eventUserCreated = "user.created"
+	eventUserUpdated = "user.updated"
+	eventUserRenamed = "user.renamed"
+	eventUserDeleted = "user.deleted"
+)
+
+// How long events are kept for consumers that fall behind
+const eventRetention = 30 * 24 * time.Hour
+
+// Settings of the queue of events waiting to be stored
+const (
+	eventRetryInterval = 2 * time.Second
+	eventInsertTimeout = 5 * time.Second
+	eventQueueLimit    = 10000
+)
+
+// UserEvent is a change to a user, appended to the UserEvents collection.
+// Other services read the collection in (createdAt, _id) order to follow
+// users.
+type UserEvent struct {
+	ID               primitive.ObjectID `bson:"_id"`
+	Type             string             `bson:"type"`
+	UserID           primitive.ObjectID `bson:"userId"`
+	Username         string             `bson:"username"`
+	PreviousUsername string             `bson:"previousUsername,omitempty"`
+	Email            string             `bson:"email,omitempty"`
+	// Names of the fields an update changed, never their values. Role
+	// changes list roles and revoked tokens list tokens.
+	Changed   []string  `bson:"changed,omitempty"`
+	CreatedAt time.Time `bson:"createdAt"`
+	ExpiresAt time.Time `bson:"expiresAt"`
+}
+
+// ensureEventIndexes supports reading events in order and lets Mongo drop
+// them after eventRetention
+func ensureEventIndexes(ctx context.Context, events *mongo.Collection) error {
+	_, err := events.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "createdAt", Value: 1}, {Key: "_id", Value: 1}}},
+		{
+			Keys:    bson.M{"expiresAt": 1},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	})
+	return err
+}
+
+// changedFields names the fields of the update that differ from before
+func changedFields(before User, update User) []string {
+	var changed []string
+	if update.Name != "" && update.Name != before.Name {
+		changed = append(changed, "name")
+	}
+	if update.Surname != "" && update.Surname != before.Surname {
+		changed = append(changed, "surname")
+	}
+	if update.Email != "" && update.Email != before.Email {
+		changed = append(changed, "email")
+	}
+	if update.Username != "" && update.Username != before.Username {
+		changed = append(changed, "username")
+	}
+	if update.Password != "" {
+		changed = append(changed, "password")
+	}
+	if update.Dob != "" && update.Dob != before.Dob {
+		changed = append(changed, "dob")
+	}
+	return changed
+}
+
+// updateEvent describes an update of the user. A new username makes it a
+// rename so consumers can move what they keep under the old one.
+func updateEvent(before User, update User) UserEvent {
+	after := before
+	if update.Username != "" {
+		after.Username = update.Username
+	}
+	if update.Email != "" {
+		after.Email = update.Email
+	}
+	event := UserEvent{Type: eventUserUpdated, UserID: before.ID, Username: after.Username, Email: after.Email, Changed: changedFields(before, update)}
+	if after.Username != before.Username {
+		event.Type = eventUserRenamed
+		event.PreviousUsername = before.Username
+	}
+	return event
+}
+
+// eventQueue holds events until they are stored. The user change is
+// already written when an event is emitted and Mongo may run without a
+// replica set, so both can not share a transaction. Only Run inserts, one
+// event at a time, so events of a user stay in order.
+type eventQueue struct {
+	events *mongo.Collection
+	mu     sync.Mutex
+	queued []UserEvent
+	wake   chan struct{}
+}
+
+func newEventQueue(events *mongo.Collection) *eventQueue {
+	return &eventQueue{events: events, wake: make(chan struct{}, 1)}
+}
+
+// emit queues the event behind the ones still waiting and wakes Run
+func (connection Connection) emit(event UserEvent) {
+	event.ID = primitive.NewObjectID()
+	queue := connection.EventQueue
+	queue.mu.Lock()
+	if len(queue.queued) >= eventQueueLimit {
+		queue.mu.Unlock()
+		log.Printf("Event queue is full, dropping %s of %s\n", event.Type, event.Username)
+		return
+	}
+	queue.queued = append(queue.queued, event)
+	queue.mu.Unlock()
+	select {
+	case queue.wake <- struct{}{}:
+	default:
+	}
+}
+
+// insert stores the event with the current time, consumers read events
+// from their last position on so a retried one must not land behind it.
+// A duplicate means an earlier try was stored after all.
+func (queue *eventQueue) insert(ctx context.Context, event UserEvent) error {
+	ctx, cancel := context.WithTimeout(ctx, eventInsertTimeout)
+	defer cancel()
+	now := time.Now()
+	event.CreatedAt = now
+	event.ExpiresAt = now.Add(eventRetention)
+	_, err := queue.events.InsertOne(ctx, event)
+	if mongo.IsDuplicateKeyError(err) {
+		return nil
+	}
+	return err
+}
+
+// Run stores the queued events until the context ends. After a failure
+// it waits eventRetryInterval before trying again.
+func (queue *eventQueue) Run(ctx context.Context) {
+	ticker := time.NewTicker(eventRetryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-queue.wake:
+		}
+		if !queue.flush(ctx) {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(eventRetryInterval):
+			}
+		}
+	}
+}
+
+// next returns the oldest waiting event
+func (queue *eventQueue) next() (UserEvent, bool) {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	if len(queue.queued) == 0 {
+		return UserEvent{}, false
+	}
+	return queue.queued[0], true
+}
+
+// stored drops the oldest event once it is stored
+func (queue *eventQueue) stored() {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	queue.queued = queue.queued[1:]
+}
+
+// flush stores queued events in order. It stops at the first failure and
+// reports if the queue was emptied. The lock is not held while inserting
+// so emit never waits for Mongo.
+func (queue *eventQueue) flush(ctx context.Context) bool {
+	for {
+		event, ok := queue.next()
+		if !ok {
+			return true
+		}
+		if err := queue.insert(ctx, event); err != nil {
+			log.Printf("Recording %s of %s failed, retrying: %v\n", event.Type, event.Username, err)
+			return false
+		}
+		queue.stored()
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestEmitQueuesInOrder(t *testing.T) {
+	connection := Connection{EventQueue: newEventQueue(nil)}
+	for _, username := range []string{"first", "second", "third"} {
+		connection.emit(UserEvent{Type: eventUserCreated, Username: username})
+	}
+	select {
+	case <-connection.EventQueue.wake:
+	default:
+		t.Error("emit did not wake the queue")
+	}
+	for _, want := range []string{"first", "second", "third"} {
+		event, ok := connection.EventQueue.next()
+		if !ok || event.Username != want {
+			t.Fatalf("next() = %q, %v, want %q", event.Username, ok, want)
+		}
+		if event.ID.IsZero() {
+			t.Errorf("event of %s has no ID", want)
+		}
+		connection.EventQueue.stored()
+	}
+	if _, ok := connection.EventQueue.next(); ok {
+		t.Error("queue not empty after storing every event")
+	}
+}
+
+func TestEmitDropsWhenFull(t *testing.T) {
+	connection := Connection{EventQueue: newEventQueue(nil)}
+	for i := 0; i < eventQueueLimit+5; i++ {
+		connection.emit(UserEvent{Type: eventUserUpdated, Username: "busy"})
+	}
+	if got := len(connection.EventQueue.queued); got != eventQueueLimit {
+		t.Errorf("%d events queued, want %d", got, eventQueueLimit)
+	}
+}
@@ -3,7 +3,16 @@ module gitlab.com/FilipVdZel/golang-modules
 go 1.13
 
 require (
-	github.com/google/uuid v1.3.0 // indirect
+	github.com/FilipVdZel/pagination v0.0.0
+	github.com/FilipVdZel/problem v0.0.0
+	github.com/FilipVdZel/settings v0.0.0
 	github.com/gorilla/mux v1.8.0
 	go.mongodb.org/mongo-driver v1.8.2
+	golang.org/x/crypto v0.0.0-20201216223049-8b5274cf687f
 )
+
+replace github.com/FilipVdZel/pagination => ../pagination
+
+replace github.com/FilipVdZel/problem => ../problem
+
+replace github.com/FilipVdZel/settings => ../settings
@@ -3,11 +3,15 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
 	"time"
 
+	"github.com/FilipVdZel/pagination"
 	"github.com/gorilla/mux"
 
 	"go.mongodb.org/mongo-driver/bson"
@@ -17,40 +21,85 @@ import (
 	"go.mongodb.org/mongo-driver/mongo/readpref"
 )
 
+// How long creating indexes and seeding admins may take at startup
+const setupTimeout = time.Minute
+
 //Time type stryct
 type timeResponse struct {
 	Time string `json:"time"`
 }
 
 // User type struct
+// Storage model of the Users collection, responses use the views in views.go
 type User struct {
 	ID       primitive.ObjectID `json:"_id,omitempty" bson:"_id,omitempty"`
 	Name     string             `json:"name,omitempty" bson:"name,omitempty"`
 	Surname  string             `json:"surname,omitempty" bson:"surname,omitempty"`
 	Email    string             `json:"email,omitempty" bson:"email,omitempty"`
 	Username string             `json:"username,omitempty" bson:"username,omitempty"`
-	Password string             `json:"password,omitempty" bson:"password,omitempty"`
+	Password string             `json:"-" bson:"password,omitempty"`
 	Dob      string             `json:"dob,omitempty" bson:"dob,omitempty"`
+	Roles    []string           `json:"roles,omitempty" bson:"roles,omitempty"`
+	// Raised on every password change, tokens issued before it stop working
+	TokenVersion int `json:"-" bson:"tokenVersion,omitempty"`
 }
 
 // Init Users varibale
 // This variables stoors user data in memory
 var Users []User
 
+// Response of /verifyUser
+type verifyResponse struct {
+	ID       string   `json:"id"`
+	Username string   `json:"username"`
+	Roles    []string `json:"roles"`
+}
+
+// Errors of authenticate that mean the credentials are wrong, others mean
+// they could not be checked
+var (
+	errBadCredentials = errors.New("username or password is incorrect")
+	errNoCredentials  = errors.New("no credentials given")
+)
+
 // Database connection struct
 type Connection struct {
-	Users *mongo.Collection
+	Users      *mongo.Collection
+	Revoked    *mongo.Collection
+	Events     *mongo.Collection
+	EventQueue *eventQueue
+	Secret     []byte
+	ServiceKey string
+	Pager      *pagination.Pager
 }
 
 func main() {
+	// Maintenance commands run once and exit
+	reportDuplicates := flag.Bool("report-duplicate-users", false, "list users sharing a username or email and exit")
+	// Defaults, then the config file, the environment and the flags
+	configFlags := registerConfigFlags(flag.CommandLine)
+	flag.Parse()
+	config, err := loadConfig(flag.CommandLine, configFlags)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *configFlags.Print {
+		printConfig(os.Stdout, config)
+		return
+	}
+	log.Println("Effective configuration:")
+	for _, line := range config.describe() {
+		log.Println("  " + line)
+	}
+
 	// connect to mongodb
 	log.Println("Connecting to mongodb ...")
-	clientOptions := options.Client().ApplyURI("mongodb://mongodb:27017")
+	clientOptions := options.Client().ApplyURI(config.MongoURI)
 	client, err := mongo.NewClient(clientOptions)
 	if err != nil {
 		log.Fatal(err)
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), config.MongoConnectTimeout)
 	defer cancel()
 
 	err = client.Connect(ctx)
@@ -64,26 +113,89 @@ func main() {
 		log.Fatal(err)
 	}
 
-	collectionUsers := client.Database("myDB").Collection("Users")
+	// Building indexes and seeding admins may take longer than connecting
+	setupCtx, cancelSetup := context.WithTimeout(context.Background(), setupTimeout)
+	defer cancelSetup()
+
+	db := client.Database(config.MongoDatabase)
+	collectionUsers := db.Collection(config.Collections.Users)
+	if *reportDuplicates {
+		duplicates, err := findDuplicateUsers(context.Background(), collectionUsers)
+		printDuplicateReport(os.Stdout, duplicates)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	err = ensureUserIndexes(setupCtx, collectionUsers)
+	if mongo.IsDuplicateKeyError(err) {
+		// Keep serving, creating and updating users still checks for conflicts
+		log.Printf("Unique username and email indexes are missing because users share them: %v\n", err)
+		log.Println("List them with -report-duplicate-users, fix them and restart to create the indexes")
+	} else if err != nil {
+		log.Fatal(err)
+	}
+	collectionRevoked := db.Collection(config.Collections.RevokedTokens)
+	err = ensureRevokedIndexes(setupCtx, collectionRevoked)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Other services follow user changes through the UserEvents collection
+	collectionEvents := db.Collection(config.Collections.UserEvents)
+	err = ensureEventIndexes(setupCtx, collectionEvents)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Cursors are signed with the token secret, the service key is optional here
+	secret := loadTokenSecret(config.TokenSecret)
 	connection := Connection{
-		Users: collectionUsers,
+		Users:      collectionUsers,
+		Revoked:    collectionRevoked,
+		Events:     collectionEvents,
+		EventQueue: newEventQueue(collectionEvents),
+		Secret:     secret,
+		ServiceKey: config.ServiceKey,
+		Pager:      pagination.New(string(secret)),
+	}
+	// adminUsers get the admin role stored once, later users with the same
+	// name do not
+	err = connection.seedAdmins(setupCtx, db.Collection(config.Collections.AdminSeeds), config.AdminUsers)
+	if err != nil {
+		log.Fatal(err)
 	}
 
+	go connection.EventQueue.Run(context.Background())
+
 	// init server mux
 	router := mux.NewRouter()
 
 	//Handelers
 	router.HandleFunc("/time", getTime).Methods("GET")
 	router.HandleFunc("/verifyUser", connection.verifyUser).Methods("POST")
+	router.HandleFunc("/login", connection.login).Methods("POST")
+	router.HandleFunc("/token/refresh", connection.refreshToken).Methods("POST")
+	router.HandleFunc("/token/revoke", connection.revoke).Methods("POST")
 	router.HandleFunc("/users", connection.getUsers).Methods("GET")
 	router.HandleFunc("/users", connection.createUsers).Methods("POST")
 	router.HandleFunc("/users/{id}", connection.getUser).Methods("GET")
 	router.HandleFunc("/users/{id}", connection.updateUser).Methods("PUT")
 	router.HandleFunc("/users/{id}", connection.deleteUser).Methods("DELETE")
+	router.HandleFunc("/admin/users/{id}/roles", connection.getRoles).Methods("GET")
+	router.HandleFunc("/admin/users/{id}/roles", connection.setRoles).Methods("PUT")
+	router.HandleFunc("/admin/users/{id}/roles/{role}", connection.addRole).Methods("POST")
+	router.HandleFunc("/admin/users/{id}/roles/{role}", connection.removeRole).Methods("DELETE")
 
-	// listen and serve requests on localhost port 8081
+	// listen and serve requests on the configured address, :8081 by default
 	// Use server mux router
-	log.Fatal(http.ListenAndServe(":8081", router))
+	server := &http.Server{
+		Addr:              config.Listen,
+		Handler:           router,
+		ReadHeaderTimeout: config.ReadHeaderTimeout,
+		ReadTimeout:       config.ReadTimeout,
+		WriteTimeout:      config.WriteTimeout,
+		IdleTimeout:       config.IdleTimeout,
+	}
+	log.Fatal(server.ListenAndServe())
 
 }
 
@@ -117,23 +229,20 @@ func getTime(w http.ResponseWriter, req *http.Request) {
 }
 
 func (connection Connection) verifyUser(w http.ResponseWriter, req *http.Request) {
-	u, p, ok := req.BasicAuth()
-	if !ok {
-		fmt.Println("Error parsing basic auth")
-		w.WriteHeader(401)
-		return
-	}
-
-	// Get Users password
-	var user User
-	connection.Users.FindOne(context.TODO(), bson.M{"username": u}).Decode(&user)
-	password := user.Password
-	if p != password {
-		fmt.Printf("Password provided is incorrect: %s\n", u)
-		w.WriteHeader(401)
+	w.Header().Set("Content-Type", "application/json")
+	user, err := connection.authenticate(req)
+	if err != nil {
+		fmt.Printf("Verification failed: %v\n", err)
+		authenticationFailed(w, req, err)
 		return
 	}
+	// Tell the caller who the credentials belong to
 	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(verifyResponse{
+		ID:       user.ID.Hex(),
+		Username: user.Username,
+		Roles:    connection.effectiveRoles(user),
+	})
 	return
 
 }
@@ -141,71 +250,104 @@ func (connection Connection) verifyUser(w http.ResponseWriter, req *http.Request
 func (connection Connection) getUsers(w http.ResponseWriter, req *http.Request) {
 	// make sure content is not served as text to client
 	w.Header().Set("Content-Type", "application/json")
-	var users []User
+	// Only load and sort on the fields the caller may see
+	level := connection.viewerLevel(req, primitive.NilObjectID)
 
 	//Get parameters value
 	params := req.URL.Query()
-
-	// If no parameters Encode all users
-	if len(params) == 0 {
-		// create a filter (cursor)
-		// this filter returns all entries in the database
-		cursor, err := connection.Users.Find(context.TODO(), bson.M{})
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(`{"message": "` + err.Error() + `" }`))
-			return
-		}
-		//Apply filter to all entries
-		cursor.All(context.TODO(), &users)
-
-		// repond with filtered content
-		json.NewEncoder(w).Encode(users)
+	page, err := connection.Pager.Parse(params, level.sortable(), level.selectable())
+	if err != nil {
+		writeProblem(w, req, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	var filter bson.D
-	//Go through all names
-	searchName := params.Get("name")
-	if searchName != "" {
-		filter = bson.D{primitive.E{
-			Key: "name", Value: primitive.Regex{Pattern: searchName, Options: "i"}}}
-	}
-
-	searchUser := params.Get("username")
-	if searchUser != "" {
-		filter = bson.D{primitive.E{
-			Key: "username", Value: searchUser}}
+	// Without search parameters all users are listed
+	// Every search parameter and the filter expression must match
+	filter, err := buildUserFilter(params, level.searchable())
+	if err != nil {
+		writeProblem(w, req, http.StatusBadRequest, err.Error())
+		return
 	}
 
-	cursor, err := connection.Users.Find(context.TODO(), filter)
+	projection := page.Projection(level.projection(), level.alwaysLoaded()...)
+	docs, total, next, err := pagination.Find(context.TODO(), connection.Users, req, page, filter, projection)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(`{"message": "` + err.Error() + `" }`))
+		dbError(w, req, err, "users")
 		return
 	}
 
-	//Apply filter to all entries
-	cursor.All(context.TODO(), &users)
-	if len(users) > 1 { // Encode ass array
-		//Encode all users
-		json.NewEncoder(w).Encode(users)
-	} else { // Encode as single entry
-		json.NewEncoder(w).Encode(users[0])
+	users := make([]User, len(docs))
+	for i, doc := range docs {
+		err = bson.Unmarshal(doc, &users[i])
+		if err != nil {
+			serverError(w, req, err)
+			return
+		}
 	}
 
+	// repond with one page of users
+	json.NewEncoder(w).Encode(pagination.Page{
+		Data:  level.renderAll(users),
+		Total: total,
+		Limit: page.Limit,
+		Next:  next,
+	})
+
 }
 
 func (connection Connection) createUsers(w http.ResponseWriter, req *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	//Create new user var and decode json contect from body
-	var user User
-	_ = json.NewDecoder(req.Body).Decode(&user)
+	var input UserInput
+	err := json.NewDecoder(req.Body).Decode(&input)
+	if err != nil {
+		writeProblemErrors(w, req, http.StatusBadRequest, "invalid json body", fieldErrors{"body": err.Error()})
+		return
+	}
+
+	// Check fields and that username and email are not taken
+	if errs := validateUser(input, false); len(errs) > 0 {
+		writeProblemErrors(w, req, http.StatusBadRequest, "validation failed", errs)
+		return
+	}
+	errs, err := connection.findConflicts(input, primitive.NilObjectID)
+	if err != nil {
+		dbError(w, req, err, "user")
+		return
+	}
+	if len(errs) > 0 {
+		writeProblemErrors(w, req, http.StatusConflict, "user already exists", errs)
+		return
+	}
+	user := input.toUser()
+	user.Roles = []string{roleUser}
+
+	// Never store the plaintext password
+	hash, err := hashPassword(user.Password)
+	if err != nil {
+		serverError(w, req, err)
+		return
+	}
+	user.Password = hash
 
 	// insert user into database
-	result, _ := connection.Users.InsertOne(context.TODO(), user)
-	//Response with json data
-	json.NewEncoder(w).Encode(result)
+	// The unique indexes catch a user created since the check above
+	result, err := connection.Users.InsertOne(context.TODO(), user)
+	if mongo.IsDuplicateKeyError(err) {
+		writeProblemErrors(w, req, http.StatusConflict, "user already exists", duplicateField(err))
+		return
+	}
+	if err != nil {
+		dbError(w, req, err, "user")
+		return
+	}
+	if id, ok := result.InsertedID.(primitive.ObjectID); ok {
+		user.ID = id
+	}
+	connection.emit(UserEvent{Type: eventUserCreated, UserID: user.ID, Username: user.Username, Email: user.Email})
+	//Response with the new user as they see themselves
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(viewSelf.render(user))
 }
 
 func (connection Connection) getUser(w http.ResponseWriter, req *http.Request) {
@@ -217,17 +359,23 @@ func (connection Connection) getUser(w http.ResponseWriter, req *http.Request) {
 	// Gat object ID
 	objectId, err := primitive.ObjectIDFromHex(param["id"])
 	if err != nil {
-		log.Println("Invalid ID")
+		invalidID(w, req, param["id"])
 		return
 	}
 
 	// Find document with sepcified ID
+	// Only the user themselves and services see the ID and private fields
 	var user User
-	//TODO: Do not show ID field
-	connection.Users.FindOne(context.TODO(), bson.M{"_id": objectId}).Decode(&user)
+	level := connection.viewerLevel(req, objectId)
+	findOptions := options.FindOne().SetProjection(level.projection())
+	err = connection.Users.FindOne(context.TODO(), bson.M{"_id": objectId}, findOptions).Decode(&user)
+	if err != nil {
+		dbError(w, req, err, "user "+param["id"])
+		return
+	}
 
 	// repond with user
-	json.NewEncoder(w).Encode(user)
+	json.NewEncoder(w).Encode(level.render(user))
 }
 
 func (connection Connection) updateUser(w http.ResponseWriter, req *http.Request) {
@@ -238,28 +386,76 @@ func (connection Connection) updateUser(w http.ResponseWriter, req *http.Request
 	// Gat object ID
 	objectId, err := primitive.ObjectIDFromHex(param["id"])
 	if err != nil {
-		log.Println("Invalid ID")
+		invalidID(w, req, param["id"])
 		return
 	}
-	var user User
+	// Only the user themselves or an admin may update
+	if _, ok := connection.authorizeUser(w, req, objectId); !ok {
+		return
+	}
+	var input UserInput
 	// decode json in request body
-	err = json.NewDecoder(req.Body).Decode(&user)
+	err = json.NewDecoder(req.Body).Decode(&input)
+	if err != nil {
+		writeProblemErrors(w, req, http.StatusBadRequest, "invalid json body", fieldErrors{"body": err.Error()})
+		return
+	}
+	// Check the fields that are being changed
+	if errs := validateUser(input, true); len(errs) > 0 {
+		writeProblemErrors(w, req, http.StatusBadRequest, "validation failed", errs)
+		return
+	}
+	errs, err := connection.findConflicts(input, objectId)
 	if err != nil {
-		fmt.Printf("%v\n", err)
+		dbError(w, req, err, "user")
+		return
+	}
+	if len(errs) > 0 {
+		writeProblemErrors(w, req, http.StatusConflict, "username or email already taken", errs)
+		return
+	}
+	user := input.toUser()
+	// Hash new password before it is stored
+	if user.Password != "" {
+		user.Password, err = hashPassword(user.Password)
+		if err != nil {
+			serverError(w, req, err)
+			return
+		}
 	}
 	var doc bson.D
 	data, _ := bson.Marshal(user)
 	_ = bson.Unmarshal(data, &doc)
+	update := bson.M{"$set": doc}
+	if user.Password != "" {
+		// A new password signs the user out everywhere
+		update["$inc"] = bson.M{"tokenVersion": 1}
+	}
 	// update specified user
-	result, err := connection.Users.UpdateOne(
+	// The previous version tells which fields changed and if it was a rename
+	var before User
+	err = connection.Users.FindOneAndUpdate(
 		context.TODO(),          // required context
 		bson.M{"_id": objectId}, // filter
-		bson.M{"$set": doc},
-	)
+		update,
+	).Decode(&before)
+	if mongo.IsDuplicateKeyError(err) {
+		writeProblemErrors(w, req, http.StatusConflict, "username or email already taken", duplicateField(err))
+		return
+	}
+	if err == mongo.ErrNoDocuments {
+		writeProblem(w, req, http.StatusNotFound, "user "+param["id"]+" not found")
+		return
+	}
 	if err != nil {
-		log.Println("Update Failed")
+		dbError(w, req, err, "user "+param["id"])
 		return
 	}
+	result := mongo.UpdateResult{MatchedCount: 1}
+	if event := updateEvent(before, user); len(event.Changed) > 0 {
+		connection.emit(event)
+		result.ModifiedCount = 1
+	}
 	json.NewEncoder(w).Encode(result)
 
 }
@@ -271,11 +467,93 @@ func (connection Connection) deleteUser(w http.ResponseWriter, req *http.Request
 	//Get Object id
 	objectId, err := primitive.ObjectIDFromHex(param["id"])
 	if err != nil {
-		log.Println("Invalid ID")
+		invalidID(w, req, param["id"])
+		return
 	}
-	result, err := connection.Users.DeleteOne(context.TODO(), bson.M{"_id": objectId})
+	// Only the user themselves or an admin may delete
+	if _, ok := connection.authorizeUser(w, req, objectId); !ok {
+		return
+	}
+	// The deleted user tells other services whose data to clean up
+	var user User
+	err = connection.Users.FindOneAndDelete(context.TODO(), bson.M{"_id": objectId}).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		writeProblem(w, req, http.StatusNotFound, "user "+param["id"]+" not found")
+		return
+	}
+	if err != nil {
+		dbError(w, req, err, "user "+param["id"])
+		return
+	}
+	connection.emit(UserEvent{Type: eventUserDeleted, UserID: user.ID, Username: user.Username, Email: user.Email})
+	result := mongo.DeleteResult{DeletedCount: 1}
 
 	//Response with json data
 	json.NewEncoder(w).Encode(result)
 
 }
+
+// checkCredentials looks up a user and verifies the password.
+// Legacy plaintext and outdated hashes are upgraded on success.
+func (connection Connection) checkCredentials(username string, password string) (User, bool) {
+	var user User
+	err := connection.Users.FindOne(context.TODO(), bson.M{"username": username}).Decode(&user)
+	if err != nil {
+		// Compare against a dummy hash so unknown users take as long as known ones
+		checkPassword(string(dummyHash), password)
+		fmt.Printf("User not found: %s\n", username)
+		return user, false
+	}
+	match, rehash := checkPassword(user.Password, password)
+	if !match {
+		fmt.Printf("Password provided is incorrect: %s\n", username)
+		return user, false
+	}
+
+	// Upgrade plaintext or outdated hashes now that we know the password
+	if rehash {
+		hash, err := hashPassword(password)
+		if err == nil {
+			_, err = connection.Users.UpdateOne(
+				context.TODO(),
+				bson.M{"_id": user.ID, "password": user.Password},
+				bson.M{"$set": bson.M{"password": hash}},
+			)
+		}
+		if err != nil {
+			log.Printf("Rehash failed for %s: %v\n", username, err)
+		}
+	}
+	return user, true
+}
+
+// authenticate returns the user behind a request's basic auth or bearer token
+func (connection Connection) authenticate(req *http.Request) (User, error) {
+	if token, ok := bearerToken(req); ok {
+		claims, err := connection.verifyToken(token, tokenAccess)
+		if err != nil {
+			return User{}, err
+		}
+		return connection.tokenUser(claims)
+	}
+	u, p, ok := req.BasicAuth()
+	if !ok {
+		return User{}, errNoCredentials
+	}
+	user, ok := connection.checkCredentials(u, p)
+	if !ok {
+		return User{}, errBadCredentials
+	}
+	return user, nil
+}
+
+// findUserByHex loads a user by the hex form of its ObjectID
+func (connection Connection) findUserByHex(id string) (User, error) {
+	var user User
+	objectId, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return user, err
+	}
+	err = connection.Users.FindOne(context.TODO(), bson.M{"_id": objectId}).Decode(&user)
+	return user, err
+}
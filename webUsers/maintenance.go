@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Fields the unique user indexes cover
+var uniqueUserFields = []string{"username", "email"}
+
+// duplicateUsers is a username or email more than one user holds
+type duplicateUsers struct {
+	Field string               `bson:"-"`
+	Value string               `bson:"_id"`
+	IDs   []primitive.ObjectID `bson:"ids"`
+}
+
+// findDuplicateUsers lists the values that stop the unique indexes from
+// being created, with the users holding each. Which user keeps the value
+// is for an admin to decide, nothing is changed.
+func findDuplicateUsers(ctx context.Context, users *mongo.Collection) ([]duplicateUsers, error) {
+	var found []duplicateUsers
+	for _, field := range uniqueUserFields {
+		pipeline := mongo.Pipeline{
+			{{Key: "$match", Value: bson.M{field: bson.M{"$type": "string"}}}},
+			{{Key: "$group", Value: bson.M{"_id": "$" + field, "ids": bson.M{"$push": "$_id"}, "count": bson.M{"$sum": 1}}}},
+			{{Key: "$match", Value: bson.M{"count": bson.M{"$gt": 1}}}},
+			{{Key: "$sort", Value: bson.M{"_id": 1}}},
+		}
+		aggregate := options.Aggregate().SetAllowDiskUse(true)
+		if field == "email" {
+			// Emails that only differ in case clash in the unique index
+			aggregate.SetCollation(emailCollation)
+		}
+		cursor, err := users.Aggregate(ctx, pipeline, aggregate)
+		if err != nil {
+			return found, err
+		}
+		var duplicates []duplicateUsers
+		if err := cursor.All(ctx, &duplicates); err != nil {
+			return found, err
+		}
+		for _, duplicate := range duplicates {
+			duplicate.Field = field
+			found = append(found, duplicate)
+		}
+	}
+	return found, nil
+}
+
+// printDuplicateReport writes one line per duplicated value and a total
+func printDuplicateReport(out io.Writer, duplicates []duplicateUsers) {
+	for _, duplicate := range duplicates {
+		ids := make([]string, len(duplicate.IDs))
+		for i, id := range duplicate.IDs {
+			ids[i] = id.Hex()
+		}
+		fmt.Fprintf(out, "%s %s is used by %d users: %v\n", duplicate.Field, duplicate.Value, len(ids), ids)
+	}
+	fmt.Fprintf(out, "Found %d duplicated usernames and emails\n", len(duplicates))
+}
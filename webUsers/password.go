@@ -0,0 +1,50 @@
+package main
+
+import (
+	"crypto/subtle"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Cost used when hashing new passwords
+const passwordCost = 12
+
+// Hash compared against when a username does not exist, so a failed
+// lookup takes about as long as a wrong password
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), passwordCost)
+
+// hashPassword returns the bcrypt hash of a plaintext password
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), passwordCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// isHashed reports if a stored password is a bcrypt hash.
+// Records created before hashing was added hold the plaintext password.
+func isHashed(stored string) bool {
+	return strings.HasPrefix(stored, "$2a$") ||
+		strings.HasPrefix(stored, "$2b$") ||
+		strings.HasPrefix(stored, "$2y$")
+}
+
+// checkPassword compares a password against the stored value in constant time.
+// rehash is true when the password matched but the stored value should be
+// replaced, either because it is legacy plaintext or uses an outdated cost.
+func checkPassword(stored string, password string) (match bool, rehash bool) {
+	if stored == "" || password == "" {
+		return false, false
+	}
+	if !isHashed(stored) {
+		match = subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+		return match, match
+	}
+	if bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) != nil {
+		return false, false
+	}
+	cost, err := bcrypt.Cost([]byte(stored))
+	return true, err != nil || cost < passwordCost
+}
@@ -0,0 +1,14 @@
+package main
+
+import (
+	"github.com/FilipVdZel/problem"
+)
+
+// Errors are answered with RFC 7807 problems from the shared problem module
+var (
+	writeProblem       = problem.Write
+	writeProblemErrors = problem.WriteErrors
+	invalidID          = problem.InvalidID
+	serverError        = problem.ServerError
+	dbError            = problem.DBError
+)
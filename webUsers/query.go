@@ -0,0 +1,309 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// contains reports if the list holds the value
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Limits on a ?filter= expression
+const (
+	maxFilterLength     = 1000
+	maxFilterConditions = 20
+)
+
+// Query parameters of GET /users that are not searches
+var nonSearchParams = []string{"limit", "sort", "fields", "cursor", "filter"}
+
+// searchable returns the fields the view level may search on
+func (level viewLevel) searchable() []string {
+	if level == viewPublic {
+		return publicFields
+	}
+	return selfFields
+}
+
+// buildUserFilter combines the simple search parameters and the filter
+// expression into one Mongo filter. All parts must match.
+//
+// Simple parameters:
+//
+//	name, surname   case-insensitive contains
+//	username, dob   exact match
+//	email, roles    exact match, email ignores case
+//	dob_from, dob_to inclusive date range
+//
+// The filter parameter takes conditions joined by AND and OR with
+// parentheses, for example: name~ann AND (surname=Smith OR dob>=1990-01-01)
+// Operators are = != ~ (contains, ignoring case) and < <= > >= for dob.
+// = and != on email ignore case.
+func buildUserFilter(params url.Values, searchable []string) (bson.M, error) {
+	var parts bson.A
+	for key, values := range params {
+		if contains(nonSearchParams, key) {
+			continue
+		}
+		field := strings.TrimSuffix(strings.TrimSuffix(key, "_from"), "_to")
+		if field != key && field != "dob" {
+			return nil, errors.New("unknown parameter '" + key + "'")
+		}
+		if !contains(searchable, field) {
+			return nil, errors.New("can not search on '" + key + "', use any of " + strings.Join(searchable, ", "))
+		}
+		for _, value := range values {
+			var op string
+			switch {
+			case key == "dob_from":
+				op = ">="
+			case key == "dob_to":
+				op = "<="
+			case key == "name" || key == "surname":
+				op = "~"
+			default:
+				op = "="
+			}
+			condition, err := userCondition(field, op, value)
+			if err != nil {
+				return nil, err
+			}
+			parts = append(parts, condition)
+		}
+	}
+
+	if expression := params.Get("filter"); expression != "" {
+		condition, err := parseFilter(expression, searchable)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, condition)
+	}
+
+	switch len(parts) {
+	case 0:
+		return bson.M{}, nil
+	case 1:
+		return parts[0].(bson.M), nil
+	default:
+		return bson.M{"$and": parts}, nil
+	}
+}
+
+// userCondition builds the Mongo condition for one comparison.
+// User input is always escaped before it is used in a regex.
+func userCondition(field string, op string, value string) (bson.M, error) {
+	if field == "dob" {
+		if _, err := time.Parse(dobLayout, value); err != nil {
+			return nil, errors.New("dob must be a date formatted as YYYY-MM-DD")
+		}
+	}
+	// Email ignores case for both = and !=
+	email := primitive.Regex{Pattern: "^" + regexp.QuoteMeta(value) + "$", Options: "i"}
+	switch op {
+	case "=":
+		if field == "email" {
+			return bson.M{field: email}, nil
+		}
+		return bson.M{field: value}, nil
+	case "!=":
+		if field == "email" {
+			return bson.M{field: bson.M{"$not": email}}, nil
+		}
+		return bson.M{field: bson.M{"$ne": value}}, nil
+	case "~":
+		return bson.M{field: primitive.Regex{Pattern: regexp.QuoteMeta(value), Options: "i"}}, nil
+	case "<", "<=", ">", ">=":
+		if field != "dob" {
+			return nil, errors.New("operator " + op + " only works on dob")
+		}
+		operators := map[string]string{"<": "$lt", "<=": "$lte", ">": "$gt", ">=": "$gte"}
+		return bson.M{field: bson.M{operators[op]: value}}, nil
+	}
+	return nil, errors.New("unknown operator '" + op + "'")
+}
+
+// Kinds of tokens in a filter expression
+const (
+	tokenWord = iota
+	tokenString
+	tokenOperator
+	tokenOpen
+	tokenClose
+)
+
+type filterToken struct {
+	kind  int
+	value string
+}
+
+// isOperatorRune reports if the rune can be part of a comparison operator
+func isOperatorRune(r rune) bool {
+	return strings.ContainsRune("=!~<>", r)
+}
+
+// tokenizeFilter splits an expression into words, quoted strings,
+// operators and parentheses
+func tokenizeFilter(expression string) ([]filterToken, error) {
+	var tokens []filterToken
+	runes := []rune(expression)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			tokens = append(tokens, filterToken{tokenOpen, "("})
+			i++
+		case r == ')':
+			tokens = append(tokens, filterToken{tokenClose, ")"})
+			i++
+		case r == '"':
+			var value strings.Builder
+			i++
+			for ; i < len(runes) && runes[i] != '"'; i++ {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+				}
+				value.WriteRune(runes[i])
+			}
+			if i == len(runes) {
+				return nil, errors.New("filter has an unterminated string")
+			}
+			tokens = append(tokens, filterToken{tokenString, value.String()})
+			i++
+		case isOperatorRune(r):
+			start := i
+			for i < len(runes) && isOperatorRune(runes[i]) {
+				i++
+			}
+			tokens = append(tokens, filterToken{tokenOperator, string(runes[start:i])})
+		default:
+			start := i
+			for i < len(runes) && !unicode.IsSpace(runes[i]) && !isOperatorRune(runes[i]) &&
+				runes[i] != '(' && runes[i] != ')' && runes[i] != '"' {
+				i++
+			}
+			tokens = append(tokens, filterToken{tokenWord, string(runes[start:i])})
+		}
+	}
+	return tokens, nil
+}
+
+// filterParser is a recursive descent parser for filter expressions.
+// AND binds tighter than OR.
+type filterParser struct {
+	tokens     []filterToken
+	pos        int
+	searchable []string
+	conditions int
+}
+
+// parseFilter turns a filter expression into a Mongo filter
+func parseFilter(expression string, searchable []string) (bson.M, error) {
+	if len(expression) > maxFilterLength {
+		return nil, errors.New("filter is too long")
+	}
+	tokens, err := tokenizeFilter(expression)
+	if err != nil {
+		return nil, err
+	}
+	parser := &filterParser{tokens: tokens, searchable: searchable}
+	filter, err := parser.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if parser.pos < len(parser.tokens) {
+		return nil, errors.New("unexpected '" + parser.tokens[parser.pos].value + "' in filter")
+	}
+	return filter, nil
+}
+
+// peekKeyword reports if the next token is the AND or OR keyword
+func (parser *filterParser) peekKeyword(keyword string) bool {
+	if parser.pos >= len(parser.tokens) {
+		return false
+	}
+	token := parser.tokens[parser.pos]
+	return token.kind == tokenWord && strings.EqualFold(token.value, keyword)
+}
+
+func (parser *filterParser) parseOr() (bson.M, error) {
+	return parser.parseJoined("OR", "$or", parser.parseAnd)
+}
+
+func (parser *filterParser) parseAnd() (bson.M, error) {
+	return parser.parseJoined("AND", "$and", parser.parseFactor)
+}
+
+// parseJoined parses operands separated by the keyword
+func (parser *filterParser) parseJoined(keyword string, operator string, operand func() (bson.M, error)) (bson.M, error) {
+	first, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	operands := bson.A{first}
+	for parser.peekKeyword(keyword) {
+		parser.pos++
+		next, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		operands = append(operands, next)
+	}
+	if len(operands) == 1 {
+		return first, nil
+	}
+	return bson.M{operator: operands}, nil
+}
+
+// parseFactor parses a parenthesised expression or a single condition
+func (parser *filterParser) parseFactor() (bson.M, error) {
+	if parser.pos >= len(parser.tokens) {
+		return nil, errors.New("filter ends unexpectedly")
+	}
+	if parser.tokens[parser.pos].kind == tokenOpen {
+		parser.pos++
+		filter, err := parser.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if parser.pos >= len(parser.tokens) || parser.tokens[parser.pos].kind != tokenClose {
+			return nil, errors.New("filter is missing a ')'")
+		}
+		parser.pos++
+		return filter, nil
+	}
+
+	// field operator value
+	if parser.pos+3 > len(parser.tokens) {
+		return nil, errors.New("filter condition must look like field=value")
+	}
+	field, op, value := parser.tokens[parser.pos], parser.tokens[parser.pos+1], parser.tokens[parser.pos+2]
+	if field.kind != tokenWord || op.kind != tokenOperator || (value.kind != tokenWord && value.kind != tokenString) {
+		return nil, errors.New("filter condition must look like field=value")
+	}
+	if !contains(parser.searchable, field.value) {
+		return nil, errors.New("can not search on '" + field.value + "', use any of " + strings.Join(parser.searchable, ", "))
+	}
+	parser.conditions++
+	if parser.conditions > maxFilterConditions {
+		return nil, errors.New("filter has too many conditions")
+	}
+	parser.pos += 3
+	return userCondition(field.value, op.value, value.value)
+}
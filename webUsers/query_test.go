@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestParseFilter(t *testing.T) {
+	emailIs := primitive.Regex{Pattern: `^ann\.smith@example\.com$`, Options: "i"}
+	tests := []struct {
+		expression string
+		want       bson.M
+	}{
+		{"username=ann", bson.M{"username": "ann"}},
+		{"username!=ann", bson.M{"username": bson.M{"$ne": "ann"}}},
+		{"name~a.n", bson.M{"name": primitive.Regex{Pattern: `a\.n`, Options: "i"}}},
+		{`surname="van der Berg"`, bson.M{"surname": "van der Berg"}},
+		{`name="say \"hi\""`, bson.M{"name": `say "hi"`}},
+		{"email=ann.smith@example.com", bson.M{"email": emailIs}},
+		{"email!=ann.smith@example.com", bson.M{"email": bson.M{"$not": emailIs}}},
+		{"dob>=1990-01-01", bson.M{"dob": bson.M{"$gte": "1990-01-01"}}},
+		{"dob<2000-01-01", bson.M{"dob": bson.M{"$lt": "2000-01-01"}}},
+		{
+			"name~ann AND surname=Smith OR username=bob",
+			bson.M{"$or": bson.A{
+				bson.M{"$and": bson.A{
+					bson.M{"name": primitive.Regex{Pattern: "ann", Options: "i"}},
+					bson.M{"surname": "Smith"},
+				}},
+				bson.M{"username": "bob"},
+			}},
+		},
+		{
+			"name~ann and (surname=Smith or dob>=1990-01-01)",
+			bson.M{"$and": bson.A{
+				bson.M{"name": primitive.Regex{Pattern: "ann", Options: "i"}},
+				bson.M{"$or": bson.A{
+					bson.M{"surname": "Smith"},
+					bson.M{"dob": bson.M{"$gte": "1990-01-01"}},
+				}},
+			}},
+		},
+	}
+	for _, test := range tests {
+		got, err := parseFilter(test.expression, selfFields)
+		if err != nil {
+			t.Errorf("parseFilter(%s) failed: %v", test.expression, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseFilter(%s) = %v, want %v", test.expression, got, test.want)
+		}
+	}
+}
+
+func TestParseFilterErrors(t *testing.T) {
+	tests := []struct {
+		expression string
+		searchable []string
+		want       string
+	}{
+		{"password=secret", selfFields, "can not search on 'password'"},
+		{"email=ann@example.com", publicFields, "can not search on 'email'"},
+		{"name=ann AND", selfFields, "filter ends unexpectedly"},
+		{"(name=ann", selfFields, "missing a ')'"},
+		{"name=ann)", selfFields, "unexpected ')'"},
+		{`name="ann`, selfFields, "unterminated string"},
+		{"name", selfFields, "must look like field=value"},
+		{"name=>ann", selfFields, "unknown operator '=>'"},
+		{"name<ann", selfFields, "only works on dob"},
+		{"dob>=yesterday", selfFields, "dob must be a date"},
+		{strings.Repeat("name=a OR ", 20) + "name=a", selfFields, "too many conditions"},
+		{strings.Repeat("x", maxFilterLength+1), selfFields, "too long"},
+	}
+	for _, test := range tests {
+		_, err := parseFilter(test.expression, test.searchable)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("parseFilter(%.40s) error = %v, want %q", test.expression, err, test.want)
+		}
+	}
+}
+
+func TestBuildUserFilter(t *testing.T) {
+	tests := []struct {
+		query string
+		want  bson.M
+		err   string
+	}{
+		{"limit=5&sort=name", bson.M{}, ""},
+		{"username=ann", bson.M{"username": "ann"}, ""},
+		{"name=a(n", bson.M{"name": primitive.Regex{Pattern: `a\(n`, Options: "i"}}, ""},
+		{
+			"dob_from=1990-01-01&filter=username=ann",
+			bson.M{"$and": bson.A{
+				bson.M{"dob": bson.M{"$gte": "1990-01-01"}},
+				bson.M{"username": "ann"},
+			}},
+			"",
+		},
+		{"name_from=a", nil, "unknown parameter 'name_from'"},
+		{"password=x", nil, "can not search on 'password'"},
+	}
+	for _, test := range tests {
+		params, _ := url.ParseQuery(test.query)
+		got, err := buildUserFilter(params, selfFields)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("buildUserFilter(%s) error = %v, want %q", test.query, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("buildUserFilter(%s) failed: %v", test.query, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("buildUserFilter(%s) = %v, want %v", test.query, got, test.want)
+		}
+	}
+}
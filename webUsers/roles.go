@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Body and response of the role endpoints
+type rolesBody struct {
+	Username string   `json:"username,omitempty"`
+	Roles    []string `json:"roles"`
+}
+
+// requireAdmin writes a 401 or 403 unless the caller is an admin
+func (connection Connection) requireAdmin(w http.ResponseWriter, req *http.Request) bool {
+	caller, err := connection.authenticate(req)
+	if err != nil {
+		authenticationFailed(w, req, err)
+		return false
+	}
+	if !connection.isAdmin(caller) {
+		writeProblem(w, req, http.StatusForbidden, "user "+caller.Username+" is not an admin")
+		return false
+	}
+	return true
+}
+
+// roleTarget loads the user named by the {id} route variable
+func (connection Connection) roleTarget(w http.ResponseWriter, req *http.Request) (User, bool) {
+	var user User
+	id := mux.Vars(req)["id"]
+	objectId, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		invalidID(w, req, id)
+		return user, false
+	}
+	err = connection.Users.FindOne(context.TODO(), bson.M{"_id": objectId}).Decode(&user)
+	if err != nil {
+		dbError(w, req, err, "user "+id)
+		return user, false
+	}
+	return user, true
+}
+
+// writeRoles stores the roles on the user and responds with the result
+func (connection Connection) writeRoles(w http.ResponseWriter, req *http.Request, user User, update bson.M) {
+	_, err := connection.Users.UpdateOne(context.TODO(), bson.M{"_id": user.ID}, update)
+	if err != nil {
+		dbError(w, req, err, "user "+user.ID.Hex())
+		return
+	}
+	updated, err := connection.findUserByHex(user.ID.Hex())
+	if err != nil {
+		dbError(w, req, err, "user "+user.ID.Hex())
+		return
+	}
+	connection.emit(UserEvent{Type: eventUserUpdated, UserID: updated.ID, Username: updated.Username, Email: updated.Email, Changed: []string{"roles"}})
+	json.NewEncoder(w).Encode(rolesBody{
+		Username: updated.Username,
+		Roles:    connection.effectiveRoles(updated),
+	})
+}
+
+//Handlers
+func (connection Connection) getRoles(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !connection.requireAdmin(w, req) {
+		return
+	}
+	user, ok := connection.roleTarget(w, req)
+	if !ok {
+		return
+	}
+	json.NewEncoder(w).Encode(rolesBody{
+		Username: user.Username,
+		Roles:    connection.effectiveRoles(user),
+	})
+}
+
+func (connection Connection) setRoles(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !connection.requireAdmin(w, req) {
+		return
+	}
+	user, ok := connection.roleTarget(w, req)
+	if !ok {
+		return
+	}
+	var body rolesBody
+	err := json.NewDecoder(req.Body).Decode(&body)
+	if err != nil {
+		writeProblem(w, req, http.StatusBadRequest, err.Error())
+		return
+	}
+	// An empty list clears the roles, a missing one is a mistake
+	if body.Roles == nil {
+		writeProblem(w, req, http.StatusBadRequest, "roles is required, send [] to remove every role")
+		return
+	}
+	for _, role := range body.Roles {
+		if !isKnownRole(role) {
+			writeProblem(w, req, http.StatusBadRequest, "unknown role "+role)
+			return
+		}
+	}
+	connection.writeRoles(w, req, user, bson.M{"$set": bson.M{"roles": body.Roles}})
+}
+
+func (connection Connection) addRole(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !connection.requireAdmin(w, req) {
+		return
+	}
+	user, ok := connection.roleTarget(w, req)
+	if !ok {
+		return
+	}
+	role := mux.Vars(req)["role"]
+	if !isKnownRole(role) {
+		writeProblem(w, req, http.StatusBadRequest, "unknown role "+role)
+		return
+	}
+	connection.writeRoles(w, req, user, bson.M{"$addToSet": bson.M{"roles": role}})
+}
+
+func (connection Connection) removeRole(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !connection.requireAdmin(w, req) {
+		return
+	}
+	user, ok := connection.roleTarget(w, req)
+	if !ok {
+		return
+	}
+	role := mux.Vars(req)["role"]
+	connection.writeRoles(w, req, user, bson.M{"$pull": bson.M{"roles": role}})
+}
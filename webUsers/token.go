@@ -0,0 +1,366 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Lifetimes of issued tokens
+const (
+	accessTokenTTL  = 15 * time.Minute
+	refreshTokenTTL = 7 * 24 * time.Hour
+)
+
+// Token types stored in the typ claim
+const (
+	tokenAccess  = "access"
+	tokenRefresh = "refresh"
+)
+
+var (
+	errTokenInvalid = errors.New("token is invalid")
+	errTokenExpired = errors.New("token has expired")
+	errTokenRevoked = errors.New("token has been revoked")
+	errUserGone     = errors.New("user no longer exists")
+)
+
+// Claims carried in a signed token
+type Claims struct {
+	Subject   string `json:"sub"`
+	UserID    string `json:"uid"`
+	Type      string `json:"typ"`
+	ID        string `json:"jti"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+	// TokenVersion of the user when the token was issued
+	Version int `json:"ver,omitempty"`
+}
+
+// Pair of tokens returned by /login and /token/refresh
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+}
+
+// Body accepted by /token/refresh and /token/revoke
+type tokenRequest struct {
+	RefreshToken string `json:"refresh_token,omitempty"`
+	Token        string `json:"token,omitempty"`
+}
+
+// Fixed JWT header, tokens are always HS256
+var tokenHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// newTokenID returns a random identifier used as the jti claim
+func newTokenID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// signToken encodes the claims as a JWT signed with HMAC-SHA256
+func signToken(secret []byte, claims Claims) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	unsigned := tokenHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// parseToken checks the signature and expiry of a token and returns its claims
+func parseToken(secret []byte, token string) (Claims, error) {
+	var claims Claims
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != tokenHeader {
+		return claims, errTokenInvalid
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return claims, errTokenInvalid
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return claims, errTokenInvalid
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return claims, errTokenInvalid
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return claims, errTokenInvalid
+	}
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return claims, errTokenExpired
+	}
+	return claims, nil
+}
+
+// issueTokens creates a new access and refresh token for the user
+func (connection Connection) issueTokens(user User) (tokenResponse, error) {
+	var response tokenResponse
+	now := time.Now()
+	access := Claims{
+		Subject:   user.Username,
+		UserID:    user.ID.Hex(),
+		Type:      tokenAccess,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(accessTokenTTL).Unix(),
+		Version:   user.TokenVersion,
+	}
+	refresh := access
+	refresh.Type = tokenRefresh
+	refresh.ExpiresAt = now.Add(refreshTokenTTL).Unix()
+
+	var err error
+	if access.ID, err = newTokenID(); err != nil {
+		return response, err
+	}
+	if refresh.ID, err = newTokenID(); err != nil {
+		return response, err
+	}
+	if response.AccessToken, err = signToken(connection.Secret, access); err != nil {
+		return response, err
+	}
+	if response.RefreshToken, err = signToken(connection.Secret, refresh); err != nil {
+		return response, err
+	}
+	response.TokenType = "Bearer"
+	response.ExpiresIn = int64(accessTokenTTL.Seconds())
+	return response, nil
+}
+
+// verifyToken parses a token of the given type and checks the revocation list
+func (connection Connection) verifyToken(token string, typ string) (Claims, error) {
+	claims, err := parseToken(connection.Secret, token)
+	if err != nil {
+		return claims, err
+	}
+	if claims.Type != typ {
+		return claims, errTokenInvalid
+	}
+	err = connection.Revoked.FindOne(context.TODO(), bson.M{"_id": claims.ID}).Err()
+	if err == nil {
+		return claims, errTokenRevoked
+	}
+	if err != mongo.ErrNoDocuments {
+		return claims, err
+	}
+	return claims, nil
+}
+
+// tokenUser loads the user a verified token was issued to. Tokens from
+// before the user's last password change are revoked.
+func (connection Connection) tokenUser(claims Claims) (User, error) {
+	user, err := connection.findUserByHex(claims.UserID)
+	if err == mongo.ErrNoDocuments {
+		return user, errUserGone
+	}
+	if err != nil {
+		return user, err
+	}
+	if claims.Version != user.TokenVersion {
+		return User{}, errTokenRevoked
+	}
+	return user, nil
+}
+
+// isCredentialError reports if authenticating failed because of the
+// credentials, other errors mean they could not be checked
+func isCredentialError(err error) bool {
+	switch err {
+	case errBadCredentials, errNoCredentials, errTokenInvalid, errTokenExpired, errTokenRevoked, errUserGone:
+		return true
+	}
+	return false
+}
+
+// revokeToken adds the token to the revocation list until it would have expired
+func (connection Connection) revokeToken(claims Claims) error {
+	_, err := connection.Revoked.UpdateOne(
+		context.TODO(),
+		bson.M{"_id": claims.ID},
+		bson.M{"$setOnInsert": bson.M{
+			"sub":       claims.Subject,
+			"expiresAt": time.Unix(claims.ExpiresAt, 0),
+		}},
+		options.Update().SetUpsert(true),
+	)
+	return err
+}
+
+// claimToken uses up a single use token. The insert keyed by jti only
+// succeeds once, concurrent refreshes with the same token get
+// errTokenRevoked.
+func (connection Connection) claimToken(claims Claims) error {
+	_, err := connection.Revoked.InsertOne(context.TODO(), bson.M{
+		"_id":       claims.ID,
+		"sub":       claims.Subject,
+		"expiresAt": time.Unix(claims.ExpiresAt, 0),
+	})
+	if mongo.IsDuplicateKeyError(err) {
+		return errTokenRevoked
+	}
+	return err
+}
+
+// ensureRevokedIndexes lets Mongo drop revoked tokens once they have expired
+func ensureRevokedIndexes(ctx context.Context, revoked *mongo.Collection) error {
+	_, err := revoked.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.M{"expiresAt": 1},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	return err
+}
+
+// bearerToken returns the token from an "Authorization: Bearer" header
+func bearerToken(req *http.Request) (string, bool) {
+	header := req.Header.Get("Authorization")
+	const prefix = "Bearer "
+	if len(header) <= len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return "", false
+	}
+	return strings.TrimSpace(header[len(prefix):]), true
+}
+
+// loadTokenSecret returns the configured signing key.
+// Without one a random key is used and tokens stop working on restart.
+func loadTokenSecret(configured string) []byte {
+	if configured != "" {
+		return []byte(configured)
+	}
+	log.Println("tokenSecret not set, using a random signing key")
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		log.Fatal(err)
+	}
+	return secret
+}
+
+//Handlers
+func (connection Connection) login(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	// Accept basic auth or a json body with username and password
+	u, p, ok := req.BasicAuth()
+	if !ok {
+		var credentials UserInput
+		err := json.NewDecoder(req.Body).Decode(&credentials)
+		if err != nil || credentials.Username == "" {
+			writeProblem(w, req, http.StatusUnauthorized, "username and password required")
+			return
+		}
+		u, p = credentials.Username, credentials.Password
+	}
+	user, ok := connection.checkCredentials(u, p)
+	if !ok {
+		writeProblem(w, req, http.StatusUnauthorized, "invalid username or password")
+		return
+	}
+
+	tokens, err := connection.issueTokens(user)
+	if err != nil {
+		serverError(w, req, err)
+		return
+	}
+	json.NewEncoder(w).Encode(tokens)
+}
+
+func (connection Connection) refreshToken(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var body tokenRequest
+	_ = json.NewDecoder(req.Body).Decode(&body)
+	claims, err := connection.verifyToken(body.RefreshToken, tokenRefresh)
+	if err != nil {
+		authenticationFailed(w, req, err)
+		return
+	}
+
+	// Make sure the user still exists and kept the password before
+	// issuing new tokens
+	user, err := connection.tokenUser(claims)
+	if err != nil {
+		authenticationFailed(w, req, err)
+		return
+	}
+
+	// Refresh tokens are single use, only the first request claiming it
+	// gets new tokens
+	err = connection.claimToken(claims)
+	if err == errTokenRevoked {
+		writeProblem(w, req, http.StatusUnauthorized, err.Error())
+		return
+	}
+	if err != nil {
+		serverError(w, req, err)
+		return
+	}
+	tokens, err := connection.issueTokens(user)
+	if err != nil {
+		serverError(w, req, err)
+		return
+	}
+	json.NewEncoder(w).Encode(tokens)
+}
+
+func (connection Connection) revoke(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	// Revoke the bearer token and any token given in the body
+	var tokens []string
+	if token, ok := bearerToken(req); ok {
+		tokens = append(tokens, token)
+	}
+	var body tokenRequest
+	_ = json.NewDecoder(req.Body).Decode(&body)
+	for _, token := range []string{body.Token, body.RefreshToken} {
+		if token != "" {
+			tokens = append(tokens, token)
+		}
+	}
+	if len(tokens) == 0 {
+		writeProblem(w, req, http.StatusBadRequest, "no token given")
+		return
+	}
+
+	for _, token := range tokens {
+		// Expired tokens can not be used anyway
+		claims, err := parseToken(connection.Secret, token)
+		if err == errTokenExpired {
+			continue
+		}
+		if err != nil {
+			writeProblem(w, req, http.StatusUnauthorized, err.Error())
+			return
+		}
+		err = connection.revokeToken(claims)
+		if err != nil {
+			serverError(w, req, err)
+			return
+		}
+		// Services that cache credentials drop the user's
+		userID, _ := primitive.ObjectIDFromHex(claims.UserID)
+		connection.emit(UserEvent{Type: eventUserUpdated, UserID: userID, Username: claims.Subject, Changed: []string{"tokens"}})
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
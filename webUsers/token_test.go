@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestIssuedTokensCarryTokenVersion(t *testing.T) {
+	connection := Connection{Secret: []byte("test secret")}
+	user := User{ID: primitive.NewObjectID(), Username: "ann", TokenVersion: 3}
+	tokens, err := connection.issueTokens(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, token := range []string{tokens.AccessToken, tokens.RefreshToken} {
+		claims, err := parseToken(connection.Secret, token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if claims.Version != user.TokenVersion || claims.UserID != user.ID.Hex() {
+			t.Errorf("%s token has version %d of %s, want %d of %s", claims.Type, claims.Version, claims.UserID, user.TokenVersion, user.ID.Hex())
+		}
+	}
+}
+
+func TestIsCredentialError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{errBadCredentials, true},
+		{errNoCredentials, true},
+		{errTokenInvalid, true},
+		{errTokenExpired, true},
+		{errTokenRevoked, true},
+		{errUserGone, true},
+		{errors.New("server selection error: context deadline exceeded"), false},
+	}
+	for _, test := range tests {
+		if got := isCredentialError(test.err); got != test.want {
+			t.Errorf("isCredentialError(%v) = %v, want %v", test.err, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/mail"
+	"strings"
+	"time"
+	"unicode"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Layout the dob field must use
+const dobLayout = "2006-01-02"
+
+// Minimum length of a new password
+const minPasswordLength = 8
+
+// Problems found in a request, keyed by field name
+type fieldErrors map[string]string
+
+// emailCollation compares emails ignoring case, the unique email index and
+// every lookup that must agree with it use it
+var emailCollation = &options.Collation{Locale: "en", Strength: 2}
+
+// validateUser checks the input fields. With partial set only fields that
+// are present are checked, as used by updates.
+func validateUser(input UserInput, partial bool) fieldErrors {
+	errs := fieldErrors{}
+
+	if !partial || input.Name != "" {
+		if strings.TrimSpace(input.Name) == "" {
+			errs["name"] = "name is required"
+		}
+	}
+	if !partial || input.Username != "" {
+		username := strings.TrimSpace(input.Username)
+		if username == "" {
+			errs["username"] = "username is required"
+		} else if username != input.Username || strings.ContainsAny(username, " \t:") {
+			errs["username"] = "username may not contain spaces or colons"
+		}
+	}
+	if !partial || input.Email != "" {
+		address, err := mail.ParseAddress(input.Email)
+		if err != nil || address.Address != input.Email {
+			errs["email"] = "email must be a valid address like name@example.com"
+		}
+	}
+	if !partial || input.Password != "" {
+		if msg := checkPasswordStrength(input.Password); msg != "" {
+			errs["password"] = msg
+		}
+	}
+	if input.Dob != "" {
+		dob, err := time.Parse(dobLayout, input.Dob)
+		if err != nil {
+			errs["dob"] = "dob must be a date formatted as YYYY-MM-DD"
+		} else if dob.After(time.Now()) {
+			errs["dob"] = "dob can not be in the future"
+		}
+	}
+	return errs
+}
+
+// checkPasswordStrength returns why a password is too weak, or "" if it is fine
+func checkPasswordStrength(password string) string {
+	if len(password) < minPasswordLength {
+		return "password must be at least 8 characters"
+	}
+	var letter, digit bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLetter(r):
+			letter = true
+		case unicode.IsDigit(r):
+			digit = true
+		}
+	}
+	if !letter || !digit {
+		return "password must contain both letters and digits"
+	}
+	return ""
+}
+
+// findConflicts reports which unique fields are already used by another user
+func (connection Connection) findConflicts(input UserInput, self primitive.ObjectID) (fieldErrors, error) {
+	errs := fieldErrors{}
+	for field, value := range map[string]string{"username": input.Username, "email": input.Email} {
+		if value == "" {
+			continue
+		}
+		filter := bson.M{field: value, "_id": bson.M{"$ne": self}}
+		find := options.FindOne()
+		if field == "email" {
+			find.SetCollation(emailCollation)
+		}
+		err := connection.Users.FindOne(context.TODO(), filter, find).Err()
+		if err == nil {
+			errs[field] = field + " " + value + " is already taken"
+		} else if err != mongo.ErrNoDocuments {
+			return errs, err
+		}
+	}
+	return errs, nil
+}
+
+// duplicateField guesses which unique index a duplicate key error came from
+func duplicateField(err error) fieldErrors {
+	if strings.Contains(err.Error(), "email") {
+		return fieldErrors{"email": "email is already taken"}
+	}
+	return fieldErrors{"username": "username is already taken"}
+}
+
+// Name of the unique email index from before it ignored case
+const legacyEmailIndex = "email_unique"
+
+// ensureUserIndexes makes username and email unique, emails ignoring case.
+// Documents without the field are left out so legacy records do not clash.
+func ensureUserIndexes(ctx context.Context, users *mongo.Collection) error {
+	_, err := users.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys: bson.M{"username": 1},
+			Options: options.Index().SetName("username_unique").SetUnique(true).
+				SetPartialFilterExpression(bson.M{"username": bson.M{"$type": "string"}}),
+		},
+		{
+			Keys: bson.M{"email": 1},
+			Options: options.Index().SetName("email_unique_ci").SetUnique(true).SetCollation(emailCollation).
+				SetPartialFilterExpression(bson.M{"email": bson.M{"$type": "string"}}),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	// The case sensitive index is covered by the new one
+	_, err = users.Indexes().DropOne(ctx, legacyEmailIndex)
+	var cmdErr mongo.CommandError
+	if errors.As(err, &cmdErr) && cmdErr.Name == "IndexNotFound" {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func TestCheckPasswordStrength(t *testing.T) {
+	tests := []struct {
+		password string
+		want     string
+	}{
+		{"", "password must be at least 8 characters"},
+		{"abc123", "password must be at least 8 characters"},
+		{"abcdefgh", "password must contain both letters and digits"},
+		{"12345678", "password must contain both letters and digits"},
+		{"!!!!!!!!", "password must contain both letters and digits"},
+		{"abcdefg1", ""},
+		{"wachtwoord 2022", ""},
+		{"pässwörd9", ""},
+	}
+	for _, test := range tests {
+		if got := checkPasswordStrength(test.password); got != test.want {
+			t.Errorf("checkPasswordStrength(%q) = %q, want %q", test.password, got, test.want)
+		}
+	}
+}
+
+// testDatabase connects to the Mongo in MONGODB_TEST_URI and returns a
+// fresh database that is dropped after the test
+func testDatabase(t *testing.T) *mongo.Database {
+	uri := os.Getenv("MONGODB_TEST_URI")
+	if uri == "" {
+		t.Skip("set MONGODB_TEST_URI to run tests against Mongo")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := client.Database("test_" + primitive.NewObjectID().Hex())
+	t.Cleanup(func() {
+		db.Drop(context.Background())
+		client.Disconnect(context.Background())
+	})
+	return db
+}
+
+func TestEmailsUniqueIgnoringCase(t *testing.T) {
+	db := testDatabase(t)
+	ctx := context.Background()
+	connection := Connection{Users: db.Collection("Users")}
+	// The index from before emails ignored case is replaced
+	_, err := connection.Users.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.M{"email": 1},
+		Options: options.Index().SetName(legacyEmailIndex).SetUnique(true),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ensureUserIndexes(ctx, connection.Users); err != nil {
+		t.Fatal(err)
+	}
+	if err := ensureUserIndexes(ctx, connection.Users); err != nil {
+		t.Fatalf("second ensureUserIndexes: %v", err)
+	}
+	names, err := connection.Users.Indexes().ListSpecifications(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, index := range names {
+		if index.Name == legacyEmailIndex {
+			t.Errorf("index %s was not dropped", legacyEmailIndex)
+		}
+	}
+
+	owner := primitive.NewObjectID()
+	_, err = connection.Users.InsertOne(ctx, User{ID: owner, Username: "ann", Email: "Ann@Example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs, err := connection.findConflicts(UserInput{Username: "other", Email: "ann@example.COM"}, primitive.NewObjectID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := errs["email"]; !ok {
+		t.Errorf("findConflicts(ann@example.COM) = %v, want an email conflict", errs)
+	}
+	errs, err = connection.findConflicts(UserInput{Email: "ANN@example.com"}, owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(errs) != 0 {
+		t.Errorf("findConflicts of the user's own email = %v, want none", errs)
+	}
+	_, err = connection.Users.InsertOne(ctx, User{Username: "other", Email: "ANN@example.com"})
+	if !mongo.IsDuplicateKeyError(err) {
+		t.Errorf("inserting ANN@example.com: %v, want a duplicate key error", err)
+	} else if fields := duplicateField(err); fields["email"] == "" {
+		t.Errorf("duplicateField(%v) = %v, want email", err, fields)
+	}
+}
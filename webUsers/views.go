@@ -0,0 +1,187 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/FilipVdZel/pagination"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Body accepted when creating or updating a user
+type UserInput struct {
+	Name     string `json:"name,omitempty"`
+	Surname  string `json:"surname,omitempty"`
+	Email    string `json:"email,omitempty"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	Dob      string `json:"dob,omitempty"`
+}
+
+// toUser copies the input into a storage model
+func (input UserInput) toUser() User {
+	return User{
+		Name:     input.Name,
+		Surname:  input.Surname,
+		Email:    input.Email,
+		Username: input.Username,
+		Password: input.Password,
+		Dob:      input.Dob,
+	}
+}
+
+// Fields anyone can see
+type PublicUser struct {
+	Username string `json:"username,omitempty"`
+	Name     string `json:"name,omitempty"`
+	Surname  string `json:"surname,omitempty"`
+}
+
+// Fields a user can see about themselves
+type SelfUser struct {
+	ID       primitive.ObjectID `json:"_id,omitempty"`
+	Name     string             `json:"name,omitempty"`
+	Surname  string             `json:"surname,omitempty"`
+	Email    string             `json:"email,omitempty"`
+	Username string             `json:"username,omitempty"`
+	Dob      string             `json:"dob,omitempty"`
+	Roles    []string           `json:"roles,omitempty"`
+}
+
+// Fields admins and other services can see
+type AdminUser struct {
+	SelfUser
+	LegacyPassword bool `json:"legacy_password"`
+}
+
+// How much of a user document the caller may see
+type viewLevel int
+
+const (
+	viewPublic viewLevel = iota
+	viewSelf
+	viewAdmin
+)
+
+// Mongo projections matching each view
+var (
+	publicProjection = bson.M{"_id": 1, "username": 1, "name": 1, "surname": 1}
+	selfProjection   = bson.M{"password": 0}
+	adminProjection  = bson.M{}
+)
+
+// projection returns the fields to load for the view level
+func (level viewLevel) projection() bson.M {
+	switch level {
+	case viewAdmin:
+		return adminProjection
+	case viewSelf:
+		return selfProjection
+	default:
+		return publicProjection
+	}
+}
+
+// Fields that can be sorted on and selected in each view
+var (
+	publicFields = []string{"username", "name", "surname"}
+	selfFields   = []string{"username", "name", "surname", "email", "dob", "roles"}
+)
+
+// sortable returns the fields the view level may sort on
+func (level viewLevel) sortable() []pagination.Field {
+	names := []string{"username", "name", "surname", "email", "dob"}
+	if level == viewPublic {
+		names = publicFields
+	}
+	// Every sortable user field is a string
+	fields := make([]pagination.Field, len(names))
+	for i, name := range names {
+		fields[i] = pagination.Field{Name: name, Type: bsontype.String}
+	}
+	return fields
+}
+
+// selectable returns the fields the view level may pick with ?fields=
+func (level viewLevel) selectable() []string {
+	if level == viewPublic {
+		return publicFields
+	}
+	return selfFields
+}
+
+// alwaysLoaded returns fields the view needs even when not selected
+func (level viewLevel) alwaysLoaded() []string {
+	if level == viewAdmin {
+		return []string{"password"}
+	}
+	return nil
+}
+
+// render converts a storage model into the response for the view level
+func (level viewLevel) render(user User) interface{} {
+	self := SelfUser{
+		ID:       user.ID,
+		Name:     user.Name,
+		Surname:  user.Surname,
+		Email:    user.Email,
+		Username: user.Username,
+		Dob:      user.Dob,
+		Roles:    user.Roles,
+	}
+	switch level {
+	case viewAdmin:
+		return AdminUser{
+			SelfUser:       self,
+			LegacyPassword: user.Password != "" && !isHashed(user.Password),
+		}
+	case viewSelf:
+		return self
+	default:
+		return PublicUser{
+			Username: user.Username,
+			Name:     user.Name,
+			Surname:  user.Surname,
+		}
+	}
+}
+
+// renderAll converts a list of storage models for the view level
+func (level viewLevel) renderAll(users []User) []interface{} {
+	views := make([]interface{}, 0, len(users))
+	for _, user := range users {
+		views = append(views, level.render(user))
+	}
+	return views
+}
+
+// isService reports if the request carries the key shared with other services
+func (connection Connection) isService(req *http.Request) bool {
+	key := req.Header.Get("X-Service-Key")
+	return connection.ServiceKey != "" && key != "" &&
+		subtle.ConstantTimeCompare([]byte(key), []byte(connection.ServiceKey)) == 1
+}
+
+// viewerLevel decides which view of the target user the caller gets.
+// Pass primitive.NilObjectID when listing several users.
+func (connection Connection) viewerLevel(req *http.Request, target primitive.ObjectID) viewLevel {
+	if connection.isService(req) {
+		return viewAdmin
+	}
+	if req.Header.Get("Authorization") == "" {
+		return viewPublic
+	}
+	caller, err := connection.authenticate(req)
+	if err != nil {
+		return viewPublic
+	}
+	if connection.isAdmin(caller) {
+		return viewAdmin
+	}
+	if !target.IsZero() && caller.ID == target {
+		return viewSelf
+	}
+	return viewPublic
+}